@@ -0,0 +1,193 @@
+package coalago
+
+import (
+	"context"
+	"sync"
+)
+
+// Call is a request sent with Client.Go.
+type Call struct {
+	Request  *Request
+	Response *Response // set when the call is done
+	Error    error     // set when the call is done
+	// Done receives the call when it is done
+	Done chan *Call
+
+	done chan struct{}
+}
+
+func (call *Call) finish(resp *Response, err error) {
+	call.Response, call.Error = resp, err
+	close(call.done)
+	call.Done <- call
+}
+
+// Wait waits for the call and returns its response.
+func (call *Call) Wait() (*Response, error) {
+	<-call.done
+	return call.Response, call.Error
+}
+
+// Go sends req in the background and returns at once. Calls to one peer share the
+// socket of the client. Under WithNStart they run n at a time and the others wait in
+// the order Go was called; a call that finds WithMaxPending requests of the client
+// waiting fails with ErrTooManyPending.
+//
+//	calls := make([]*coalago.Call, len(devices))
+//	for i, uri := range devices {
+//		calls[i] = client.Go(coalago.NewRequest(coalago.GET, uri))
+//	}
+//	for _, call := range calls {
+//		resp, err := call.Wait()
+//		...
+//	}
+func (c *Client) Go(req *Request) *Call {
+	call := &Call{Request: req, Done: make(chan *Call, 1), done: make(chan struct{})}
+	msg, err := req.message()
+	if err != nil {
+		call.finish(nil, err)
+		return call
+	}
+	addr := msg.Recipient.String()
+	peer, turn, err := c.reserve(msg, addr)
+	if err != nil {
+		call.finish(nil, err)
+		return call
+	}
+
+	go func() {
+		ctx, cancel := req.context()
+		defer cancel()
+		msg.Context = ctx
+		if turn != nil {
+			if err := c.limiter.wait(ctx, peer, turn); err != nil {
+				call.finish(nil, err)
+				return
+			}
+			defer c.limiter.release(peer)
+		}
+		call.finish(c.exchange(msg, addr))
+	}()
+	return call
+}
+
+// InFlight returns the number of confirmable requests of the client being exchanged
+// and the number waiting for WithNStart.
+func (c *Client) InFlight() (active, pending int) {
+	return c.limiter.counts()
+}
+
+// peerLimiter enforces NSTART: at most nstart requests are outstanding per peer, and
+// at most maxPending wait for their turn.
+type peerLimiter struct {
+	nstart     int
+	maxPending int
+
+	mx      sync.Mutex
+	active  map[string]int
+	waiting map[string][]chan struct{} // FIFO; a closed channel owns a slot
+	total   int                        // sum of active
+	pending int
+}
+
+func newPeerLimiter(nstart, maxPending int) *peerLimiter {
+	return &peerLimiter{
+		nstart:     nstart,
+		maxPending: maxPending,
+		active:     make(map[string]int),
+		waiting:    make(map[string][]chan struct{}),
+	}
+}
+
+// acquire takes a slot of peer, waiting for one unless ctx is done first.
+func (l *peerLimiter) acquire(ctx context.Context, peer string) (release func(), err error) {
+	turn, err := l.reserve(peer)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.wait(ctx, peer, turn); err != nil {
+		return nil, err
+	}
+	return func() { l.release(peer) }, nil
+}
+
+// reserve queues a request to peer without waiting; turn is closed when the request
+// owns a slot.
+func (l *peerLimiter) reserve(peer string) (turn chan struct{}, err error) {
+	turn = make(chan struct{})
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.nstart == 0 || l.active[peer] < l.nstart {
+		l.active[peer]++
+		l.total++
+		close(turn)
+		return turn, nil
+	}
+	if l.pending >= l.maxPending {
+		return nil, ErrTooManyPending
+	}
+	l.waiting[peer] = append(l.waiting[peer], turn)
+	l.pending++
+	return turn, nil
+}
+
+// wait waits for the turn of a reservation, or gives it up when ctx is done first.
+func (l *peerLimiter) wait(ctx context.Context, peer string, turn chan struct{}) error {
+	select {
+	case <-turn:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	select {
+	case <-turn:
+		// Granted meanwhile: pass the slot on
+		l.releaseLocked(peer)
+		return ctx.Err()
+	default:
+	}
+	queue := l.waiting[peer]
+	for i, ch := range queue {
+		if ch == turn {
+			l.waiting[peer] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(l.waiting[peer]) == 0 {
+		delete(l.waiting, peer)
+	}
+	l.pending--
+	return ctx.Err()
+}
+
+func (l *peerLimiter) release(peer string) {
+	l.mx.Lock()
+	l.releaseLocked(peer)
+	l.mx.Unlock()
+}
+
+// releaseLocked hands the slot of peer to the first waiter, or frees it.
+func (l *peerLimiter) releaseLocked(peer string) {
+	if queue := l.waiting[peer]; len(queue) > 0 {
+		close(queue[0])
+		if len(queue) == 1 {
+			delete(l.waiting, peer)
+		} else {
+			l.waiting[peer] = queue[1:]
+		}
+		l.pending--
+		return
+	}
+	l.total--
+	if l.active[peer]--; l.active[peer] == 0 {
+		delete(l.active, peer)
+	}
+}
+
+func (l *peerLimiter) counts() (active, pending int) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.total, l.pending
+}
@@ -0,0 +1,165 @@
+package coalago
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientGo(t *testing.T) {
+	var current, peak atomic.Int32
+	s := NewServer()
+	s.GET("/slow", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		n := current.Add(1)
+		defer current.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		return NewResponse(NewStringPayload(message.GetURIQuery("n")), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+	client := NewClient(WithNStart(2))
+	defer client.Close()
+
+	calls := make([]*Call, 10)
+	for i := range calls {
+		calls[i] = client.Go(NewRequest(GET, fmt.Sprintf("coap://%s/slow?n=%d", addr, i)))
+	}
+	if active, pending := client.InFlight(); active > 2 || active+pending == 0 {
+		t.Errorf("InFlight() = %d, %d right after Go", active, pending)
+	}
+	for i, call := range calls {
+		resp, err := call.Wait()
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if string(resp.Body) != fmt.Sprint(i) {
+			t.Fatalf("call %d got %q", i, resp.Body)
+		}
+		if done := <-call.Done; done != call {
+			t.Fatalf("call %d: Done delivered another call", i)
+		}
+	}
+	if p := peak.Load(); p != 2 {
+		t.Fatalf("%d requests handled at once, want NSTART = 2", p)
+	}
+	if active, pending := client.InFlight(); active != 0 || pending != 0 {
+		t.Fatalf("InFlight() = %d, %d after all calls", active, pending)
+	}
+}
+
+func TestClientDoesNotLimitByDefault(t *testing.T) {
+	unblock := make(chan struct{})
+	s := NewServer()
+	s.GET("/blocked", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		<-unblock
+		return NewResponse(NewStringPayload("blocked"), CoapCodeContent)
+	})
+	s.GET("/fast", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("fast"), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+	client := NewClient()
+	defer client.Close()
+
+	blocked := client.Go(NewRequest(GET, "coap://"+addr+"/blocked"))
+	resp, err := client.GET("coap://" + addr + "/fast")
+	active, pending := client.InFlight()
+	close(unblock)
+	if err != nil {
+		t.Fatalf("GET() next to an outstanding request: %v", err)
+	}
+	if string(resp.Body) != "fast" {
+		t.Fatalf("body = %q", resp.Body)
+	}
+	if active != 1 || pending != 0 {
+		t.Fatalf("InFlight() = %d, %d, want the blocked request only", active, pending)
+	}
+	if _, err := blocked.Wait(); err != nil {
+		t.Fatalf("blocked request: %v", err)
+	}
+}
+
+func TestClientMaxPending(t *testing.T) {
+	addr := silentPeer(t)
+	client := NewClient(WithNStart(1), WithMaxPending(1))
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	uri := "coap://" + addr + "/silent"
+	active := client.Go(NewRequest(GET, uri).WithContext(ctx))
+	waitFor(t, func() bool { a, _ := client.InFlight(); return a == 1 })
+	pending := client.Go(NewRequest(GET, uri).WithTimeout(50 * time.Millisecond))
+	waitFor(t, func() bool { _, p := client.InFlight(); return p == 1 })
+
+	if _, err := client.Do(NewRequest(GET, uri)); err != ErrTooManyPending {
+		t.Fatalf("Do() with a full queue error = %v, want %v", err, ErrTooManyPending)
+	}
+	// NON requests do not wait
+	if _, err := client.Do(NewRequest(GET, uri).NonConfirmable()); err != nil {
+		t.Fatalf("NON Do() error = %v", err)
+	}
+	if _, err := pending.Wait(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("pending call error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if a, p := client.InFlight(); a != 1 || p != 0 {
+		t.Fatalf("InFlight() = %d, %d after the pending call timed out, want 1, 0", a, p)
+	}
+
+	cancel()
+	if _, err := active.Wait(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("active call error = %v, want %v", err, context.Canceled)
+	}
+	if a, p := client.InFlight(); a != 0 || p != 0 {
+		t.Fatalf("InFlight() = %d, %d at the end", a, p)
+	}
+}
+
+func TestPeerLimiterOrder(t *testing.T) {
+	l := newPeerLimiter(1, 10)
+	release, err := l.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other peers are not limited by a
+	releaseB, err := l.acquire(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseB()
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			r, err := l.acquire(context.Background(), "a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			r()
+		}(i)
+		waitFor(t, func() bool { _, p := l.counts(); return p == i+1 })
+	}
+	release()
+	for want := 0; want < 3; want++ {
+		if got := <-order; got != want {
+			t.Fatalf("waiter %d went before waiter %d", got, want)
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
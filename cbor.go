@@ -0,0 +1,249 @@
+package coalago
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// cborMaxDepth bounds the nesting of arrays, maps and tags accepted by decodeCBOR.
+const cborMaxDepth = 128
+
+// unmarshalCBOR decodes CBOR data (RFC 8949) into v. The CBOR value is converted to its
+// JSON counterpart and decoded with encoding/json, so v follows the encoding/json
+// rules and struct tags; byte strings decode into []byte fields, non-string map keys
+// are matched by their decimal or textual form, and tags are ignored.
+func unmarshalCBOR(data []byte, v interface{}) error {
+	value, rest, err := decodeCBOR(data, 0)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidCBOR, len(rest))
+	}
+	if p, ok := v.(*interface{}); ok {
+		*p = value
+		return nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCBOR, err)
+	}
+	return json.Unmarshal(b, v)
+}
+
+// decodeCBOR decodes the first data item of data into nil, bool, uint64, int64,
+// float64, []byte, string, []interface{} or map[string]interface{} and returns the
+// bytes that follow it.
+func decodeCBOR(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deep", ErrInvalidCBOR)
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	if major == 7 {
+		return decodeCBORSimple(info, data)
+	}
+	if info == 31 {
+		return decodeCBORIndefinite(major, data, depth)
+	}
+	n, data, err := cborArgument(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		return n, data, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: negative integer out of range", ErrInvalidCBOR)
+		}
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if n > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+		}
+		if major == 3 {
+			return string(data[:n]), data[n:], nil
+		}
+		return append([]byte(nil), data[:n]...), data[n:], nil
+	case 4:
+		// Every item takes at least one byte
+		if n > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			if item, data, err = decodeCBOR(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if n > uint64(len(data))/2 {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+		}
+		m := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			if data, err = decodeCBORPair(m, data, depth); err != nil {
+				return nil, nil, err
+			}
+		}
+		return m, data, nil
+	default: // 6, a tag: the tagged item stands for itself
+		return decodeCBOR(data, depth+1)
+	}
+}
+
+// decodeCBORPair decodes a key and a value of a map into m.
+func decodeCBORPair(m map[string]interface{}, data []byte, depth int) ([]byte, error) {
+	key, data, err := decodeCBOR(data, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	value, data, err := decodeCBOR(data, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case string:
+		m[k] = value
+	case []byte:
+		m[string(k)] = value
+	default:
+		m[fmt.Sprint(k)] = value
+	}
+	return data, nil
+}
+
+// decodeCBORIndefinite decodes an indefinite-length string, array or map.
+func decodeCBORIndefinite(major byte, data []byte, depth int) (interface{}, []byte, error) {
+	var (
+		chunks []byte
+		items  = []interface{}{}
+		m      = map[string]interface{}{}
+		err    error
+	)
+	for {
+		if len(data) == 0 {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+		}
+		if data[0] == 0xff {
+			data = data[1:]
+			break
+		}
+		switch major {
+		case 2, 3:
+			// Chunks are definite-length strings of the same major type
+			if data[0]>>5 != major || data[0]&0x1f == 31 {
+				return nil, nil, fmt.Errorf("%w: bad string chunk", ErrInvalidCBOR)
+			}
+			var chunk interface{}
+			if chunk, data, err = decodeCBOR(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch c := chunk.(type) {
+			case string:
+				chunks = append(chunks, c...)
+			case []byte:
+				chunks = append(chunks, c...)
+			}
+		case 4:
+			var item interface{}
+			if item, data, err = decodeCBOR(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		case 5:
+			if data, err = decodeCBORPair(m, data, depth); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("%w: indefinite length for major type %d", ErrInvalidCBOR, major)
+		}
+	}
+
+	switch major {
+	case 2:
+		return append([]byte{}, chunks...), data, nil
+	case 3:
+		return string(chunks), data, nil
+	case 4:
+		return items, data, nil
+	default:
+		return m, data, nil
+	}
+}
+
+// decodeCBORSimple decodes the simple values and floats of major type 7.
+func decodeCBORSimple(info byte, data []byte) (interface{}, []byte, error) {
+	size := map[byte]int{24: 1, 25: 2, 26: 4, 27: 8}[info]
+	if len(data) < size {
+		return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+	}
+	switch info {
+	case 20:
+		return false, data, nil
+	case 21:
+		return true, data, nil
+	case 22, 23: // null, undefined
+		return nil, data, nil
+	case 25:
+		return float16(binary.BigEndian.Uint16(data)), data[2:], nil
+	case 26:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+	case 27:
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported simple value %d", ErrInvalidCBOR, info)
+	}
+}
+
+// cborArgument reads the argument of an initial byte with additional information info.
+func cborArgument(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	case info > 27:
+		return 0, nil, fmt.Errorf("%w: reserved additional information %d", ErrInvalidCBOR, info)
+	default:
+		return 0, nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidCBOR)
+	}
+}
+
+// float16 converts an IEEE 754 half-precision float.
+func float16(h uint16) float64 {
+	exp, mant := int(h>>10)&0x1f, float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		f = math.Inf(1)
+		if mant != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
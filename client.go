@@ -1,8 +1,10 @@
 package coalago
 
 import (
+	"context"
 	"net"
 	"net/url"
+	"time"
 )
 
 // Response представляет ответ на CoAP-запрос
@@ -10,6 +12,32 @@ type Response struct {
 	Body          []byte
 	Code          CoapCode
 	PeerPublicKey []byte
+	// Options are the options of the reply, e.g. OptionContentFormat; see also the
+	// typed accessors such as ContentFormat and ETag
+	Options []*CoAPMessageOption
+	// Addr is the address the response came from: the server, or the proxy in between
+	Addr string
+	// RTT is the time from the last transmission of the request, or of its first
+	// window of Block1 blocks, to the first reply
+	RTT time.Duration
+	// Retransmissions counts the request messages and blocks sent more than once
+	Retransmissions int
+	// Blocks counts the Block1 blocks sent and the Block2 blocks received, 0 for an
+	// exchange of single messages
+	Blocks int
+}
+
+func newResponse(message *CoAPMessage) *Response {
+	r := &Response{
+		Body:          message.Payload.Bytes(),
+		Code:          message.Code,
+		PeerPublicKey: message.PeerPublicKey,
+		Options:       message.Options,
+	}
+	if message.Sender != nil {
+		r.Addr = message.Sender.String()
+	}
+	return r
 }
 
 // Client для отправки CoAP-запросов
@@ -17,34 +45,104 @@ type Client struct {
 	privateKey []byte
 	useTCP     bool
 	pool       *connpool
+	opts       *coalaopts
+	// sessions is nil unless the client was given its own session store or TTL; such
+	// clients keep their sessions apart from the process-wide pool shared by the others.
+	sessions *sessionStorageImpl
+	limiter  *peerLimiter
 }
 
 func NewClient(opts ...Opt) *Client {
-	options := &coalaopts{}
-	for _, opt := range opts {
-		opt(options)
-	}
+	return newClient(false, opts...)
+}
+
+func NewTCPClient(opts ...Opt) *Client {
+	return newClient(true, opts...)
+}
+
+func newClient(useTCP bool, opts ...Opt) *Client {
+	options := newCoalaopts(opts...)
 
-	return &Client{
+	c := &Client{
 		privateKey: options.privatekey,
-		pool:       newConnpool(false),
+		useTCP:     useTCP,
+		pool:       newConnpool(useTCP, options),
+		opts:       options,
+		limiter:    newPeerLimiter(options.nstart, options.maxPending),
 	}
+	c.pool.control = c.receiveControl
+	switch {
+	case options.sessionStore != nil:
+		c.sessions = newSessionStorage(options.sessionStore)
+	case options.sessionTTL != defaultOptions.sessionTTL:
+		c.sessions = newSessionStorageImpl(options.sessionTTL)
+	}
+	return c
 }
 
-func NewTCPClient(opts ...Opt) *Client {
-	options := &coalaopts{}
-	for _, opt := range opts {
-		opt(options)
+// Close closes the UDP sockets of the client; requests in flight fail. The client
+// stays usable and opens new sockets, and so new coaps sessions, when needed.
+func (c *Client) Close() error {
+	return c.pool.Close()
+}
+
+// acquire waits until a confirmable message may be sent to addr under WithNStart.
+func (c *Client) acquire(message *CoAPMessage, addr string) (release func(), err error) {
+	peer, turn, err := c.reserve(message, addr)
+	if err != nil || turn == nil {
+		return func() {}, err
 	}
-	return &Client{
-		privateKey: options.privatekey,
-		pool:       newConnpool(true),
+	if err := c.limiter.wait(message.getContext(), peer, turn); err != nil {
+		return nil, err
+	}
+	return func() { c.limiter.release(peer) }, nil
+}
+
+// reserve queues a confirmable message to addr under WithNStart without waiting; turn
+// is nil for other messages, which are not limited.
+func (c *Client) reserve(message *CoAPMessage, addr string) (peer string, turn chan struct{}, err error) {
+	if message.Type != CON {
+		return "", nil, nil
+	}
+	peer = addr
+	if a, err := resolveUDPAddrCached(addr); err == nil {
+		peer = a.String()
+	}
+	turn, err = c.limiter.reserve(peer)
+	return peer, turn, err
+}
+
+// newTransport wraps conn into a transport that uses the client's key, configuration and sessions.
+func (c *Client) newTransport(conn Transport) *transport {
+	sr := newtransport(conn)
+	sr.privateKey = c.privateKey
+	sr.opts = c.opts
+	sr.sessions = c.sessions
+	setAckTimeout(conn, c.opts.ackTimeout)
+	return sr
+}
+
+// applyAckTimeout replaces the package default timeout of a message with the client's
+// ACK timeout; a timeout set explicitly by the caller is kept.
+func (c *Client) applyAckTimeout(message *CoAPMessage) {
+	if message.Timeout == 0 || message.Timeout == timeWait {
+		message.Timeout = c.opts.ackTimeout
 	}
 }
 
 func (c *Client) Send(message *CoAPMessage, addr string, options ...*CoAPMessageOption) (*Response, error) {
 	message.AddOptions(options)
 
+	release, err := c.acquire(message, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.exchange(message, addr)
+}
+
+// exchange sends message to addr and waits for the response.
+func (c *Client) exchange(message *CoAPMessage, addr string) (*Response, error) {
 	conn, err := c.pool.Dial(addr)
 	if err != nil {
 		return nil, err
@@ -52,10 +150,10 @@ func (c *Client) Send(message *CoAPMessage, addr string, options ...*CoAPMessage
 
 	defer conn.Close()
 
-	sr := newtransport(conn)
-	sr.privateKey = c.privateKey
-
-	resp, err := sr.Send(message)
+	c.applyAckTimeout(message)
+	tr := c.newTransport(conn)
+	tr.stats = new(exchangeStats)
+	resp, err := tr.Send(message)
 	if err != nil {
 		return nil, err
 	}
@@ -63,63 +161,54 @@ func (c *Client) Send(message *CoAPMessage, addr string, options ...*CoAPMessage
 	case NON, ACK:
 		return nil, nil
 	}
-	r := new(Response)
-	r.Body = resp.Payload.Bytes()
-	r.Code = resp.Code
-	r.PeerPublicKey = resp.PeerPublicKey
+	r := newResponse(resp)
+	tr.stats.fill(r)
 	return r, nil
 }
 
+// SendContext is like Send, but binds the message to ctx: cancellation or deadline
+// aborts retransmissions, blockwise transfers and the coaps handshake, and the
+// call returns ctx.Err().
+func (c *Client) SendContext(ctx context.Context, message *CoAPMessage, addr string, options ...*CoAPMessageOption) (*Response, error) {
+	message.Context = ctx
+	return c.Send(message, addr, options...)
+}
+
 func (c *Client) GET(uri string, opts ...*CoAPMessageOption) (*Response, error) {
-	msg, err := constructMessage(GET, uri)
-	if err != nil {
-		return nil, err
-	}
-	msg.AddOptions(opts)
-	return c.sendCONMessage(msg)
+	return c.GETContext(context.Background(), uri, opts...)
+}
+
+// GETContext sends a confirmable GET request bound to ctx.
+func (c *Client) GETContext(ctx context.Context, uri string, opts ...*CoAPMessageOption) (*Response, error) {
+	return c.Do(NewRequest(GET, uri).WithOptions(opts...).WithContext(ctx))
 }
 
 func (c *Client) POST(data []byte, uri string, opts ...*CoAPMessageOption) (*Response, error) {
-	msg, err := constructMessage(POST, uri)
-	if err != nil {
-		return nil, err
-	}
-	msg.AddOptions(opts)
-	msg.Payload = NewBytesPayload(data)
-	return c.sendCONMessage(msg)
+	return c.POSTContext(context.Background(), data, uri, opts...)
 }
 
-func (c *Client) DELETE(data []byte, uri string, opts ...*CoAPMessageOption) (*Response, error) {
-	msg, err := constructMessage(DELETE, uri)
-	if err != nil {
-		return nil, err
-	}
-	msg.AddOptions(opts)
-	return c.sendCONMessage(msg)
+// POSTContext sends a confirmable POST request bound to ctx.
+func (c *Client) POSTContext(ctx context.Context, data []byte, uri string, opts ...*CoAPMessageOption) (*Response, error) {
+	return c.Do(NewRequest(POST, uri).WithPayload(data).WithOptions(opts...).WithContext(ctx))
 }
 
-func (c *Client) sendCONMessage(msg *CoAPMessage) (*Response, error) {
-	resp, err := c.sendCON(msg)
-	if err != nil {
-		return nil, err
-	}
-	return &Response{
-		Body:          resp.Payload.Bytes(),
-		Code:          resp.Code,
-		PeerPublicKey: resp.PeerPublicKey,
-	}, nil
+// PUT sends a confirmable PUT request.
+func (c *Client) PUT(data []byte, uri string, opts ...*CoAPMessageOption) (*Response, error) {
+	return c.PUTContext(context.Background(), data, uri, opts...)
 }
 
-func (c *Client) sendCON(msg *CoAPMessage) (*CoAPMessage, error) {
-	conn, err := c.pool.Dial(msg.Recipient.String())
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
+// PUTContext sends a confirmable PUT request bound to ctx.
+func (c *Client) PUTContext(ctx context.Context, data []byte, uri string, opts ...*CoAPMessageOption) (*Response, error) {
+	return c.Do(NewRequest(PUT, uri).WithPayload(data).WithOptions(opts...).WithContext(ctx))
+}
 
-	sr := newtransport(conn)
-	sr.privateKey = c.privateKey
-	return sr.Send(msg)
+func (c *Client) DELETE(data []byte, uri string, opts ...*CoAPMessageOption) (*Response, error) {
+	return c.DELETEContext(context.Background(), data, uri, opts...)
+}
+
+// DELETEContext sends a confirmable DELETE request bound to ctx.
+func (c *Client) DELETEContext(ctx context.Context, data []byte, uri string, opts ...*CoAPMessageOption) (*Response, error) {
+	return c.Do(NewRequest(DELETE, uri).WithPayload(data).WithOptions(opts...).WithContext(ctx))
 }
 
 func constructMessage(code CoapCode, uri string) (*CoAPMessage, error) {
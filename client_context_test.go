@@ -0,0 +1,80 @@
+package coalago
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// silentPeer returns the address of a UDP socket that reads and drops everything,
+// so every confirmable request sent to it ends up in the retransmission loop.
+func silentPeer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, MTU+1)
+		for {
+			if _, _, err := conn.ReadFromUDP(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestClientGETContextDeadline(t *testing.T) {
+	addr := silentPeer(t)
+	client := NewClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.GETContext(ctx, "coap://"+addr+"/silent")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GETContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed >= timeWait {
+		t.Fatalf("GETContext() returned after %v, want well under one retransmission interval", elapsed)
+	}
+}
+
+func TestClientSendContextCancelAbortsHandshake(t *testing.T) {
+	addr := silentPeer(t)
+	client := NewClient(WithPrivateKey([]byte("ctx-test")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	message := NewCoAPMessage(CON, GET)
+	message.SetSchemeCOAPS()
+	message.SetURIPath("/secure")
+
+	start := time.Now()
+	_, err := client.SendContext(ctx, message, addr)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("SendContext() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed >= timeWait {
+		t.Fatalf("SendContext() returned after %v, want well under one retransmission interval", elapsed)
+	}
+}
+
+func TestClientPOSTContextAlreadyCanceled(t *testing.T) {
+	addr := silentPeer(t)
+	client := NewClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := client.POSTContext(ctx, make([]byte, 4*MAX_PAYLOAD_SIZE), "coap://"+addr+"/upload")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("POSTContext() error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,226 @@
+package coalago
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// observeReorderWindow is the time after which a notification is fresh regardless of
+	// its sequence number (RFC 7641 §3.4).
+	observeReorderWindow = 128 * time.Second
+)
+
+// Observe subscribes to the resource at uri (RFC 7641). The registration response and
+// every fresh notification are delivered on the returned channel; when the consumer is
+// slower than the server, stale representations are dropped in favour of the newest one.
+//
+// The subscription keeps its own socket open. Confirmable notifications are acknowledged,
+// duplicates and reordered notifications are discarded by their Observe sequence number,
+// and the registration is renewed when Max-Age passes without a notification.
+//
+// The channel is closed when ctx is done, cancel is called, the server ends the
+// observation (a response without Observe or with a non-2.xx code), or a renewal fails.
+// On ctx or cancel the client deregisters with GET Observe=1. A server that does not
+// support Observe gets a single response followed by a closed channel.
+func (c *Client) Observe(ctx context.Context, uri string, opts ...*CoAPMessageOption) (<-chan *Response, func(), error) {
+	msg, err := constructMessage(GET, uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg.AddOptions(opts)
+	msg.AddOption(OptionObserve, 0)
+
+	conn, err := c.pool.Dial(msg.Recipient.String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	o := &clientObservation{
+		client:    c,
+		tr:        c.newTransport(conn),
+		request:   msg,
+		ctx:       ctx,
+		stop:      stop,
+		done:      make(chan struct{}),
+		responses: make(chan *Response, 1),
+		maxAge:    DefaultMaxAge,
+	}
+
+	resp, err := o.send(ctx, 0)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, nil, err
+	}
+
+	go o.run(resp)
+	return o.responses, o.cancel, nil
+}
+
+type clientObservation struct {
+	client    *Client
+	tr        *transport
+	request   *CoAPMessage // registration request; its token identifies the observation
+	ctx       context.Context
+	stop      context.CancelFunc
+	done      chan struct{}
+	responses chan *Response
+	once      sync.Once
+
+	seq      int       // sequence number of the last fresh notification
+	received time.Time // arrival of the last fresh notification
+	hasSeq   bool
+	maxAge   time.Duration
+}
+
+// cancel stops the observation and waits until the deregistration has been sent.
+func (o *clientObservation) cancel() {
+	o.once.Do(o.stop)
+	<-o.done
+}
+
+// send issues the registration request again with a new MessageID: observe is 0 to
+// (re)register and 1 to deregister.
+func (o *clientObservation) send(ctx context.Context, observe int) (*CoAPMessage, error) {
+	msg := o.request.Clone(true)
+	msg.MessageID = generateMessageID()
+	msg.AddOption(OptionObserve, observe)
+	msg.Context = ctx
+	o.client.applyAckTimeout(msg)
+	release, err := o.client.acquire(msg, o.request.Recipient.String())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return o.tr.Send(msg)
+}
+
+func (o *clientObservation) run(resp *CoAPMessage) {
+	defer close(o.done)
+	defer close(o.responses)
+	defer o.tr.conn.Close()
+	defer o.once.Do(o.stop)
+
+	if !o.handle(resp) {
+		return
+	}
+
+	stopWatch := o.tr.watchContext(o.ctx)
+	defer stopWatch()
+
+	mtu := o.tr.config().mtu
+	for {
+		o.tr.conn.SetReadDeadlineSec(time.Until(o.received.Add(o.maxAge)))
+		if o.ctx.Err() != nil {
+			o.deregister()
+			return
+		}
+
+		// A fresh buffer per datagram: the delivered Body aliases it.
+		buf := make([]byte, mtu+1)
+		n, err := o.tr.conn.Read(buf)
+		if err != nil {
+			if o.ctx.Err() != nil {
+				o.deregister()
+				return
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				// Max-Age expired without a notification: renew the registration.
+				resp, err := o.send(o.ctx, 0)
+				if err != nil {
+					if o.ctx.Err() != nil {
+						o.deregister()
+					}
+					return
+				}
+				// The response to a new registration is fresh whatever its sequence number.
+				o.hasSeq = false
+				if !o.handle(resp) {
+					return
+				}
+				continue
+			}
+			return
+		}
+		if n > mtu {
+			continue
+		}
+
+		message, err := preparationReceivingBuffer(o.tr, buf[:n], o.tr.conn.RemoteAddr(), o.request.ProxyAddr)
+		if err != nil || !bytes.Equal(message.Token, o.request.Token) {
+			continue
+		}
+		if !o.handle(message) {
+			return
+		}
+	}
+}
+
+// handle acknowledges and delivers a response or notification. It returns false when
+// the message ends the observation.
+func (o *clientObservation) handle(message *CoAPMessage) bool {
+	if message.Type == CON {
+		o.tr.sendToSocket(NewCoAPMessageId(ACK, CoapCodeEmpty, message.MessageID))
+	}
+
+	option := message.GetOption(OptionObserve)
+	if option == nil || message.Code.Group() != "2.xx" {
+		o.deliver(message)
+		return false
+	}
+
+	now := time.Now()
+	if !o.isFresh(option.IntValue(), now) {
+		return true
+	}
+	o.seq, o.received, o.hasSeq = option.IntValue(), now, true
+
+	o.maxAge = DefaultMaxAge
+	if maxAge := message.GetOption(OptionMaxAge); maxAge != nil && maxAge.IntValue() > 0 {
+		o.maxAge = time.Duration(maxAge.IntValue()) * time.Second
+	}
+
+	o.deliver(message)
+	return true
+}
+
+// isFresh implements the notification ordering rule of RFC 7641 §3.4.
+func (o *clientObservation) isFresh(seq int, now time.Time) bool {
+	if !o.hasSeq {
+		return true
+	}
+	const half = 1 << 23
+	return (o.seq < seq && seq-o.seq < half) ||
+		(o.seq > seq && o.seq-seq > half) ||
+		now.After(o.received.Add(observeReorderWindow))
+}
+
+func (o *clientObservation) deliver(message *CoAPMessage) {
+	r := newResponse(message)
+	for {
+		select {
+		case o.responses <- r:
+			return
+		default:
+		}
+		// Drop the representation the consumer has not picked up yet: it is already stale.
+		select {
+		case <-o.responses:
+		default:
+		}
+	}
+}
+
+// deregister tells the server to stop notifying. It is best effort and waits for at
+// most one ACK timeout: an observer that disappears is also removed by the server once
+// a notification is rejected or goes unacknowledged.
+func (o *clientObservation) deregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), o.tr.config().ackTimeout)
+	defer cancel()
+	o.send(ctx, 1)
+}
@@ -0,0 +1,110 @@
+package coalago
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func receiveResponse(t *testing.T, ch <-chan *Response) *Response {
+	t.Helper()
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			t.Fatal("observation channel closed")
+		}
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("no notification received")
+	}
+	return nil
+}
+
+func TestClientObserveReceivesNotificationsAndCancels(t *testing.T) {
+	var value atomic.Int32
+	s := NewServer()
+	res := s.OBSERVE("/counter", func(*CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload(strconv.Itoa(int(value.Load()))), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+
+	ch, cancel, err := NewClient().Observe(context.Background(), "coap://"+addr+"/counter")
+	if err != nil {
+		t.Fatalf("Observe() error = %v", err)
+	}
+	if r := receiveResponse(t, ch); string(r.Body) != "0" || r.Code != CoapCodeContent {
+		t.Fatalf("registration response = %q %v, want \"0\" 2.05", r.Body, r.Code)
+	}
+
+	for i := 1; i <= 3; i++ {
+		value.Store(int32(i))
+		res.Notify()
+		if r := receiveResponse(t, ch); string(r.Body) != strconv.Itoa(i) {
+			t.Fatalf("notification %d body = %q", i, r.Body)
+		}
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatal("channel still open after cancel")
+	}
+	if n := res.ObserversCount(); n != 0 {
+		t.Fatalf("ObserversCount() = %d after cancel, want 0", n)
+	}
+	cancel() // idempotent
+}
+
+func TestClientObserveRenewsAfterMaxAge(t *testing.T) {
+	var calls atomic.Int32
+	s := NewServer()
+	res := s.OBSERVE("/slow", func(*CoAPMessage) *CoAPResourceHandlerResult {
+		calls.Add(1)
+		return NewResponse(NewStringPayload("v"), CoapCodeContent)
+	})
+	res.SetMaxAge(time.Second)
+	addr := startTestServer(t, s)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	ch, _, err := NewClient().Observe(ctx, "coap://"+addr+"/slow")
+	if err != nil {
+		t.Fatalf("Observe() error = %v", err)
+	}
+	receiveResponse(t, ch)
+	receiveResponse(t, ch) // response to the renewed registration
+
+	if n := calls.Load(); n < 2 {
+		t.Fatalf("handler called %d times, want the registration renewed", n)
+	}
+
+	stop()
+	for range ch {
+	}
+	if n := res.ObserversCount(); n != 0 {
+		t.Fatalf("ObserversCount() = %d after ctx cancel, want 0", n)
+	}
+}
+
+func TestClientObservationFreshness(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		last, next int
+		elapsed    time.Duration
+		fresh      bool
+	}{
+		{last: 5, next: 6, fresh: true},
+		{last: 6, next: 5, fresh: false},
+		{last: 6, next: 6, fresh: false},
+		{last: observeSequenceMask, next: 1, fresh: true}, // wrapped around
+		{last: 1, next: observeSequenceMask, fresh: false},
+		{last: 6, next: 5, elapsed: observeReorderWindow + time.Second, fresh: true},
+	}
+	for _, tt := range tests {
+		o := &clientObservation{seq: tt.last, hasSeq: true, received: now.Add(-tt.elapsed)}
+		if got := o.isFresh(tt.next, now); got != tt.fresh {
+			t.Errorf("isFresh(%d after %d, %v) = %v, want %v", tt.next, tt.last, tt.elapsed, got, tt.fresh)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package coalago
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+)
+
+// WithCluster makes a Server one node of a cluster behind a UDP load balancer. Every
+// peer address is owned by one node, chosen by consistent hashing over nodes; a node
+// relays the datagrams of peers it does not own to the owner and sends the owner's
+// replies back from its own socket, so the peer sees one address. Sessions, block
+// transfers and Observe registrations thus stay on one node. self is the address of
+// this node as the other nodes reach it and must be one of nodes; all nodes need the
+// same list. Nodes exchange relayed datagrams over the listening socket and trust
+// each other, so keep that traffic off untrusted networks.
+//
+// Adding or removing a node moves about 1/len(nodes) of the peers to another node;
+// with NewKVSessionStore their sessions move along. Only UDP listeners take part.
+func WithCluster(self string, nodes ...string) Opt {
+	return func(opts *coalaopts) {
+		opts.clusterSelf = self
+		opts.clusterNodes = nodes
+	}
+}
+
+// clusterVirtualNodes is the number of points of each node on the hash ring.
+const clusterVirtualNodes = 64
+
+// hashRing assigns keys to nodes by consistent hashing.
+type hashRing struct {
+	points []uint64
+	owners map[uint64]string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	r := &hashRing{owners: make(map[uint64]string, len(nodes)*clusterVirtualNodes)}
+	for _, node := range nodes {
+		for i := 0; i < clusterVirtualNodes; i++ {
+			point := ringHash(fmt.Sprintf("%s#%d", node, i))
+			r.points = append(r.points, point)
+			r.owners[point] = node
+		}
+	}
+	slices.Sort(r.points)
+	return r
+}
+
+func (r *hashRing) owner(key string) string {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Cluster frames carry a datagram between nodes together with the peer address. The
+// first byte 0xFF is CoAP version 3, which never starts a Coala message.
+var clusterMagic = []byte{0xFF, 'C', 'L'}
+
+const (
+	clusterFrameForward = 'F' // peer -> relaying node -> owner
+	clusterFrameReply   = 'R' // owner -> relaying node -> peer
+	// magic, kind, address length, address ("[ipv6]:port" fits in 64 bytes)
+	clusterFrameOverhead = 3 + 1 + 1 + 64
+)
+
+func clusterFrame(kind byte, peer string, datagram []byte) []byte {
+	frame := make([]byte, 0, len(clusterMagic)+2+len(peer)+len(datagram))
+	frame = append(frame, clusterMagic...)
+	frame = append(frame, kind, byte(len(peer)))
+	frame = append(frame, peer...)
+	return append(frame, datagram...)
+}
+
+func parseClusterFrame(data []byte) (kind byte, peer string, datagram []byte, ok bool) {
+	if len(data) < len(clusterMagic)+2 || !bytes.HasPrefix(data, clusterMagic) {
+		return 0, "", nil, false
+	}
+	data = data[len(clusterMagic):]
+	kind, n := data[0], int(data[1])
+	if len(data) < 2+n {
+		return 0, "", nil, false
+	}
+	return kind, string(data[2 : 2+n]), data[2+n:], true
+}
+
+// clusterConn wraps the listening socket of a cluster node. The Server above it only
+// sees the datagrams of the peers this node owns, with their original addresses.
+type clusterConn struct {
+	Transport
+	self  string
+	nodes map[string]bool
+	ring  *hashRing
+	// relays maps a peer address to the node that relays its datagrams here
+	relays *shardedCache
+}
+
+func newClusterConn(conn Transport, cfg *coalaopts) (*clusterConn, error) {
+	resolve := func(addr string) (string, error) {
+		a, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return "", err
+		}
+		return a.String(), nil
+	}
+
+	c := &clusterConn{
+		Transport: conn,
+		nodes:     make(map[string]bool, len(cfg.clusterNodes)),
+		relays:    newShardedCache(cfg.sessionTTL),
+	}
+	var err error
+	if c.self, err = resolve(cfg.clusterSelf); err != nil {
+		return nil, err
+	}
+	nodes := make([]string, 0, len(cfg.clusterNodes))
+	for _, node := range cfg.clusterNodes {
+		if node, err = resolve(node); err != nil {
+			return nil, err
+		}
+		c.nodes[node] = true
+		nodes = append(nodes, node)
+	}
+	if !c.nodes[c.self] {
+		return nil, fmt.Errorf("cluster node %s is not in the node list", c.self)
+	}
+	c.ring = newHashRing(nodes)
+	return c, nil
+}
+
+func (c *clusterConn) Listen(buff []byte) (int, net.Addr, error) {
+	frame := make([]byte, len(buff)+clusterFrameOverhead)
+	for {
+		n, from, err := c.Transport.Listen(frame)
+		if err != nil {
+			return n, from, err
+		}
+		data, sender := frame[:n], from.String()
+
+		if c.nodes[sender] {
+			// Traffic between nodes: relayed datagrams or the nodes' own requests
+			kind, peer, datagram, ok := parseClusterFrame(data)
+			switch {
+			case !ok:
+				return copy(buff, data), from, nil
+			case kind == clusterFrameForward:
+				addr, err := net.ResolveUDPAddr("udp", peer)
+				if err != nil {
+					continue
+				}
+				c.relays.Set(addr.String(), sender)
+				return copy(buff, datagram), addr, nil
+			case kind == clusterFrameReply:
+				c.Transport.WriteTo(datagram, peer)
+			}
+			continue
+		}
+
+		if owner := c.ring.owner(sender); owner != c.self {
+			c.Transport.WriteTo(clusterFrame(clusterFrameForward, sender, data), owner)
+			continue
+		}
+		// The balancer sends the peer here directly now, so answer directly as well
+		c.relays.Delete(sender)
+		return copy(buff, data), from, nil
+	}
+}
+
+// WriteTo sends to peers relayed by another node through that node.
+func (c *clusterConn) WriteTo(buf []byte, addr string) (int, error) {
+	if via, ok := c.relays.Get(addr); ok {
+		if _, err := c.Transport.WriteTo(clusterFrame(clusterFrameReply, addr, buf), via.(string)); err != nil {
+			return 0, err
+		}
+		return len(buf), nil
+	}
+	return c.Transport.WriteTo(buf, addr)
+}
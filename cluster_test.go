@@ -0,0 +1,160 @@
+package coalago
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+// freeUDPAddrs reserves n local UDP addresses; the sockets are closed before return.
+func freeUDPAddrs(t *testing.T, n int) []string {
+	t.Helper()
+	addrs := make([]string, n)
+	for i := range addrs {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = conn.LocalAddr().String()
+		conn.Close()
+	}
+	return addrs
+}
+
+func TestClusterRelaysToOwner(t *testing.T) {
+	nodes := freeUDPAddrs(t, 2)
+	kv := NewMemoryKV()
+	var hits [2]atomic.Int32
+	for i, node := range nodes {
+		s := NewServer(WithCluster(node, nodes...), WithSessionStore(NewKVSessionStore(kv, time.Minute)))
+		s.POST("/echo", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+			hits[i].Add(1)
+			return NewResponse(NewBytesPayload(message.Payload.Bytes()), CoapCodeChanged)
+		})
+		startTestServerAt(t, s, node)
+	}
+
+	// Every request comes from a new client, so a new port, all through the first
+	// node. The second body needs Block1/Block2 transfers, which must stay on the owner.
+	for i := 0; i < 20; i++ {
+		body := []byte("ping")
+		if i%2 == 1 {
+			body = make([]byte, 3000)
+		}
+		client := NewClient()
+		resp, err := client.POST(body, "coaps://"+nodes[0]+"/echo")
+		if err != nil {
+			t.Fatalf("request %d: POST() error = %v", i, err)
+		}
+		if len(resp.Body) != len(body) {
+			t.Fatalf("request %d: echoed %d bytes, want %d", i, len(resp.Body), len(body))
+		}
+		client.Close()
+	}
+	if hits[0].Load() == 0 || hits[1].Load() == 0 {
+		t.Fatalf("requests per node = %d, %d; want both nodes to own peers", hits[0].Load(), hits[1].Load())
+	}
+}
+
+func TestHashRingMovesFewKeys(t *testing.T) {
+	before := newHashRing([]string{"10.0.0.1:5683", "10.0.0.2:5683", "10.0.0.3:5683"})
+	after := newHashRing([]string{"10.0.0.1:5683", "10.0.0.2:5683", "10.0.0.3:5683", "10.0.0.4:5683"})
+
+	moved := 0
+	for port := 1000; port < 3000; port++ {
+		peer := net.JoinHostPort("192.168.1.10", strconv.Itoa(port))
+		if owner := after.owner(peer); owner != before.owner(peer) {
+			if owner != "10.0.0.4:5683" {
+				t.Fatalf("%s moved between existing nodes", peer)
+			}
+			moved++
+		}
+	}
+	// A quarter of the keys is expected to move to the new node.
+	if moved < 300 || moved > 700 {
+		t.Fatalf("moved %d of 2000 keys, want about 500", moved)
+	}
+}
+
+func TestKVSessionStoreSharesSessions(t *testing.T) {
+	kv := NewMemoryKV()
+	first := newSessionStorage(NewKVSessionStore(kv, time.Minute))
+	second := newSessionStorage(NewKVSessionStore(kv, time.Minute))
+
+	client, server := newSessionPair(t, session.SupportedFeatures)
+	first.Set("10.0.0.1:5683", "192.168.1.10:40000", "", server)
+
+	// The other node listens on another address but serves the same peer.
+	moved, ok := second.Get("10.0.0.2:5683", "192.168.1.10:40000", "")
+	if !ok {
+		t.Fatal("session not shared through the KV")
+	}
+	data := sealedRequest(t, client, 1)
+	if _, err := openRequest(t, moved, data); err != nil {
+		t.Fatalf("moved session cannot decrypt: %v", err)
+	}
+
+	second.Delete("10.0.0.2:5683", "192.168.1.10:40000", "")
+	if _, ok := newSessionStorage(NewKVSessionStore(kv, time.Minute)).Get("", "192.168.1.10:40000", ""); ok {
+		t.Fatal("Delete() kept the session in the KV")
+	}
+}
+
+// countingKV counts the calls that reach a KV.
+type countingKV struct {
+	KV
+	gets, sets int
+}
+
+func (c *countingKV) Get(key string) ([]byte, bool, error) {
+	c.gets++
+	return c.KV.Get(key)
+}
+
+func (c *countingKV) Set(key string, value []byte, ttl time.Duration) error {
+	c.sets++
+	return c.KV.Set(key, value, ttl)
+}
+
+func TestKVSessionStoreWritesSparingly(t *testing.T) {
+	kv := &countingKV{KV: NewMemoryKV()}
+	first := newSessionStorage(NewKVSessionStore(kv, time.Minute))
+
+	_, server := newSessionPair(t, session.SupportedFeatures)
+	first.Set("10.0.0.1:5683", "192.168.1.10:40000", "", server)
+	for i := 0; i < 10; i++ {
+		server.NextSequence()
+		server.UpdatedAt++
+		first.Set("10.0.0.1:5683", "192.168.1.10:40000", "", server)
+	}
+	if kv.sets != 1 {
+		t.Fatalf("KV writes = %d, want 1 for the new session", kv.sets)
+	}
+
+	// A new handshake writes through again.
+	_, rekeyed := newSessionPair(t, session.SupportedFeatures)
+	first.Set("10.0.0.1:5683", "192.168.1.10:40000", "", rekeyed)
+	if kv.sets != 2 {
+		t.Fatalf("KV writes after a new handshake = %d, want 2", kv.sets)
+	}
+
+	// Unknown peers query the KV once.
+	for i := 0; i < 5; i++ {
+		first.Get("10.0.0.1:5683", "192.168.1.99:40000", "")
+	}
+	if kv.gets != 1 {
+		t.Fatalf("KV reads for an unknown peer = %d, want 1", kv.gets)
+	}
+
+	// A node loading the session reserves its block of sequence numbers, so the next
+	// node to load it sends from another one.
+	second, _ := newSessionStorage(NewKVSessionStore(kv, time.Minute)).Get("10.0.0.2:5683", "192.168.1.10:40000", "")
+	third, _ := newSessionStorage(NewKVSessionStore(kv, time.Minute)).Get("10.0.0.3:5683", "192.168.1.10:40000", "")
+	if a, b := second.SentSequence(), third.SentSequence(); b < a+session.RestoredSequenceGap {
+		t.Fatalf("nodes loaded the session at sequence %d and %d, want %d apart", a, b, session.RestoredSequenceGap)
+	}
+}
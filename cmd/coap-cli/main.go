@@ -119,7 +119,7 @@ func main() {
 	case "post":
 		resp, err = client.POST([]byte(*data), uri)
 	case "put":
-		resp, err = client.POST([]byte(*data), uri) // coalago uses POST for PUT
+		resp, err = client.PUT([]byte(*data), uri)
 	case "delete":
 		resp, err = client.DELETE([]byte(*data), uri)
 	default:
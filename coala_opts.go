@@ -1,5 +1,12 @@
 package coalago
 
+import (
+	"net/http"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
 type Opt func(*coalaopts)
 
 func WithPrivateKey(privatekey []byte) Opt {
@@ -8,6 +15,210 @@ func WithPrivateKey(privatekey []byte) Opt {
 	}
 }
 
+// WithAckTimeout sets how long a confirmable message waits for an ACK before it is
+// retransmitted. The same interval paces retransmission of ARQ blocks.
+func WithAckTimeout(timeout time.Duration) Opt {
+	return func(opts *coalaopts) {
+		if timeout > 0 {
+			opts.ackTimeout = timeout
+		}
+	}
+}
+
+// WithMaxRetransmits sets how many times a confirmable message or an ARQ block is
+// retransmitted before the exchange fails with ErrMaxAttempts.
+func WithMaxRetransmits(retransmits int) Opt {
+	return func(opts *coalaopts) {
+		if retransmits >= 0 {
+			opts.maxRetransmits = retransmits
+		}
+	}
+}
+
+// WithRetransmitPolicy sets how the ACK wait of a confirmable message grows between
+// retransmissions (RFC7252Retransmit by default). It applies to messages sent on
+// their own: requests of a Client whose payload fits in one block, the Send of a
+// Server, handshakes and Observe notifications. Block1 and Block2 ARQ transfers keep
+// retransmitting blocks every WithAckTimeout.
+func WithRetransmitPolicy(policy RetransmitPolicy) Opt {
+	return func(opts *coalaopts) {
+		if policy != nil {
+			opts.retransmit = policy
+		}
+	}
+}
+
+// WithBlockSize sets the Block1/Block2 payload size. Payloads larger than the block
+// size are sent with selective-repeat ARQ. The size must be a power of two between
+// 16 and 1024 bytes (the range encodable in SZX); other values are ignored.
+func WithBlockSize(size int) Opt {
+	return func(opts *coalaopts) {
+		if size >= 16 && size <= 1024 && size&(size-1) == 0 {
+			opts.blockSize = size
+		}
+	}
+}
+
+// WithWindowBounds sets the range the adaptive ARQ send window is kept within.
+func WithWindowBounds(min, max int) Opt {
+	return func(opts *coalaopts) {
+		if min > 0 && max >= min {
+			opts.minWindowSize = min
+			opts.maxWindowSize = max
+		}
+	}
+}
+
+// WithWindowSize sets the initial ARQ send window. It is clamped to the window bounds.
+func WithWindowSize(size int) Opt {
+	return func(opts *coalaopts) {
+		if size > 0 {
+			opts.windowSize = size
+		}
+	}
+}
+
+// WithMTU sets the largest datagram accepted from the network; bigger datagrams are dropped.
+func WithMTU(mtu int) Opt {
+	return func(opts *coalaopts) {
+		if mtu > 0 {
+			opts.mtu = mtu
+		}
+	}
+}
+
+// WithSessionTTL sets how long an idle coaps session is kept before the peer has to
+// handshake again.
+func WithSessionTTL(ttl time.Duration) Opt {
+	return func(opts *coalaopts) {
+		if ttl > 0 {
+			opts.sessionTTL = ttl
+		}
+	}
+}
+
+// WithForwardSecrecy adds an ephemeral X25519 key to the coaps handshakes the Client
+// (or Server) initiates, so recorded sessions stay confidential if the private key set
+// with WithPrivateKey leaks later. The static key then only authenticates the peer.
+// A handshake with a peer that does not support it fails with ErrorHandshake.
+func WithForwardSecrecy() Opt {
+	return func(opts *coalaopts) {
+		opts.forwardSecrecy = true
+	}
+}
+
+// WithStrictSessions makes the Client (or Server) refuse coaps sessions without
+// sequence numbers and authenticated headers (session.FeatureSequenceNonce and
+// session.FeatureAuthenticatedHeader): a handshake with a legacy peer, or one whose
+// features were stripped on the way, fails with ErrorHandshake instead of falling back.
+func WithStrictSessions() Opt {
+	return func(opts *coalaopts) {
+		opts.strictSessions = true
+	}
+}
+
+// WithNStart limits the Client to n outstanding confirmable requests per peer; more
+// wait for one to complete. WithNStart(NSTART) follows RFC 7252 §4.7. By default,
+// and with 0, the requests are not limited.
+func WithNStart(n int) Opt {
+	return func(opts *coalaopts) {
+		if n >= 0 {
+			opts.nstart = n
+		}
+	}
+}
+
+// WithMaxPending bounds the requests of a Client waiting for WithNStart; more fail
+// with ErrTooManyPending.
+func WithMaxPending(n int) Opt {
+	return func(opts *coalaopts) {
+		if n >= 0 {
+			opts.maxPending = n
+		}
+	}
+}
+
 type coalaopts struct {
-	privatekey []byte
+	privatekey  []byte
+	keyVerifier KeyVerifier
+	pskIdentity string
+	psk         []byte
+	pskLookup   PSKLookup
+
+	forwardSecrecy bool
+	strictSessions bool
+	rekeyMessages  int
+	rekeyInterval  time.Duration
+
+	ackTimeout     time.Duration
+	maxRetransmits int
+	retransmit     RetransmitPolicy
+	clock          clock
+	blockSize      int
+	windowSize     int
+	minWindowSize  int
+	maxWindowSize  int
+	mtu            int
+	sessionTTL     time.Duration
+	sessionStore   SessionStore
+	nstart         int
+	maxPending     int
+
+	clusterSelf  string
+	clusterNodes []string
+
+	httpProxyClient *http.Client
+	httpProxyAllow  []string
+}
+
+// defaultOptions is used by transports that are not owned by a Client or Server.
+var defaultOptions = newCoalaopts()
+
+func newCoalaopts(opts ...Opt) *coalaopts {
+	options := &coalaopts{
+		ackTimeout:     timeWait,
+		maxRetransmits: maxSendAttempts - 1,
+		retransmit:     RFC7252Retransmit(),
+		clock:          systemClock{},
+		blockSize:      MAX_PAYLOAD_SIZE,
+		windowSize:     DEFAULT_WINDOW_SIZE,
+		minWindowSize:  MIN_WiNDOW_SIZE,
+		maxWindowSize:  MAX_WINDOW_SIZE,
+		mtu:            MTU,
+		sessionTTL:     SESSIONS_POOL_EXPIRATION,
+		maxPending:     MAX_PENDING_REQUESTS,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	if options.windowSize < options.minWindowSize {
+		options.windowSize = options.minWindowSize
+	}
+	if options.windowSize > options.maxWindowSize {
+		options.windowSize = options.maxWindowSize
+	}
+	return options
+}
+
+// maxAttempts is the total number of transmissions of one message: the first send plus retransmits.
+func (opts *coalaopts) maxAttempts() int {
+	return opts.maxRetransmits + 1
+}
+
+// backoff starts the retransmission schedule of a message that waits timeout for its
+// first ACK; zero means the ACK timeout.
+func (opts *coalaopts) backoff(timeout time.Duration) Backoff {
+	if timeout <= 0 {
+		timeout = opts.ackTimeout
+	}
+	return opts.retransmit.NewBackoff(timeout)
+}
+
+// requiredFeatures returns the features a coaps handshake has to negotiate.
+func (opts *coalaopts) requiredFeatures() session.Features {
+	if opts.strictSessions {
+		return session.FeatureSequenceNonce | session.FeatureAuthenticatedHeader
+	}
+	return 0
 }
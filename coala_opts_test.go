@@ -0,0 +1,110 @@
+package coalago
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewCoalaoptsDefaultsMatchConstants(t *testing.T) {
+	opts := newCoalaopts()
+
+	if opts.ackTimeout != timeWait {
+		t.Fatalf("ackTimeout = %v, want %v", opts.ackTimeout, timeWait)
+	}
+	if opts.maxAttempts() != maxSendAttempts {
+		t.Fatalf("maxAttempts() = %d, want %d", opts.maxAttempts(), maxSendAttempts)
+	}
+	if opts.blockSize != MAX_PAYLOAD_SIZE || opts.mtu != MTU || opts.sessionTTL != SESSIONS_POOL_EXPIRATION {
+		t.Fatalf("blockSize/mtu/sessionTTL = %d/%d/%v, want package constants", opts.blockSize, opts.mtu, opts.sessionTTL)
+	}
+	if opts.windowSize != DEFAULT_WINDOW_SIZE || opts.minWindowSize != MIN_WiNDOW_SIZE || opts.maxWindowSize != MAX_WINDOW_SIZE {
+		t.Fatalf("window = %d [%d, %d], want package constants", opts.windowSize, opts.minWindowSize, opts.maxWindowSize)
+	}
+}
+
+func TestNewCoalaoptsOverridesAndValidation(t *testing.T) {
+	opts := newCoalaopts(
+		WithAckTimeout(200*time.Millisecond),
+		WithMaxRetransmits(2),
+		WithBlockSize(512),
+		WithWindowBounds(10, 100),
+		WithWindowSize(500),
+		WithMTU(1280),
+		WithSessionTTL(time.Minute),
+	)
+
+	if opts.ackTimeout != 200*time.Millisecond || opts.maxAttempts() != 3 {
+		t.Fatalf("ackTimeout/maxAttempts = %v/%d, want 200ms/3", opts.ackTimeout, opts.maxAttempts())
+	}
+	if opts.blockSize != 512 || opts.mtu != 1280 || opts.sessionTTL != time.Minute {
+		t.Fatalf("blockSize/mtu/sessionTTL = %d/%d/%v", opts.blockSize, opts.mtu, opts.sessionTTL)
+	}
+	if opts.windowSize != 100 || opts.minWindowSize != 10 || opts.maxWindowSize != 100 {
+		t.Fatalf("window = %d [%d, %d], want initial window clamped to 100", opts.windowSize, opts.minWindowSize, opts.maxWindowSize)
+	}
+
+	invalid := newCoalaopts(WithBlockSize(1000), WithBlockSize(2048), WithWindowBounds(50, 10), WithAckTimeout(0))
+	if invalid.blockSize != MAX_PAYLOAD_SIZE {
+		t.Fatalf("blockSize = %d, want invalid sizes ignored", invalid.blockSize)
+	}
+	if invalid.minWindowSize != MIN_WiNDOW_SIZE || invalid.maxWindowSize != MAX_WINDOW_SIZE {
+		t.Fatalf("window bounds = [%d, %d], want inverted bounds ignored", invalid.minWindowSize, invalid.maxWindowSize)
+	}
+	if invalid.ackTimeout != timeWait {
+		t.Fatalf("ackTimeout = %v, want zero timeout ignored", invalid.ackTimeout)
+	}
+}
+
+func TestClientUsesInstanceRetransmissionSettings(t *testing.T) {
+	addr := silentPeer(t)
+	client := NewClient(WithAckTimeout(20*time.Millisecond), WithMaxRetransmits(2))
+
+	start := time.Now()
+	_, err := client.GET("coap://" + addr + "/silent")
+	if !errors.Is(err, ErrMaxAttempts) {
+		t.Fatalf("GET() error = %v, want %v", err, ErrMaxAttempts)
+	}
+	if elapsed := time.Since(start); elapsed >= timeWait {
+		t.Fatalf("GET() gave up after %v, want about 3 x 20ms", elapsed)
+	}
+}
+
+func TestServerTransportInheritsServerConfig(t *testing.T) {
+	s := NewServer(WithBlockSize(256), WithSessionTTL(time.Minute))
+	tr := s.newServerTransport(checksumTransport{})
+
+	if tr.config().blockSize != 256 {
+		t.Fatalf("transport blockSize = %d, want 256", tr.config().blockSize)
+	}
+	if ttl := s.sessions.store.(*memorySessionStore).cache.ttl; ttl != time.Minute {
+		t.Fatalf("session TTL = %v, want %v", ttl, time.Minute)
+	}
+	if newtransport(checksumTransport{}).config() != defaultOptions {
+		t.Fatal("transport without owner does not fall back to defaultOptions")
+	}
+	if s.tcpConns.storage.ttl != time.Minute {
+		t.Fatalf("TCP connection TTL = %v, want %v", s.tcpConns.storage.ttl, time.Minute)
+	}
+}
+
+func TestConnectionsUseOwnerTimeouts(t *testing.T) {
+	client := NewClient(WithAckTimeout(20*time.Millisecond), WithSessionTTL(time.Minute))
+	if client.pool.idleTimeout != time.Minute {
+		t.Fatalf("pool idle timeout = %v, want %v", client.pool.idleTimeout, time.Minute)
+	}
+	conn := &tcpConnection{}
+	client.newTransport(conn)
+	if conn.ackTimeout() != 20*time.Millisecond {
+		t.Fatalf("client connection ACK timeout = %v, want 20ms", conn.ackTimeout())
+	}
+
+	listener := &connection{}
+	NewServer(WithAckTimeout(30 * time.Millisecond)).newServerTransport(listener)
+	if listener.ackTimeout() != 30*time.Millisecond {
+		t.Fatalf("server connection ACK timeout = %v, want 30ms", listener.ackTimeout())
+	}
+	if (&muxConn{}).ackTimeout() != defaultOptions.ackTimeout {
+		t.Fatal("connection without owner does not fall back to defaultOptions")
+	}
+}
@@ -217,6 +217,16 @@ func optionCodeToString(option OptionCode) string {
 		return "OptionSecurityID"
 	case OptionChecksum:
 		return "Checksum"
+	case OptionSequenceNumber:
+		return "SequenceNumber"
+	case OptionHandshakeFeatures:
+		return "HandshakeFeatures"
+	case OptionPSKIdentity:
+		return "PSKIdentity"
+	case OptionHandshakeNonce:
+		return "HandshakeNonce"
+	case OptionHandshakeEphemeral:
+		return "HandshakeEphemeral"
 	default:
 		return "Unknown"
 	}
@@ -247,6 +257,14 @@ func constructNextBlock(blockType OptionCode, s *stateSend) (*CoAPMessage, bool)
 
 	blockMessage.CloneOptions(s.origMessage, OptionProxyURI, OptionProxySecurityID)
 	blockMessage.ProxyAddr = s.origMessage.ProxyAddr
+	// Size2 tells the receiver of a Block2 transfer the size of the whole body
+	if blockType == OptionBlock2 {
+		if size := s.origMessage.GetOption(OptionSize2); size != nil {
+			blockMessage.AddOption(OptionSize2, size.Value)
+		} else {
+			blockMessage.AddOption(OptionSize2, s.lenght)
+		}
+	}
 
 	return blockMessage, !isMore
 }
@@ -297,6 +315,7 @@ func newBlockingMessage(
 	msg.AddOption(OptionSelectiveRepeatWindowSize, windowSize)
 	msg.Payload = NewBytesPayload(frame)
 	msg.SetURIPath(origMessage.GetURIPath())
+	msg.CloneOptions(origMessage, OptionContentFormat, OptionEtag, OptionMaxAge, OptionLocationPath, OptionLocationQuery)
 	msg.Token = origMessage.Token
 	msg.AddChecksumOnSend = origMessage.AddChecksumOnSend
 
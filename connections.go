@@ -2,12 +2,14 @@ package coalago
 
 import (
 	"bytes"
+	"errors"
 	"net"
+	"sync"
 	"time"
 )
 
 var NumberConnections = 1024
-var globalPoolConnections = newConnpool(false)
+var globalPoolConnections = newConnpool(false, defaultOptions)
 
 type Transport interface {
 	Close() error
@@ -23,10 +25,36 @@ type Transport interface {
 }
 
 type connection struct {
+	ackWait
 	end  chan struct{}
 	conn *net.UDPConn
 }
 
+// ackWait встраивается в соединения: SetReadDeadline ждёт ACK-таймаут Client или
+// Server, которому принадлежит соединение (его выставляет transport владельца), а
+// без владельца — таймаут по умолчанию.
+type ackWait struct {
+	timeout time.Duration
+}
+
+func (w *ackWait) setAckTimeout(timeout time.Duration) {
+	w.timeout = timeout
+}
+
+func (w *ackWait) ackTimeout() time.Duration {
+	if w.timeout > 0 {
+		return w.timeout
+	}
+	return defaultOptions.ackTimeout
+}
+
+// setAckTimeout передаёт ACK-таймаут владельца соединению conn, если оно его принимает.
+func setAckTimeout(conn Transport, timeout time.Duration) {
+	if c, ok := conn.(interface{ setAckTimeout(time.Duration) }); ok {
+		c.setAckTimeout(timeout)
+	}
+}
+
 func (c *connection) SetUDPRecvBuf(size int) int {
 	for {
 		if err := c.conn.SetReadBuffer(size); err == nil {
@@ -75,7 +103,11 @@ func (c *connection) Write(buf []byte) (int, error) {
 // ARQ-передачи (тысячи пакетов на одно большое тело), и повторный ResolveUDPAddr одного
 // и того же адреса — лишние парсинг и аллокации в горячем пути. TTL-кэш, а не карта:
 // адреса NAT-клиентов уникальны и без вытеснения память росла бы неограниченно.
-var resolvedAddrs = newShardedCache(SESSIONS_POOL_EXPIRATION)
+var resolvedAddrs = newShardedCache(resolvedAddrTTL)
+
+// resolvedAddrTTL — сколько живёт разобранный адрес; кэш общий на процесс и от
+// настроек отдельного Client или Server не зависит.
+const resolvedAddrTTL = 3 * time.Minute
 
 func resolveUDPAddrCached(addr string) (*net.UDPAddr, error) {
 	if v, ok := resolvedAddrs.Get(addr); ok {
@@ -127,12 +159,24 @@ func newListener(addr string) (Transport, error) {
 type connpool struct {
 	balance chan struct{}
 	useTCP  bool
-}
-
-func newConnpool(useTCP bool) *connpool {
+	// UDP: один сокет на пира, общий для всех обменов клиента (см. connmux.go);
+	// сокет закрывается после idleTimeout без обменов.
+	mx          sync.Mutex
+	shared      map[string]*sharedConn
+	idleTimeout time.Duration
+	mtu         int
+	// control получает датаграммы, которых не ждёт ни один обмен, вместе с обменом
+	// на том же сокете для ответа; обмен закрывает control.
+	control func(conn Transport, data []byte)
+}
+
+// newConnpool создаёт пул с таймаутами и MTU из opts владельца.
+func newConnpool(useTCP bool, opts *coalaopts) *connpool {
 	return &connpool{
-		balance: make(chan struct{}, NumberConnections),
-		useTCP:  useTCP,
+		balance:     make(chan struct{}, NumberConnections),
+		useTCP:      useTCP,
+		idleTimeout: opts.sessionTTL,
+		mtu:         opts.mtu,
 	}
 }
 
@@ -140,11 +184,11 @@ func (c *connpool) Dial(addr string) (Transport, error) {
 	if c.useTCP {
 		return newDialerTCP(addr)
 	}
-	return newDialer(c.balance, addr)
+	return c.dialShared(addr)
 }
 
 func (c *connection) SetReadDeadline() {
-	c.conn.SetReadDeadline(time.Now().Add(timeWait))
+	c.conn.SetReadDeadline(time.Now().Add(c.ackTimeout()))
 }
 
 func (c *connection) SetReadDeadlineSec(timeout time.Duration) {
@@ -158,26 +202,37 @@ type packet struct {
 	message  *CoAPMessage
 }
 
-func receiveMessage(tr *transport, origMessage *CoAPMessage) (*CoAPMessage, error) {
+// receiveMessage ждет ответ на origMessage не дольше timeout; чужие датаграммы срок не продлевают.
+func receiveMessage(tr *transport, origMessage *CoAPMessage, timeout time.Duration) (*CoAPMessage, error) {
+	ctx := origMessage.getContext()
+	cfg := tr.config()
+	deadline := time.Now().Add(timeout)
 	for {
-		tr.conn.SetReadDeadlineSec(origMessage.Timeout)
+		tr.conn.SetReadDeadlineSec(time.Until(deadline))
+		// Checked after the deadline is armed: a cancellation that lands later is
+		// turned into an expired deadline by transport.watchContext and unblocks Read.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-		buff := make([]byte, MTU+1)
+		buff := make([]byte, cfg.mtu+1)
 		n, err := tr.conn.Read(buff)
-		origMessage.Timeout = timeWait
 		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
 			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 				return nil, ErrMaxAttempts
 			}
 			return nil, err
 		}
-		if n > MTU {
+		if n > cfg.mtu {
 			continue
 		}
 
 		message, err := preparationReceivingBuffer(tr, buff[:n], tr.conn.RemoteAddr(), origMessage.ProxyAddr)
 		if err != nil {
-			if err == ErrChecksumMismatch {
+			if err == ErrChecksumMismatch || errors.Is(err, ErrorReplayedMessage) || err == ErrorSessionClosed {
 				continue
 			}
 			return nil, err
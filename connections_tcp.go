@@ -8,6 +8,7 @@ import (
 )
 
 type tcpConnection struct {
+	ackWait
 	conn *net.TCPConn
 }
 
@@ -43,7 +44,7 @@ func (c *tcpConnection) WriteTo(buf []byte, _ string) (int, error) {
 }
 
 func (c *tcpConnection) SetReadDeadline() {
-	c.conn.SetReadDeadline(time.Now().Add(timeWait))
+	c.conn.SetReadDeadline(time.Now().Add(c.ackTimeout()))
 }
 
 func (c *tcpConnection) SetReadDeadlineSec(timeout time.Duration) {
@@ -164,6 +165,7 @@ func newListenerTCP(addr string) (Transport, error) {
 }
 
 type tcpListenerWrapper struct {
+	ackWait
 	ln *net.TCPListener
 }
 
@@ -207,7 +209,7 @@ func (l *tcpListenerWrapper) WriteTo(buf []byte, addr string) (int, error) {
 }
 
 func (l *tcpListenerWrapper) SetReadDeadline() {
-	l.ln.SetDeadline(time.Now().Add(timeWait))
+	l.ln.SetDeadline(time.Now().Add(l.ackTimeout()))
 }
 
 func (l *tcpListenerWrapper) SetReadDeadlineSec(timeout time.Duration) {
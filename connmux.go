@@ -0,0 +1,320 @@
+package coalago
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The UDP sockets of a Client live as long as they are used: the coaps session key
+// includes the local address, so a socket per request made every session single-use.
+// A connpool keeps one socket per peer; each exchange gets a muxConn on it, and the
+// reader of the socket hands every datagram to the muxConn that sent its token.
+
+// sharedConn is a long-lived UDP socket of a Client to one peer.
+type sharedConn struct {
+	pool *connpool
+	key  string
+	conn *connection
+
+	mx     sync.Mutex
+	routes map[string]*muxConn // token → exchange that sent it
+	users  int
+	idle   *time.Timer
+	closed bool
+}
+
+func (s *sharedConn) readLoop() {
+	for {
+		buf := make([]byte, s.pool.mtu+1)
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// E.g. ICMP port unreachable reported on a connected socket
+			continue
+		}
+		token, ok := datagramToken(buf[:n])
+		if !ok {
+			continue
+		}
+		s.mx.Lock()
+		c := s.routes[token]
+		s.mx.Unlock()
+		if c != nil {
+			c.deliver(buf[:n])
+		} else if s.pool.control != nil {
+			// A message the peer started, e.g. a session Close
+			s.pool.mx.Lock()
+			c = s.attach()
+			s.pool.mx.Unlock()
+			go s.pool.control(c, buf[:n])
+		}
+	}
+}
+
+// datagramToken returns the token of a CoAP datagram, which coaps leaves in clear.
+func datagramToken(data []byte) (string, bool) {
+	if len(data) < 4 {
+		return "", false
+	}
+	tkl := int(data[0] & 0x0f)
+	if tkl > 8 || len(data) < 4+tkl {
+		return "", false
+	}
+	return string(data[4 : 4+tkl]), true
+}
+
+func (s *sharedConn) route(token string, c *muxConn) {
+	s.mx.Lock()
+	s.routes[token] = c
+	s.mx.Unlock()
+}
+
+// release ends an exchange; the socket is closed after the pool idle timeout without
+// exchanges.
+func (s *sharedConn) release(c *muxConn) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for token, r := range s.routes {
+		if r == c {
+			delete(s.routes, token)
+		}
+	}
+	s.users--
+	if s.users == 0 && !s.closed {
+		s.idle = time.AfterFunc(s.pool.idleTimeout, func() { s.pool.remove(s) })
+	}
+}
+
+// close closes the socket; exchanges still using it fail.
+func (s *sharedConn) close() {
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return
+	}
+	s.closed = true
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+	routes := s.routes
+	s.routes = make(map[string]*muxConn)
+	s.mx.Unlock()
+
+	s.conn.Close()
+	for _, c := range routes {
+		c.Close()
+	}
+}
+
+// muxQueueSize bounds the datagrams waiting for an exchange; more are dropped, as a
+// full socket buffer would, and left to the ARQ.
+const muxQueueSize = 4096
+
+// muxConn is the Transport of one exchange over a sharedConn. It receives the
+// datagrams carrying the tokens it has sent.
+type muxConn struct {
+	ackWait
+	shared *sharedConn
+
+	mx       sync.Mutex
+	queue    [][]byte
+	deadline time.Time
+	closed   bool
+	signal   chan struct{} // queue, deadline or closed changed
+	tokens   map[string]bool
+}
+
+func (c *muxConn) notify() {
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (c *muxConn) deliver(data []byte) {
+	c.mx.Lock()
+	if c.closed || len(c.queue) >= muxQueueSize {
+		c.mx.Unlock()
+		return
+	}
+	c.queue = append(c.queue, data)
+	c.mx.Unlock()
+	c.notify()
+}
+
+func (c *muxConn) Read(buff []byte) (int, error) {
+	for {
+		c.mx.Lock()
+		if len(c.queue) > 0 {
+			data := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.mx.Unlock()
+			return copy(buff, data), nil
+		}
+		if c.closed {
+			c.mx.Unlock()
+			return 0, net.ErrClosed
+		}
+		deadline := c.deadline
+		c.mx.Unlock()
+
+		if deadline.IsZero() {
+			<-c.signal
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.signal:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (c *muxConn) Listen(buff []byte) (int, net.Addr, error) {
+	n, err := c.Read(buff)
+	return n, c.RemoteAddr(), err
+}
+
+// Write sends buf and routes the replies to its token to this exchange.
+func (c *muxConn) Write(buf []byte) (int, error) {
+	if token, ok := datagramToken(buf); ok {
+		c.mx.Lock()
+		known := c.tokens[token]
+		c.tokens[token] = true
+		closed := c.closed
+		c.mx.Unlock()
+		if closed {
+			return 0, net.ErrClosed
+		}
+		if !known {
+			c.shared.route(token, c)
+		}
+	}
+	return c.shared.conn.Write(buf)
+}
+
+func (c *muxConn) WriteTo(buf []byte, _ string) (int, error) {
+	return c.Write(buf)
+}
+
+func (c *muxConn) Close() error {
+	c.mx.Lock()
+	if c.closed {
+		c.mx.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.queue = nil
+	c.mx.Unlock()
+	c.notify()
+	c.shared.release(c)
+	return nil
+}
+
+func (c *muxConn) RemoteAddr() net.Addr { return c.shared.conn.RemoteAddr() }
+
+func (c *muxConn) LocalAddr() net.Addr { return c.shared.conn.LocalAddr() }
+
+func (c *muxConn) SetReadDeadline() {
+	c.SetReadDeadlineSec(c.ackTimeout())
+}
+
+func (c *muxConn) SetReadDeadlineSec(timeout time.Duration) {
+	c.mx.Lock()
+	c.deadline = time.Now().Add(timeout)
+	c.mx.Unlock()
+	c.notify()
+}
+
+func (c *muxConn) SetUDPRecvBuf(size int) int {
+	return c.shared.conn.SetUDPRecvBuf(size)
+}
+
+// dialShared returns an exchange on the socket of the pool to addr, opening it if
+// needed.
+func (p *connpool) dialShared(addr string) (Transport, error) {
+	a, err := resolveUDPAddrCached(addr)
+	if err != nil {
+		return nil, err
+	}
+	key := a.String()
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	s := p.shared[key]
+	if s == nil {
+		conn, err := newDialer(p.balance, key)
+		if err != nil {
+			return nil, err
+		}
+		s = &sharedConn{pool: p, key: key, conn: conn.(*connection), routes: make(map[string]*muxConn)}
+		if p.shared == nil {
+			p.shared = make(map[string]*sharedConn)
+		}
+		p.shared[key] = s
+		go s.readLoop()
+	}
+	return s.attach(), nil
+}
+
+// openShared returns an exchange on the socket of the pool to the resolved address
+// addr, or false when no socket to addr is open.
+func (p *connpool) openShared(addr string) (Transport, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	s := p.shared[addr]
+	if s == nil {
+		return nil, false
+	}
+	return s.attach(), true
+}
+
+// attach starts an exchange on s; the pool lock is held.
+func (s *sharedConn) attach() *muxConn {
+	s.mx.Lock()
+	s.users++
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	s.mx.Unlock()
+	return &muxConn{shared: s, signal: make(chan struct{}, 1), tokens: make(map[string]bool)}
+}
+
+// remove closes s and forgets it unless a new exchange started on it meanwhile.
+func (p *connpool) remove(s *sharedConn) {
+	p.mx.Lock()
+	s.mx.Lock()
+	idle := s.users == 0
+	s.mx.Unlock()
+	if idle && p.shared[s.key] == s {
+		delete(p.shared, s.key)
+	}
+	p.mx.Unlock()
+	if idle {
+		s.close()
+	}
+}
+
+// Close closes the sockets of the pool.
+func (p *connpool) Close() error {
+	p.mx.Lock()
+	shared := p.shared
+	p.shared = nil
+	p.mx.Unlock()
+	for _, s := range shared {
+		s.close()
+	}
+	return nil
+}
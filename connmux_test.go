@@ -0,0 +1,119 @@
+package coalago
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientReusesSocketAndSession(t *testing.T) {
+	var mx sync.Mutex
+	senders := make(map[string]bool)
+	s := NewServer()
+	s.GET("/peer", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		mx.Lock()
+		senders[message.Sender.String()] = true
+		mx.Unlock()
+		return NewResponse(NewStringPayload(message.GetURIQuery("n")), CoapCodeContent)
+	})
+	ports := func() int {
+		mx.Lock()
+		defer mx.Unlock()
+		return len(senders)
+	}
+	var established atomic.Int32
+	s.OnSessionEstablished(func(SessionInfo) { established.Add(1) })
+	addr := startTestServer(t, s)
+	client := NewClient(WithPrivateKey([]byte("mux-test")))
+	defer client.Close()
+
+	// Concurrent requests share the socket and wait for one handshake
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := client.GET(fmt.Sprintf("coaps://%s/peer?n=%d", addr, i))
+			if err == nil && string(resp.Body) != fmt.Sprint(i) {
+				err = fmt.Errorf("request %d got the response %q", i, resp.Body)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if _, err := client.GET("coaps://" + addr + "/peer?n=0"); err != nil {
+		t.Fatal(err)
+	}
+	if n := established.Load(); n != 1 {
+		t.Fatalf("%d handshakes, want 1", n)
+	}
+	if ports() != 1 {
+		t.Fatalf("requests came from %d ports, want 1", ports())
+	}
+
+	// After Close the client opens a new socket
+	client.Close()
+	if _, err := client.GET("coaps://" + addr + "/peer?n=0"); err != nil {
+		t.Fatal(err)
+	}
+	if ports() != 2 || established.Load() != 2 {
+		t.Fatalf("after Close: %d ports, %d handshakes, want 2 and 2", ports(), established.Load())
+	}
+}
+
+func TestClientClosesIdleSocket(t *testing.T) {
+	s := NewServer()
+	s.GET("/ping", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("pong"), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+	client := NewClient(WithSessionTTL(50 * time.Millisecond))
+
+	if _, err := client.GET("coap://" + addr + "/ping"); err != nil {
+		t.Fatal(err)
+	}
+	open := func() int {
+		client.pool.mx.Lock()
+		defer client.pool.mx.Unlock()
+		return len(client.pool.shared)
+	}
+	if open() != 1 {
+		t.Fatal("socket closed right after the request")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for open() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle socket was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := client.GET("coap://" + addr + "/ping"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatagramToken(t *testing.T) {
+	message := NewCoAPMessage(CON, GET)
+	data, err := Serialize(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, ok := datagramToken(data); !ok || token != string(message.Token) {
+		t.Fatalf("datagramToken() = %x, %v, want %x", token, ok, message.Token)
+	}
+	for _, bad := range [][]byte{nil, {0x40, 1, 0}, {0x49, 1, 0, 0}, {0x42, 1, 0, 0, 1}} {
+		if _, ok := datagramToken(bad); ok {
+			t.Fatalf("datagramToken(%x) ok", bad)
+		}
+	}
+}
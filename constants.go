@@ -8,6 +8,7 @@ import (
 const (
 	timeWait                 = time.Second
 	maxSendAttempts          = 6
+	ACK_RANDOM_FACTOR        = 1.5   // spread of the first ACK wait, RFC 7252 §4.8
 	maxParallel              = 10000 // max parallel connections
 	SESSIONS_POOL_EXPIRATION = time.Second * 60 * 3
 	MAX_PAYLOAD_SIZE         = 1024
@@ -15,6 +16,8 @@ const (
 	MIN_WiNDOW_SIZE          = 50
 	MAX_WINDOW_SIZE          = 1500
 	MTU                      = 1500
+	NSTART                   = 1    // outstanding requests per peer of RFC 7252 §4.7, see WithNStart
+	MAX_PENDING_REQUESTS     = 1024 // requests of a client waiting for NSTART
 )
 
 const PayloadMarker = 0xff
@@ -191,6 +194,7 @@ const (
 	MediaTypeApplicationSoapFastInfoSet MediaType = 49
 	MediaTypeApplicationJSON            MediaType = 50
 	MediaTypeApplicationXObitBinary     MediaType = 51
+	MediaTypeApplicationCBOR            MediaType = 60
 	MediaTypeTextPlainVndOmaLwm2m       MediaType = 1541
 	MediaTypeTlvVndOmaLwm2m             MediaType = 1542
 	MediaTypeJSONVndOmaLwm2m            MediaType = 1543
@@ -204,6 +208,10 @@ const (
 	CoapHandshakeTypePeerHello       = 2
 	CoapHandshakeTypeClientSignature = 3
 	CoapHandshakeTypePeerSignature   = 4
+	CoapHandshakeTypePSKClientHello  = 5
+	CoapHandshakeTypePSKPeerHello    = 6
+	// Session control message, sent over the session it refers to (see sessions.go)
+	CoapHandshakeTypeClose = 7
 )
 
 type OptionCode int
@@ -250,6 +258,25 @@ const (
 
 	OptionСoapsUri OptionCode = 4005
 	OptionChecksum OptionCode = 4006
+
+	/// Sequence number option carries the per-session send sequence number of coaps://
+	/// messages when FeatureSequenceNonce is negotiated. AEAD nonces are derived from it
+	OptionSequenceNumber OptionCode = 4007
+
+	/// Handshake features option carries the session.Features offered in ClientHello and
+	/// accepted in PeerHello. Peers that omit it negotiate the legacy protocol
+	OptionHandshakeFeatures OptionCode = 4008
+
+	/// PSK identity option names the pre-shared key of a PSK ClientHello
+	OptionPSKIdentity OptionCode = 4010
+
+	/// Handshake nonce option carries the random nonce of an X25519 ClientHello or
+	/// PeerHello, see session.FeatureHandshakeNonce
+	OptionHandshakeNonce OptionCode = 4012
+
+	/// Handshake ephemeral option carries the ephemeral X25519 public key of a hello,
+	/// see session.FeatureEphemeralKey
+	OptionHandshakeEphemeral OptionCode = 4014
 )
 
 // Fragments/parts of a CoAP Message packet
@@ -272,6 +299,8 @@ var (
 	ErrUnsupportedMethod             = errors.New("unsupported method")
 	ErrNoMatchingRoute               = errors.New("no matching route found")
 	ErrUnsupportedContentFormat      = errors.New("unsupported content-format")
+	ErrInvalidCBOR                   = errors.New("malformed CBOR data")
+	ErrTooManyPending                = errors.New("too many pending requests")
 	ErrNoMatchingMethod              = errors.New("no matching method")
 	ErrNilMessage                    = errors.New("message is nil")
 	ErrRepeatedMessage               = errors.New("repeated message")
@@ -286,6 +315,13 @@ var (
 	ErrorSessionExpired              = errors.New("session expired")
 	ErrorClientSessionExpired        = errors.New("client session expired")
 	ErrorHandshake                   = errors.New("error handshake")
+	ErrorUntrustedPeerKey            = errors.New("untrusted peer public key")
+	ErrorPeerKeyRejected             = errors.New("peer rejected our public key")
+	ErrorUnknownPSKIdentity          = errors.New("unknown PSK identity")
+	ErrorPSKRejected                 = errors.New("peer rejected our PSK identity")
+	ErrorSessionClosed               = errors.New("session closed by peer")
+	ErrorReplayedMessage             = errors.New("replayed coaps message")
+	ErrSessionFileCorrupted          = errors.New("session file is corrupted or the secret is wrong")
 	ERR_KEYS_NOT_MATCH               = "expected and current public keys do not match"
 	ErrNotImplemented                = errors.New("not implemented")
 )
@@ -0,0 +1,122 @@
+package coalago
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// wellKnownCorePath is the resource discovery entry point of RFC 6690.
+const wellKnownCorePath = ".well-known/core"
+
+// WithResourceType sets the rt attribute advertised in /.well-known/core.
+func WithResourceType(rt ...string) ResourceOption {
+	return func(res *CoAPResource) {
+		res.resourceTypes = append(res.resourceTypes, rt...)
+	}
+}
+
+// WithInterface sets the if attribute advertised in /.well-known/core.
+func WithInterface(iface ...string) ResourceOption {
+	return func(res *CoAPResource) {
+		res.interfaces = append(res.interfaces, iface...)
+	}
+}
+
+// WithContentFormat sets the content formats of the resource (CoAPResource.MediaTypes),
+// advertised as the ct attribute in /.well-known/core.
+func WithContentFormat(ct ...MediaType) ResourceOption {
+	return func(res *CoAPResource) {
+		res.MediaTypes = append(res.MediaTypes, ct...)
+	}
+}
+
+// WithSize sets the sz attribute (estimated representation size in bytes) advertised in /.well-known/core.
+func WithSize(size int) ResourceOption {
+	return func(res *CoAPResource) {
+		res.size = size
+	}
+}
+
+// links describes the resources of the server in CoRE Link Format. A path served by
+// several methods is a single link carrying the attributes of all of them. Templated
+// and wildcard paths have no single target and are not listed.
+func (s *Server) links() []Link {
+	var links []Link
+	index := make(map[string]int)
+	for _, res := range s.routes.resources() {
+		if res.Path == wellKnownCorePath {
+			continue
+		}
+		i, ok := index[res.Path]
+		if !ok {
+			i = len(links)
+			index[res.Path] = i
+			links = append(links, Link{Target: "/" + res.Path})
+		}
+		link := &links[i]
+		link.ResourceTypes = appendUnique(link.ResourceTypes, res.resourceTypes...)
+		link.Interfaces = appendUnique(link.Interfaces, res.interfaces...)
+		link.ContentFormats = appendUnique(link.ContentFormats, res.MediaTypes...)
+		link.Observable = link.Observable || res.observable != nil
+		link.Size = max(link.Size, res.size)
+	}
+	return links
+}
+
+func appendUnique[T comparable](list []T, values ...T) []T {
+	for _, v := range values {
+		if !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// wellKnownCore serves /.well-known/core. Query parameters filter the links as in
+// RFC 6690 §4.1, e.g. ?rt=temperature or ?href=/sensors/*.
+func (s *Server) wellKnownCore(message *CoAPMessage) *CoAPResourceHandlerResult {
+	var links []Link
+	for _, link := range s.links() {
+		if linkMatchesQueries(link, message.GetURIQueryArray()) {
+			links = append(links, link)
+		}
+	}
+
+	result := NewResponse(NewStringPayload(FormatLinks(links)), CoapCodeContent)
+	result.MediaType = MediaTypeApplicationLinkFormat
+	return result
+}
+
+func linkMatchesQueries(link Link, queries []string) bool {
+	for _, q := range queries {
+		name, value, _ := strings.Cut(q, "=")
+		if !link.matchesQuery(name, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Discover fetches and parses the CoRE Link Format resource list of a server. When uri
+// has no path, /.well-known/core is requested, so "coap://host:5683?rt=temperature"
+// lists the temperature resources of host.
+func (c *Client) Discover(uri string) ([]Link, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/" + wellKnownCorePath
+	}
+
+	resp, err := c.GET(u.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != CoapCodeContent {
+		return nil, fmt.Errorf("discover %s: %s", u, resp.Code)
+	}
+	return ParseLinkFormat(resp.Body)
+}
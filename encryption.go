@@ -1,42 +1,142 @@
 package coalago
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"net/url"
+	"sort"
 
 	"github.com/coalalib/coalago/session"
 )
 
-func encrypt(message *CoAPMessage, address string, aead session.AEAD) error {
-	if message.Payload != nil && message.Payload.Length() != 0 {
-		var associatedData []byte
-		message.Payload = NewBytesPayload(aead.Seal(message.Payload.Bytes(), message.MessageID, associatedData))
+// Message parts sealed under the same sequence number get distinct nonces.
+const (
+	noncePartPayload byte = iota
+	noncePartURI
+)
+
+var errMissingSequenceNumber = errors.New("coaps message without sequence number")
+
+// replayed wraps the replay errors of the session package in ErrorReplayedMessage.
+func replayed(err error) error {
+	if err == session.ErrReplayedSequence || err == session.ErrReplayedMessageID {
+		return fmt.Errorf("%w: %w", ErrorReplayedMessage, err)
 	}
+	return err
+}
 
-	err := encryptionOptions(message, address, aead)
-	if err != nil {
-		return err
+// sealFunc and openFunc process one part of a message with the nonce of the session mode:
+// the MessageID in legacy sessions, the sequence number and part otherwise. The
+// associated data is empty unless session.FeatureAuthenticatedHeader is negotiated.
+type (
+	sealFunc func(part byte, plainText []byte) []byte
+	openFunc func(part byte, cipherText []byte) ([]byte, error)
+)
+
+func encrypt(message *CoAPMessage, address string, ses session.SecuredSession) error {
+	var aad []byte
+	var seal sealFunc = func(_ byte, plainText []byte) []byte {
+		return ses.AEAD.Seal(plainText, message.MessageID, aad)
 	}
 
-	return nil
+	if ses.Features.Has(session.FeatureSequenceNonce) {
+		seq, err := ses.NextSequence()
+		if err != nil {
+			return err
+		}
+		seal = func(part byte, plainText []byte) []byte {
+			return ses.AEAD.SealSequence(plainText, seq, part, aad)
+		}
+		message.RemoveOptions(OptionSequenceNumber)
+		message.AddOption(OptionSequenceNumber, string(encodeSequence(seq)))
+	}
+
+	if ses.Features.Has(session.FeatureAuthenticatedHeader) {
+		aad = associatedData(message)
+	}
+
+	if message.Payload != nil && message.Payload.Length() != 0 {
+		message.Payload = NewBytesPayload(seal(noncePartPayload, message.Payload.Bytes()))
+	}
+
+	ses.CountMessage()
+	return encryptionOptions(message, address, seal)
 }
 
-func decrypt(message *CoAPMessage, aead session.AEAD) error {
+func decrypt(message *CoAPMessage, ses session.SecuredSession) error {
+	var aad []byte
+	if ses.Features.Has(session.FeatureAuthenticatedHeader) {
+		aad = associatedData(message)
+	}
+	var open openFunc = func(_ byte, cipherText []byte) ([]byte, error) {
+		return ses.AEAD.Open(cipherText, message.MessageID, aad)
+	}
+
+	var seq uint64
+	sequenced := ses.Features.Has(session.FeatureSequenceNonce)
+	ack := message.Type == ACK
+	if !sequenced {
+		// The nonce is the message ID: a message is accepted once per session. A
+		// retransmission repeats the ID and, sealed under the same nonce, the
+		// ciphertext, so an ID known for less than MessageIDLifetime is decrypted and
+		// marked: ARQ blocks have to be acknowledged again (see handleCoapsScheme).
+		// An older one is a replay or a reused nonce and ends the session.
+		switch err := ses.CheckMessageID(message.MessageID, ack); err {
+		case nil:
+		case session.ErrReplayedMessageID:
+			message.duplicate = true
+		default:
+			return err
+		}
+	} else {
+		option := message.GetOption(OptionSequenceNumber)
+		if option == nil {
+			return errMissingSequenceNumber
+		}
+		seq = decodeSequence([]byte(option.StringValue()))
+		// Replays are rejected before decryption, but the window only moves once the
+		// message is authenticated, so a forged sequence number cannot advance it.
+		if err := ses.CheckSequence(seq); err != nil {
+			return replayed(err)
+		}
+		open = func(part byte, cipherText []byte) ([]byte, error) {
+			return ses.AEAD.OpenSequence(cipherText, seq, part, aad)
+		}
+	}
+
 	if message.Payload != nil && message.Payload.Length() != 0 {
-		var associatedData []byte
-		newPayload, err := aead.Open(message.Payload.Bytes(), message.MessageID, associatedData)
+		newPayload, err := open(noncePartPayload, message.Payload.Bytes())
 		if err != nil {
 			return err
 		}
 		message.Payload = NewBytesPayload(newPayload)
 	}
 
-	return decryptionOptions(message, aead)
-}
+	if err := decryptionOptions(message, open); err != nil {
+		return err
+	}
 
-func encryptionOptions(message *CoAPMessage, address string, aead session.AEAD) error {
-	var associatedData []byte
+	if sequenced {
+		if err := ses.AcceptSequence(seq); err != nil {
+			return replayed(err)
+		}
+		message.RemoveOptions(OptionSequenceNumber)
+	} else if !message.duplicate {
+		if err := ses.AcceptMessageID(message.MessageID, ack); err == session.ErrReplayedMessageID {
+			// A copy received concurrently
+			message.duplicate = true
+		} else if err != nil {
+			return err
+		}
+	}
+	ses.CountMessage()
+	return nil
+}
 
-	coapsURI := aead.Seal([]byte(message.GetURI(address)), message.MessageID, associatedData)
+func encryptionOptions(message *CoAPMessage, address string, seal sealFunc) error {
+	coapsURI := seal(noncePartURI, []byte(message.GetURI(address)))
 	message.RemoveOptions(OptionURIPath)
 	message.RemoveOptions(OptionURIQuery)
 	message.AddOption(OptionСoapsUri, string(coapsURI))
@@ -44,14 +144,13 @@ func encryptionOptions(message *CoAPMessage, address string, aead session.AEAD)
 	return nil
 }
 
-func decryptionOptions(message *CoAPMessage, aead session.AEAD) error {
+func decryptionOptions(message *CoAPMessage, open openFunc) error {
 	coapsURIOption := message.GetOption(OptionСoapsUri)
 	if coapsURIOption == nil {
 		return nil
 	}
 
-	var associatedData []byte
-	coapsURI, err := aead.Open([]byte(coapsURIOption.StringValue()), message.MessageID, associatedData)
+	coapsURI, err := open(noncePartURI, []byte(coapsURIOption.StringValue()))
 	if err != nil {
 		return err
 	}
@@ -74,3 +173,58 @@ func decryptionOptions(message *CoAPMessage, aead session.AEAD) error {
 	message.RemoveOptions(OptionСoapsUri)
 	return nil
 }
+
+// encodeSequence writes seq as a 6-byte big endian value, enough for session.DefaultSequenceLimit.
+func encodeSequence(seq uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	return b[2:]
+}
+
+func decodeSequence(b []byte) uint64 {
+	if len(b) > 8 {
+		return 0
+	}
+	var buf [8]byte
+	copy(buf[8-len(b):], b)
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// associatedData is the canonical form of the parts of a coaps message that travel in
+// clear but must not be altered: the header (version, type, token length, code,
+// message ID), the token and the options sorted by code, each as code (2 bytes),
+// length (2 bytes) and value. Excluded are the options a Coala proxy removes
+// (Proxy-Uri, Proxy-Scheme), the ones replaced by the encrypted URI (Uri-Path,
+// Uri-Query), the encrypted URI itself, the checksum computed after encryption, and
+// options unknown to this implementation, which the receiver drops on decoding. Every
+// option Deserialize keeps must therefore be listed in IsValidOption.
+func associatedData(message *CoAPMessage) []byte {
+	options := make([]*CoAPMessageOption, 0, len(message.Options))
+	for _, opt := range message.Options {
+		if opt.IsValidOption() && !isUnauthenticatedOption(opt.Code) {
+			options = append(options, opt)
+		}
+	}
+	sort.Stable(sortOptions(options))
+
+	var b bytes.Buffer
+	b.WriteByte(1<<6 | uint8(message.Type)<<4 | 0x0f&uint8(len(message.Token)))
+	b.WriteByte(byte(message.Code))
+	binary.Write(&b, binary.BigEndian, message.MessageID)
+	b.Write(message.Token)
+	for _, opt := range options {
+		value := valueToBytes(opt.Value)
+		binary.Write(&b, binary.BigEndian, uint16(opt.Code))
+		binary.Write(&b, binary.BigEndian, uint16(len(value)))
+		b.Write(value)
+	}
+	return b.Bytes()
+}
+
+func isUnauthenticatedOption(code OptionCode) bool {
+	switch code {
+	case OptionProxyURI, OptionProxyScheme, OptionURIPath, OptionURIQuery, OptionСoapsUri, OptionChecksum:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,416 @@
+package coalago
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+// newSessionPair returns the two ends of an established session, as the handshake
+// leaves them on the client (Verify) and on the server (PeerVerify).
+func newSessionPair(t *testing.T, features session.Features) (client, server session.SecuredSession) {
+	t.Helper()
+	client, _ = session.NewSecuredSession(nil)
+	server, _ = session.NewSecuredSession(nil)
+	client.PeerPublicKey = server.Curve.GetPublicKey()
+	server.PeerPublicKey = client.Curve.GetPublicKey()
+	client.Features, server.Features = features, features
+
+	signature, _ := client.GetSignature()
+	if err := client.Verify(signature); err != nil {
+		t.Fatal(err)
+	}
+	signature, _ = server.GetSignature()
+	if err := server.PeerVerify(signature); err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func sealedRequest(t *testing.T, ses session.SecuredSession, mid uint16) []byte {
+	t.Helper()
+	message := NewCoAPMessageId(CON, GET, mid)
+	message.SetSchemeCOAPS()
+	message.SetURIPath("/secure")
+	message.Payload = NewStringPayload("secret-password!")
+	if err := encrypt(message, "127.0.0.1:5683", ses); err != nil {
+		t.Fatalf("encrypt() error = %v", err)
+	}
+	data, err := Serialize(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func openRequest(t *testing.T, ses session.SecuredSession, data []byte) (*CoAPMessage, error) {
+	t.Helper()
+	message, err := Deserialize(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message, decrypt(message, ses)
+}
+
+func TestEncryptSequenceNonce(t *testing.T) {
+	client, server := newSessionPair(t, session.FeatureSequenceNonce)
+
+	first := sealedRequest(t, client, 42)
+	second := sealedRequest(t, client, 42) // same MessageID, as after a wrap-around
+	if bytes.Equal(first, second) {
+		t.Fatal("messages with the same MessageID produced the same ciphertext")
+	}
+
+	for _, data := range [][]byte{second, first} {
+		message, err := openRequest(t, server, data)
+		if err != nil {
+			t.Fatalf("decrypt() error = %v", err)
+		}
+		if message.GetURIPath() != "/secure" || message.Payload.String() != "secret-password!" {
+			t.Fatalf("decrypted %q %q", message.GetURIPath(), message.Payload.String())
+		}
+		if message.GetOption(OptionSequenceNumber) != nil {
+			t.Fatal("sequence number option left in the decrypted message")
+		}
+	}
+
+	if _, err := openRequest(t, server, first); !errors.Is(err, ErrorReplayedMessage) || !errors.Is(err, session.ErrReplayedSequence) {
+		t.Fatalf("replayed decrypt() error = %v, want %v", err, session.ErrReplayedSequence)
+	}
+
+	legacyClient, _ := newSessionPair(t, 0)
+	if _, err := openRequest(t, server, sealedRequest(t, legacyClient, 43)); err != errMissingSequenceNumber {
+		t.Fatalf("decrypt() of a legacy message error = %v, want %v", err, errMissingSequenceNumber)
+	}
+}
+
+func TestEncryptLegacyMode(t *testing.T) {
+	client, server := newSessionPair(t, 0)
+
+	data := sealedRequest(t, client, 42)
+	message, err := openRequest(t, server, data)
+	if err != nil {
+		t.Fatalf("decrypt() error = %v", err)
+	}
+	if message.GetOption(OptionSequenceNumber) != nil {
+		t.Fatal("legacy message carries a sequence number")
+	}
+	if message.GetURIPath() != "/secure" || message.Payload.String() != "secret-password!" {
+		t.Fatalf("decrypted %q %q", message.GetURIPath(), message.Payload.String())
+	}
+
+	// A retransmission cannot be told from a replay: it is decrypted and marked.
+	if replay, err := openRequest(t, server, data); err != nil || !replay.duplicate {
+		t.Fatalf("replayed decrypt() error = %v, duplicate = %v, want a marked duplicate", err, replay.duplicate)
+	}
+	// The peer's acknowledgement of our message 42 is not a replay.
+	ack := NewCoAPMessageId(ACK, CoapCodeContent, 42)
+	ack.Payload = NewStringPayload("ok")
+	if err := encrypt(ack, "127.0.0.1:5683", client); err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt(ack, server); err != nil {
+		t.Fatalf("decrypt() of an ACK with the same message ID error = %v", err)
+	}
+}
+
+func TestCoapsRekeysBeforeSequenceExhaustion(t *testing.T) {
+	defer session.SetSequenceLimit(session.SetSequenceLimit(16))
+
+	s := NewServer()
+	s.GET("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+	client := NewClient()
+
+	handshakes := MetricSuccessfulHandhshakes.Val()
+	for i := 0; i < 40; i++ {
+		resp, err := client.GET("coaps://" + addr + "/secure")
+		if err != nil {
+			t.Fatalf("request %d: GET() error = %v", i, err)
+		}
+		if string(resp.Body) != "ok" {
+			t.Fatalf("request %d: body = %q", i, resp.Body)
+		}
+	}
+
+	// Client and server both count their handshakes: one initial session plus at
+	// least three renegotiations on each side.
+	if got := MetricSuccessfulHandhshakes.Val() - handshakes; got < 8 {
+		t.Fatalf("handshakes = %d, want at least 8", got)
+	}
+}
+
+func TestCoapsForwardSecrecy(t *testing.T) {
+	clientKey := []byte("client-key")
+	peers := make(chan []byte, 1)
+	s := NewServer(WithPrivateKey([]byte("server-key")))
+	s.GET("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		key, _ := message.PeerIdentity()
+		peers <- key
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+
+	resp, err := NewClient(WithPrivateKey(clientKey), WithForwardSecrecy()).GET("coaps://" + addr + "/secure")
+	if err != nil {
+		t.Fatalf("GET() error = %v", err)
+	}
+	if string(resp.Body) != "ok" {
+		t.Fatalf("body = %q", resp.Body)
+	}
+	// The static key still identifies the client.
+	if key := <-peers; !bytes.Equal(key, publicKeyOf(t, clientKey)) {
+		t.Fatalf("PeerIdentity() = %x, want the static client key", key)
+	}
+}
+
+func TestCoapsAuthenticatedHeaderLargePayload(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 700)
+
+	s := NewServer()
+	s.POST("/echo", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewBytesPayload(message.Payload.Bytes()), CoapCodeChanged)
+	})
+	addr := startTestServer(t, s)
+
+	resp, err := NewClient().POST(body, "coaps://"+addr+"/echo")
+	if err != nil {
+		t.Fatalf("POST() error = %v", err)
+	}
+	if !bytes.Equal(resp.Body, body) {
+		t.Fatalf("echoed %d bytes, want %d", len(resp.Body), len(body))
+	}
+}
+
+func TestEncryptAuthenticatedHeader(t *testing.T) {
+	seal := func(ses session.SecuredSession) []byte {
+		message := NewCoAPMessageId(CON, POST, 42)
+		message.Token = []byte{1, 2, 3, 4}
+		message.SetSchemeCOAPS()
+		message.SetURIPath("/fw")
+		message.AddOption(OptionBlock1, newBlock(true, 3, MAX_PAYLOAD_SIZE).ToInt())
+		message.AddOption(OptionSize2, 4096)
+		message.SetProxy("coap", "10.0.0.2:5683")
+		message.Payload = NewStringPayload("firmware block")
+		if err := encrypt(message, "127.0.0.1:5683", ses); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := Serialize(message)
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(*CoAPMessage)
+		ok     bool
+	}{
+		{"untouched", func(*CoAPMessage) {}, true},
+		{"proxy strips Proxy-Uri", func(m *CoAPMessage) {
+			m.RemoveOptions(OptionProxyURI)
+			m.RemoveOptions(OptionProxyScheme)
+		}, true},
+		{"code", func(m *CoAPMessage) { m.Code = CoapCode(DELETE) }, false},
+		{"type", func(m *CoAPMessage) { m.Type = NON }, false},
+		{"message id", func(m *CoAPMessage) { m.MessageID++ }, false},
+		{"token", func(m *CoAPMessage) { m.Token[0] ^= 1 }, false},
+		{"block number", func(m *CoAPMessage) {
+			m.RemoveOptions(OptionBlock1)
+			m.AddOption(OptionBlock1, newBlock(true, 4, MAX_PAYLOAD_SIZE).ToInt())
+		}, false},
+		{"size2", func(m *CoAPMessage) {
+			m.RemoveOptions(OptionSize2)
+			m.AddOption(OptionSize2, 1<<20)
+		}, false},
+		{"removed size2", func(m *CoAPMessage) { m.RemoveOptions(OptionSize2) }, false},
+		{"added option", func(m *CoAPMessage) { m.AddOption(OptionObserve, 1) }, false},
+	}
+
+	client, server := newSessionPair(t, session.FeatureSequenceNonce|session.FeatureAuthenticatedHeader)
+	for _, tt := range tests {
+		message, err := Deserialize(seal(client))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.tamper(message)
+		if err := decrypt(message, server); (err == nil) != tt.ok {
+			t.Errorf("%s: decrypt() error = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+
+	// Without the feature the header is not covered and a swapped code goes unnoticed.
+	client, server = newSessionPair(t, session.FeatureSequenceNonce)
+	message, _ := Deserialize(seal(client))
+	message.Code = CoapCode(DELETE)
+	if err := decrypt(message, server); err != nil {
+		t.Fatalf("decrypt() without authenticated header error = %v", err)
+	}
+}
+
+func TestReceiveMessageSkipsReplayedResponse(t *testing.T) {
+	client, server := newSessionPair(t, session.SupportedFeatures)
+	conn := &scriptedTransport{
+		local:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+		remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5683},
+	}
+	tr := newtransport(conn)
+	tr.sessions = newSessionStorageImpl(time.Minute)
+	tr.sessions.Set(conn.local.String(), conn.remote.String(), "", client)
+
+	request := NewCoAPMessageId(CON, GET, 7)
+	request.Token = []byte{1, 2, 3, 4}
+	response := func(payload string) []byte {
+		message := NewCoAPMessageId(ACK, CoapCodeContent, 7)
+		message.Token = request.Token
+		message.SetSchemeCOAPS()
+		message.Payload = NewStringPayload(payload)
+		if err := encrypt(message, conn.local.String(), server); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := Serialize(message)
+		return data
+	}
+	first, second := response("first"), response("second")
+	conn.queue = [][]byte{first, first, second}
+
+	for _, want := range []string{"first", "second"} {
+		message, err := receiveMessage(tr, request, time.Second)
+		if err != nil {
+			t.Fatalf("receiveMessage() error = %v", err)
+		}
+		if message.Payload.String() != want {
+			t.Fatalf("receiveMessage() = %q, want %q", message.Payload.String(), want)
+		}
+	}
+}
+
+// sealedBlock returns a legacy coaps ARQ block of a POST to /upload.
+func sealedBlock(t *testing.T, ses session.SecuredSession, option OptionCode, mid uint16, num int, more bool) []byte {
+	t.Helper()
+	message := NewCoAPMessageId(CON, POST, mid)
+	message.Token = []byte{5, 6, 7, 8}
+	message.SetSchemeCOAPS()
+	message.SetURIPath("/upload")
+	message.AddOption(option, newBlock(more, num, 16).ToInt())
+	message.Payload = NewBytesPayload(bytes.Repeat([]byte{byte('a' + num)}, 16))
+	if err := encrypt(message, "127.0.0.1:5683", ses); err != nil {
+		t.Fatal(err)
+	}
+	data, err := Serialize(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestLegacyBlock1LostACK(t *testing.T) {
+	client, server := newSessionPair(t, 0)
+	conn := &scriptedTransport{
+		local:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5683},
+		remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+	}
+	tr := newtransport(conn)
+	tr.sessions = newSessionStorageImpl(time.Minute)
+	tr.sessions.Set(conn.local.String(), conn.remote.String(), "", server)
+
+	deliver := func(ls *localState, data []byte) {
+		message, err := Deserialize(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message.Sender = conn.remote
+		ls.processMessage(message)
+	}
+	block := sealedBlock(t, client, OptionBlock1, 100, 0, true)
+
+	ls := newLocalState(nil, tr)
+	deliver(ls, block)
+	// The ACK is lost and the client sends the same datagram again.
+	deliver(ls, block)
+	if len(conn.written) != 2 {
+		t.Fatalf("sent %d ACKs, want the retransmitted block acknowledged again", len(conn.written))
+	}
+	ack, err := Deserialize(conn.written[1])
+	if err != nil || ack.Type != ACK || ack.MessageID != 100 {
+		t.Fatalf("second reply = %+v, %v, want the ACK of block 0", ack, err)
+	}
+
+	// The same datagram replayed outside the transfer is not acknowledged.
+	deliver(newLocalState(nil, tr), block)
+	if len(conn.written) != 2 {
+		t.Fatal("replayed block started a new transfer")
+	}
+}
+
+func TestLegacyBlock2LostACK(t *testing.T) {
+	client, server := newSessionPair(t, 0)
+	conn := &scriptedTransport{
+		local:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+		remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5683},
+	}
+	tr := newtransport(conn)
+	tr.sessions = newSessionStorageImpl(time.Minute)
+	tr.sessions.Set(conn.local.String(), conn.remote.String(), "", client)
+
+	first := sealedBlock(t, server, OptionBlock2, 200, 0, true)
+	// The ACK of the first block is lost and the server sends it again.
+	conn.queue = [][]byte{first, first, sealedBlock(t, server, OptionBlock2, 201, 1, false)}
+
+	request := NewCoAPMessageId(CON, GET, 1)
+	request.Token = []byte{5, 6, 7, 8}
+	request.SetSchemeCOAPS()
+	resp, err := tr.receiveARQBlock2(request, nil)
+	if err != nil {
+		t.Fatalf("receiveARQBlock2() error = %v", err)
+	}
+	if want := strings.Repeat("a", 16) + strings.Repeat("b", 16); resp.Payload.String() != want {
+		t.Fatalf("body = %q, want %q", resp.Payload.String(), want)
+	}
+	if len(conn.written) != 3 {
+		t.Fatalf("sent %d ACKs, want 3", len(conn.written))
+	}
+}
+
+// scriptedTransport reads the datagrams queued by the test, then times out, and keeps
+// what is written to it.
+type scriptedTransport struct {
+	checksumTransport
+	local, remote net.Addr
+
+	mx      sync.Mutex
+	queue   [][]byte
+	written [][]byte
+}
+
+func (t *scriptedTransport) RemoteAddr() net.Addr { return t.remote }
+func (t *scriptedTransport) LocalAddr() net.Addr  { return t.local }
+
+func (t *scriptedTransport) Read(buf []byte) (int, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if len(t.queue) == 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n := copy(buf, t.queue[0])
+	t.queue = t.queue[1:]
+	return n, nil
+}
+
+func (t *scriptedTransport) Write(buf []byte) (int, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.written = append(t.written, append([]byte(nil), buf...))
+	return len(buf), nil
+}
+
+func (t *scriptedTransport) WriteTo(buf []byte, _ string) (int, error) {
+	return t.Write(buf)
+}
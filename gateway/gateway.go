@@ -0,0 +1,302 @@
+// Package gateway is an HTTP-to-CoAP proxy in the sense of RFC 8075: an http.Handler
+// that forwards requests for /coap/{host}/{path}?{query} to the Coala endpoint at host
+// and translates the response back to HTTP.
+//
+//	gw := gateway.New(gateway.WithPrivateKey(seed))
+//	http.Handle("/coap/", gw)
+//
+// GET, POST, PUT and DELETE map to the CoAP methods of the same name. Content-Type and
+// Accept headers map to the Content-Format and Accept options, response codes to HTTP
+// statuses as in RFC 8075, and the body of a Block2 response is streamed to the HTTP
+// client while it is still being received.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coalalib/coalago"
+)
+
+const (
+	defaultPrefix      = "/coap/"
+	defaultPort        = "5683"
+	defaultTimeout     = 30 * time.Second
+	defaultMaxBodySize = 1 << 20
+)
+
+// Gateway forwards HTTP requests to Coala endpoints, see the package documentation.
+type Gateway struct {
+	client      *coalago.Client
+	clientOpts  []coalago.Opt
+	prefix      string
+	secure      bool
+	proxy       string
+	routes      map[string]string
+	timeout     time.Duration
+	maxBodySize int64
+}
+
+// Option configures a Gateway.
+type Option func(*Gateway)
+
+// WithPrivateKey makes the gateway reach endpoints over coaps, with an X25519 key
+// derived from seed as with coalago.WithPrivateKey.
+func WithPrivateKey(seed []byte) Option {
+	return func(g *Gateway) {
+		g.secure = true
+		g.clientOpts = append(g.clientOpts, coalago.WithPrivateKey(seed))
+	}
+}
+
+// WithClientOptions passes options to the coalago.Client of the gateway, e.g.
+// coalago.WithAckTimeout or coalago.WithKeyVerifier.
+func WithClientOptions(opts ...coalago.Opt) Option {
+	return func(g *Gateway) {
+		g.clientOpts = append(g.clientOpts, opts...)
+	}
+}
+
+// WithProxy sends the requests for every host without a route of its own through the
+// Coala proxy at addr (see coalago.CoAPMessage.SetProxy).
+func WithProxy(addr string) Option {
+	return func(g *Gateway) {
+		g.proxy = addr
+	}
+}
+
+// WithRoute sends the requests for host through the Coala proxy at proxy. host is
+// matched as it appears in the request path, e.g. "10.0.0.7:5683".
+func WithRoute(host, proxy string) Option {
+	return func(g *Gateway) {
+		g.routes[host] = proxy
+	}
+}
+
+// WithPrefix sets the path under which the gateway is mounted (default "/coap/").
+func WithPrefix(prefix string) Option {
+	return func(g *Gateway) {
+		g.prefix = "/" + strings.Trim(prefix, "/") + "/"
+	}
+}
+
+// WithTimeout bounds the time to complete a CoAP exchange (default 30s); the context of
+// the HTTP request can end it earlier. 0 disables the limit.
+func WithTimeout(d time.Duration) Option {
+	return func(g *Gateway) {
+		g.timeout = d
+	}
+}
+
+// WithMaxBodySize limits the size of the HTTP request bodies forwarded (default 1 MiB).
+func WithMaxBodySize(n int64) Option {
+	return func(g *Gateway) {
+		g.maxBodySize = n
+	}
+}
+
+// New returns a Gateway configured by opts.
+func New(opts ...Option) *Gateway {
+	g := &Gateway{
+		prefix:      defaultPrefix,
+		routes:      make(map[string]string),
+		timeout:     defaultTimeout,
+		maxBodySize: defaultMaxBodySize,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	g.client = coalago.NewClient(g.clientOpts...)
+	return g
+}
+
+// ServeHTTP forwards r to the endpoint named in its path.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, g.prefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	host, path, _ := strings.Cut(rest, "/")
+	if host == "" {
+		http.Error(w, "missing CoAP host", http.StatusBadRequest)
+		return
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+	}
+
+	code, ok := methods[r.Method]
+	if !ok {
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, g.maxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	message := coalago.NewCoAPMessage(coalago.CON, code)
+	scheme := "coap"
+	if g.secure {
+		scheme = "coaps"
+		message.SetSchemeCOAPS()
+	}
+	message.SetURIPath("/" + path)
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range query[k] {
+			message.SetURIQuery(k, v)
+		}
+	}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		format, ok := coalago.MediaTypeOf(contentType)
+		if !ok {
+			http.Error(w, "no CoAP Content-Format for "+contentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		message.SetMediaType(format)
+	}
+	if format, ok := coalago.MediaTypeOf(r.Header.Get("Accept")); ok {
+		message.AddOption(coalago.OptionAccept, format)
+	}
+	if len(body) > 0 {
+		message.Payload = coalago.NewBytesPayload(body)
+	}
+
+	addr := host
+	if proxy := g.proxyFor(host); proxy != "" {
+		message.SetProxy(scheme, host)
+		addr = proxy
+	}
+
+	ctx := r.Context()
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+
+	rw := &responseWriter{w: w, base: g.prefix + strings.TrimSuffix(rest, path)}
+	if _, err := g.client.Stream(ctx, message, addr, rw.start); err != nil {
+		if rw.wroteHeader {
+			// Part of the body is out: abort the response rather than end it cleanly
+			panic(http.ErrAbortHandler)
+		}
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	rw.finish()
+}
+
+func (g *Gateway) proxyFor(host string) string {
+	if proxy, ok := g.routes[host]; ok {
+		return proxy
+	}
+	return g.proxy
+}
+
+// errorStatus is the HTTP status for a CoAP exchange that did not complete.
+func errorStatus(err error) int {
+	if errors.Is(err, coalago.ErrMaxAttempts) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// responseWriter copies a CoAP response to an http.ResponseWriter. The status is
+// written with the first byte of the body, since 2.02 and 2.04 without a body become
+// 204 No Content.
+type responseWriter struct {
+	w           http.ResponseWriter
+	base        string // gateway path of the endpoint, for Location
+	code        coalago.CoapCode
+	wroteHeader bool
+}
+
+func (rw *responseWriter) start(resp *coalago.Response) io.Writer {
+	rw.code = resp.Code
+	header := rw.w.Header()
+	if mt, ok := resp.ContentFormat(); ok {
+		if t, ok := mt.MIMEType(); ok {
+			header.Set("Content-Type", t)
+		} else {
+			header.Set("Content-Type", "application/octet-stream")
+		}
+	}
+	if etag := resp.ETag(); etag != nil {
+		header.Set("ETag", fmt.Sprintf(`"%x"`, etag))
+	}
+	if hasOption(resp, coalago.OptionMaxAge) {
+		header.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(resp.MaxAge().Seconds())))
+	}
+	if location, ok := locationOf(resp); ok {
+		header.Set("Location", strings.TrimSuffix(rw.base, "/")+location)
+	}
+	return rw
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.w.WriteHeader(HTTPStatus(rw.code, true))
+	}
+	n, err := rw.w.Write(b)
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+func (rw *responseWriter) finish() {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.w.WriteHeader(HTTPStatus(rw.code, false))
+	}
+}
+
+// locationOf joins the Location-Path and Location-Query options of a response.
+func locationOf(resp *coalago.Response) (string, bool) {
+	path, query := resp.LocationPath(), resp.LocationQuery()
+	if path == "" && len(query) == 0 {
+		return "", false
+	}
+	if path == "" {
+		path = "/"
+	}
+	if len(query) > 0 {
+		path += "?" + strings.Join(query, "&")
+	}
+	return path, true
+}
+
+// hasOption reports whether resp has an option with code.
+func hasOption(resp *coalago.Response, code coalago.OptionCode) bool {
+	for _, opt := range resp.Options {
+		if opt.Code == code {
+			return true
+		}
+	}
+	return false
+}
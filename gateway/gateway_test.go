@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago"
+)
+
+// startServer starts s on a free local port and returns its address.
+func startServer(t *testing.T, s *coalago.Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	go s.Listen(addr)
+	t.Cleanup(func() { s.Close() })
+	time.Sleep(50 * time.Millisecond)
+	return addr
+}
+
+func newDevice(t *testing.T, big []byte) string {
+	t.Helper()
+	s := coalago.NewServer()
+	s.GET("/info", func(message *coalago.CoAPMessage) *coalago.CoAPResourceHandlerResult {
+		result := coalago.NewResponse(coalago.NewStringPayload(`{"name":"`+message.GetURIQuery("name")+`"}`), coalago.CoapCodeContent)
+		result.MediaType = coalago.MediaTypeApplicationJSON
+		return result
+	})
+	s.PUT("/items", func(message *coalago.CoAPMessage) *coalago.CoAPResourceHandlerResult {
+		var format coalago.MediaType = -1
+		if opt := message.GetOption(coalago.OptionContentFormat); opt != nil {
+			format = coalago.MediaType(opt.IntValue())
+		}
+		if format != coalago.MediaTypeApplicationJSON {
+			return coalago.NewResponse(coalago.NewEmptyPayload(), coalago.CoapCodeUnsupportedContentFormat)
+		}
+		return coalago.NewResponse(coalago.NewBytesPayload(message.Payload.Bytes()), coalago.CoapCodeCreated)
+	})
+	s.DELETE("/items", func(message *coalago.CoAPMessage) *coalago.CoAPResourceHandlerResult {
+		return coalago.NewResponse(coalago.NewEmptyPayload(), coalago.CoapCodeDeleted)
+	})
+	s.GET("/big", func(message *coalago.CoAPMessage) *coalago.CoAPResourceHandlerResult {
+		result := coalago.NewResponse(coalago.NewBytesPayload(big), coalago.CoapCodeContent)
+		result.MediaType = coalago.MediaTypeApplicationOctetStream
+		return result
+	})
+	s.GET("/peer", func(message *coalago.CoAPMessage) *coalago.CoAPResourceHandlerResult {
+		if len(message.PeerPublicKey) == 0 {
+			return coalago.NewResponse(coalago.NewStringPayload("plain"), coalago.CoapCodeContent)
+		}
+		return coalago.NewResponse(coalago.NewStringPayload("secure"), coalago.CoapCodeContent)
+	})
+	return startServer(t, s)
+}
+
+func do(t *testing.T, h http.Handler, method, target, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestGateway(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 2000)
+	device := newDevice(t, big)
+	gw := New(WithTimeout(5 * time.Second))
+
+	tests := []struct {
+		name, method, path, contentType, body string
+		status                                int
+		wantType, wantBody                    string
+	}{
+		{"content with query", "GET", "/info?name=lamp", "", "", http.StatusOK, "application/json", `{"name":"lamp"}`},
+		{"created", "PUT", "/items", "application/json", `{"id":1}`, http.StatusCreated, "", `{"id":1}`},
+		{"unsupported format at the device", "PUT", "/items", "text/plain", "x", http.StatusUnsupportedMediaType, "", ""},
+		{"deleted without body", "DELETE", "/items", "", "", http.StatusNoContent, "", ""},
+		{"not found", "GET", "/missing", "", "", http.StatusNotFound, "", ""},
+		{"not allowed at the device", "POST", "/info", "", "", http.StatusBadRequest, "", ""},
+		{"method without CoAP equivalent", "PATCH", "/info", "", "", http.StatusMethodNotAllowed, "", ""},
+		{"unknown content type", "POST", "/info", "application/x-unknown", "x", http.StatusUnsupportedMediaType, "", ""},
+		{"streamed Block2", "GET", "/big", "", "", http.StatusOK, "application/octet-stream", string(big)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(t, gw, tt.method, "/coap/"+device+tt.path, tt.contentType, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.status, w.Body.String())
+			}
+			if tt.wantType != "" && w.Header().Get("Content-Type") != tt.wantType {
+				t.Fatalf("Content-Type = %q, want %q", w.Header().Get("Content-Type"), tt.wantType)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Fatalf("body = %d bytes %.40q, want %d bytes", w.Body.Len(), w.Body.String(), len(tt.wantBody))
+			}
+		})
+	}
+}
+
+func TestGatewaySecureAndProxied(t *testing.T) {
+	device := newDevice(t, nil)
+
+	secure := New(WithPrivateKey([]byte("gateway")), WithTimeout(5*time.Second))
+	if w := do(t, secure, "GET", "/coap/"+device+"/peer", "", ""); w.Body.String() != "secure" {
+		t.Fatalf("coaps response = %d %q", w.Code, w.Body.String())
+	}
+
+	proxy := coalago.NewServer()
+	proxy.Proxy(true)
+	proxyAddr := startServer(t, proxy)
+	proxied := New(WithRoute(device, proxyAddr), WithTimeout(5*time.Second))
+	if w := do(t, proxied, "GET", "/coap/"+device+"/info?name=relay", "", ""); w.Body.String() != `{"name":"relay"}` {
+		t.Fatalf("proxied response = %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestGatewayTimeout(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // a peer that never answers
+
+	gw := New(WithTimeout(300 * time.Millisecond))
+	w := do(t, gw, "GET", "/coap/"+conn.LocalAddr().String()+"/info", "", "")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	if got := HTTPStatus(coalago.CoapCodeUnauthorized, true); got != http.StatusForbidden {
+		t.Errorf("HTTPStatus(4.01) = %d, want %d", got, http.StatusForbidden)
+	}
+	if got := HTTPStatus(coalago.CoapCodeChanged, true); got != http.StatusOK {
+		t.Errorf("HTTPStatus(2.04) with body = %d, want %d", got, http.StatusOK)
+	}
+	if got := HTTPStatus(coalago.CoapCodeChanged, false); got != http.StatusNoContent {
+		t.Errorf("HTTPStatus(2.04) without body = %d, want %d", got, http.StatusNoContent)
+	}
+}
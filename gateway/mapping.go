@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/coalalib/coalago"
+)
+
+// statuses maps CoAP response codes to HTTP status codes (RFC 8075, section 7).
+var statuses = map[coalago.CoapCode]int{
+	coalago.CoapCodeCreated:                  http.StatusCreated,
+	coalago.CoapCodeDeleted:                  http.StatusOK,
+	coalago.CoapCodeValid:                    http.StatusNotModified,
+	coalago.CoapCodeChanged:                  http.StatusOK,
+	coalago.CoapCodeContent:                  http.StatusOK,
+	coalago.CoapCodeBadRequest:               http.StatusBadRequest,
+	coalago.CoapCodeUnauthorized:             http.StatusForbidden,
+	coalago.CoapCodeBadOption:                http.StatusBadRequest,
+	coalago.CoapCodeForbidden:                http.StatusForbidden,
+	coalago.CoapCodeNotFound:                 http.StatusNotFound,
+	coalago.CoapCodeMethodNotAllowed:         http.StatusBadRequest,
+	coalago.CoapCodeNotAcceptable:            http.StatusNotAcceptable,
+	coalago.CoapCodeRequestEntityIncomplete:  http.StatusBadRequest,
+	coalago.CoapCodeConflict:                 http.StatusConflict,
+	coalago.CoapCodePreconditionFailed:       http.StatusPreconditionFailed,
+	coalago.CoapCodeRequestEntityTooLarge:    http.StatusRequestEntityTooLarge,
+	coalago.CoapCodeUnsupportedContentFormat: http.StatusUnsupportedMediaType,
+	coalago.CoapCodeInternalServerError:      http.StatusInternalServerError,
+	coalago.CoapCodeNotImplemented:           http.StatusNotImplemented,
+	coalago.CoapCodeBadGateway:               http.StatusBadGateway,
+	coalago.CoapCodeServiceUnavailable:       http.StatusServiceUnavailable,
+	coalago.CoapCodeGatewayTimeout:           http.StatusGatewayTimeout,
+	coalago.CoapCodeProxyingNotSupported:     http.StatusBadGateway,
+}
+
+// HTTPStatus returns the HTTP status of a CoAP response code. 2.02 Deleted and 2.04
+// Changed map to 204 No Content when the response has no body.
+func HTTPStatus(code coalago.CoapCode, hasBody bool) int {
+	if !hasBody && (code == coalago.CoapCodeDeleted || code == coalago.CoapCodeChanged) {
+		return http.StatusNoContent
+	}
+	if status, ok := statuses[code]; ok {
+		return status
+	}
+	switch {
+	case code >= 64 && code < 96:
+		return http.StatusOK
+	case code >= 128 && code < 160:
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+// methods maps HTTP methods to CoAP request codes.
+var methods = map[string]coalago.CoapCode{
+	http.MethodGet:    coalago.GET,
+	http.MethodPost:   coalago.POST,
+	http.MethodPut:    coalago.PUT,
+	http.MethodDelete: coalago.DELETE,
+}
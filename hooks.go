@@ -0,0 +1,182 @@
+package coalago
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+// SessionInfo describes a coaps session of a Server.
+type SessionInfo struct {
+	// Peer is the address of the peer, as it appears in CoAPMessage.Sender.
+	Peer string
+	// Proxy is the Coala proxy the session goes through, followed by the proxy security
+	// ID; "" for direct sessions.
+	Proxy string
+	// PeerPublicKey is the X25519 public key of the peer, nil for PSK sessions.
+	PeerPublicKey []byte
+	// PSKIdentity is the identity of a PSK session, "" for X25519 sessions.
+	PSKIdentity string
+	CreatedAt   time.Time
+	// UpdatedAt is the last time the session was used.
+	UpdatedAt time.Time
+}
+
+func newSessionInfo(key string, ses session.SecuredSession) SessionInfo {
+	info := SessionInfo{
+		PeerPublicKey: ses.PeerPublicKey,
+		PSKIdentity:   ses.PSKIdentity,
+		CreatedAt:     time.Unix(int64(ses.CreatedAt), 0),
+		UpdatedAt:     time.Unix(int64(ses.UpdatedAt), 0),
+	}
+	if parts := strings.SplitN(key, "|", 3); len(parts) == 3 {
+		info.Peer, info.Proxy = parts[1], parts[2]
+	}
+	return info
+}
+
+// Sessions returns the live coaps sessions of the server.
+func (s *Server) Sessions() []SessionInfo {
+	var sessions []SessionInfo
+	s.sessions.store.Range(func(key string, ses session.SecuredSession) bool {
+		sessions = append(sessions, newSessionInfo(key, ses))
+		return true
+	})
+	return sessions
+}
+
+// OnSessionEstablished sets f to be called after every successful coaps handshake of
+// the server, in either role. A rekey of a peer establishes a new session. The hooks
+// run on the goroutine processing the handshake; hand slow work off to another one.
+func (s *Server) OnSessionEstablished(f func(SessionInfo)) {
+	s.hooks.mx.Lock()
+	s.hooks.established = f
+	s.hooks.mx.Unlock()
+}
+
+// OnSessionExpired sets f to be called when a session of the server ends: it was idle
+// for longer than the session TTL, the peer closed it, or it failed to decrypt. TTL
+// expiry is noticed within sessionSweepInterval. Only sessions established after
+// the call are reported.
+func (s *Server) OnSessionExpired(f func(SessionInfo)) {
+	s.hooks.mx.Lock()
+	s.hooks.expired = f
+	s.hooks.mx.Unlock()
+	s.sessions.watch(s.hooks)
+}
+
+// OnHandshakeFailed sets f to be called when a coaps handshake with peer fails, in
+// either role: a malformed hello, a rejected key or PSK identity, or no answer.
+func (s *Server) OnHandshakeFailed(f func(peer string, err error)) {
+	s.hooks.mx.Lock()
+	s.hooks.failed = f
+	s.hooks.mx.Unlock()
+}
+
+// sessionHooks are the session callbacks of a Server; a nil *sessionHooks (clients)
+// calls nothing.
+type sessionHooks struct {
+	mx          sync.RWMutex
+	established func(SessionInfo)
+	expired     func(SessionInfo)
+	failed      func(peer string, err error)
+}
+
+func (h *sessionHooks) sessionEstablished(sender, receiver, proxy string, ses session.SecuredSession) {
+	if h == nil {
+		return
+	}
+	h.mx.RLock()
+	f := h.established
+	h.mx.RUnlock()
+	if f != nil {
+		f(newSessionInfo(sessionKey(sender, receiver, proxy), ses))
+	}
+}
+
+func (h *sessionHooks) sessionExpired(key string, ses session.SecuredSession) {
+	if h == nil {
+		return
+	}
+	h.mx.RLock()
+	f := h.expired
+	h.mx.RUnlock()
+	if f != nil {
+		f(newSessionInfo(key, ses))
+	}
+}
+
+func (h *sessionHooks) handshakeFailed(peer net.Addr, err error) {
+	if h == nil || peer == nil {
+		return
+	}
+	h.mx.RLock()
+	f := h.failed
+	h.mx.RUnlock()
+	if f != nil {
+		f(peer.String(), err)
+	}
+}
+
+// sessionSweepInterval is how often a watched session storage looks for sessions the
+// store has expired.
+var sessionSweepInterval = 10 * time.Second
+
+// sessionWatch remembers the sessions of a storage to report the ones that end.
+type sessionWatch struct {
+	mx    sync.Mutex
+	live  map[string]session.SecuredSession
+	hooks *sessionHooks
+}
+
+// watch starts reporting the sessions of s that end to hooks.
+func (s *sessionStorageImpl) watch(hooks *sessionHooks) {
+	s.watchOnce.Do(func() {
+		w := &sessionWatch{live: make(map[string]session.SecuredSession), hooks: hooks}
+		s.watcher.Store(w)
+		go func() {
+			ticker := time.NewTicker(sessionSweepInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				s.sweep(w)
+			}
+		}()
+	})
+}
+
+func (w *sessionWatch) set(key string, ses session.SecuredSession) {
+	w.mx.Lock()
+	w.live[key] = ses
+	w.mx.Unlock()
+}
+
+func (w *sessionWatch) delete(key string) {
+	w.mx.Lock()
+	ses, ok := w.live[key]
+	delete(w.live, key)
+	w.mx.Unlock()
+	if ok {
+		w.hooks.sessionExpired(key, ses)
+	}
+}
+
+// sweep reports the watched sessions the store no longer has.
+func (s *sessionStorageImpl) sweep(w *sessionWatch) {
+	ended := make(map[string]session.SecuredSession)
+	// Checked under the lock, so a session Set again meanwhile is not reported
+	w.mx.Lock()
+	for key, ses := range w.live {
+		if _, ok := s.store.Get(key); !ok {
+			delete(w.live, key)
+			ended[key] = ses
+		}
+	}
+	w.mx.Unlock()
+
+	for key, ses := range ended {
+		w.hooks.sessionExpired(key, ses)
+	}
+}
@@ -0,0 +1,112 @@
+package coalago
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerSessions(t *testing.T) {
+	key := []byte("device-key")
+	a, b, aAddr, bAddr := newPeerServers(t, WithPrivateKey(key))
+	established := make(chan SessionInfo, 1)
+	b.OnSessionEstablished(func(info SessionInfo) { established <- info })
+
+	before := time.Now().Add(-time.Second)
+	secureGET(t, a, bAddr)
+
+	select {
+	case info := <-established:
+		if info.Peer != aAddr {
+			t.Fatalf("established Peer = %q, want %q", info.Peer, aAddr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnSessionEstablished was not called")
+	}
+
+	sessions := b.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("Sessions() = %d, want 1", len(sessions))
+	}
+	info := sessions[0]
+	if info.Peer != aAddr || info.Proxy != "" {
+		t.Fatalf("Sessions() peer = %q proxy = %q, want %q", info.Peer, info.Proxy, aAddr)
+	}
+	if !bytes.Equal(info.PeerPublicKey, publicKeyOf(t, key)) {
+		t.Fatal("Sessions() peer public key is not the key of the peer")
+	}
+	if info.CreatedAt.Before(before) || info.UpdatedAt.Before(info.CreatedAt) {
+		t.Fatalf("Sessions() created = %v updated = %v", info.CreatedAt, info.UpdatedAt)
+	}
+}
+
+func TestOnSessionExpired(t *testing.T) {
+	defer func(interval time.Duration) { sessionSweepInterval = interval }(sessionSweepInterval)
+	sessionSweepInterval = 10 * time.Millisecond
+
+	a := NewServer()
+	b := NewServer(WithSessionTTL(100 * time.Millisecond))
+	b.GET("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	})
+	aAddr, bAddr := startTestServer(t, a), startTestServer(t, b)
+
+	expired := make(chan SessionInfo, 1)
+	b.OnSessionExpired(func(info SessionInfo) { expired <- info })
+
+	// Closed by the peer
+	secureGET(t, a, bAddr)
+	if err := a.CloseSession(bAddr); err != nil {
+		t.Fatalf("CloseSession() error = %v", err)
+	}
+	select {
+	case info := <-expired:
+		if info.Peer != aAddr {
+			t.Fatalf("expired Peer = %q, want %q", info.Peer, aAddr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnSessionExpired was not called after CloseSession")
+	}
+
+	// Idle for longer than the TTL
+	secureGET(t, a, bAddr)
+	select {
+	case <-expired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnSessionExpired was not called after the TTL")
+	}
+	if len(b.Sessions()) != 0 {
+		t.Fatalf("Sessions() after expiry = %d, want 0", len(b.Sessions()))
+	}
+}
+
+func TestOnHandshakeFailed(t *testing.T) {
+	a, b := NewServer(), NewServer(WithKeyVerifier(KeyVerifierFunc(func([]byte, net.Addr) error {
+		return errors.New("unknown device")
+	})))
+	aAddr, bAddr := startTestServer(t, a), startTestServer(t, b)
+
+	failed := make(chan string, 1)
+	b.OnHandshakeFailed(func(peer string, err error) {
+		if errors.Is(err, ErrorUntrustedPeerKey) {
+			failed <- peer
+		}
+	})
+
+	message := NewCoAPMessage(CON, GET)
+	message.SetSchemeCOAPS()
+	message.SetURIPath("/secure")
+	message.Timeout = 200 * time.Millisecond
+	a.Send(message, bAddr)
+
+	select {
+	case peer := <-failed:
+		if peer != aAddr {
+			t.Fatalf("failed peer = %q, want %q", peer, aAddr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnHandshakeFailed was not called")
+	}
+}
@@ -0,0 +1,259 @@
+package coalago
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpProxyMaxBody is the largest HTTP response body a Server forwards to a peer.
+const httpProxyMaxBody = 8 << 20
+
+// WithHTTPProxy makes a Server a CoAP-to-HTTP proxy (RFC 7252, section 10.2): a
+// request whose Proxy-Uri has the http or https scheme is sent to that URL, and the
+// HTTP response is returned to the peer, large bodies through Block2 ARQ. Only hosts
+// in allow are contacted; an entry without a port matches any port of the host and
+// "*.example.com" matches its subdomains. Requests to other hosts get 4.03 Forbidden,
+// and redirects are only followed to allowed hosts. client performs the requests; nil
+// uses http.DefaultClient's transport. The response is piggybacked on the ACK, so an
+// HTTP request is given half of the ACK timeout of the server (WithAckTimeout) and
+// answered with 5.04 Gateway Timeout after that, whatever the timeout of client;
+// proxying slower APIs needs a longer ACK timeout on both peers. Global middleware of
+// the server applies to proxied requests as well.
+func WithHTTPProxy(client *http.Client, allow ...string) Opt {
+	return func(opts *coalaopts) {
+		opts.httpProxyClient = client
+		opts.httpProxyAllow = allow
+	}
+}
+
+// httpProxyAllowed reports whether host (host[:port] of a URL) may be contacted.
+func (opts *coalaopts) httpProxyAllowed(u *url.URL) bool {
+	for _, entry := range opts.httpProxyAllow {
+		host := u.Hostname()
+		if _, _, err := net.SplitHostPort(entry); err == nil {
+			host = u.Host
+		}
+		if suffix, ok := strings.CutPrefix(entry, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(host, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpProxyTimeout bounds a proxied HTTP request. The peer gets the response in the
+// ACK, so it has to be ready before the peer retransmits its request.
+func (opts *coalaopts) httpProxyTimeout() time.Duration {
+	return opts.ackTimeout / 2
+}
+
+// httpProxyClient returns the client for proxied requests, limited to allowed hosts.
+func (opts *coalaopts) httpProxyHTTPClient() *http.Client {
+	client := &http.Client{}
+	if opts.httpProxyClient != nil {
+		c := *opts.httpProxyClient
+		client = &c
+	}
+	check := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !opts.httpProxyAllowed(req.URL) {
+			return fmt.Errorf("redirect to %s is not allowed", req.URL.Host)
+		}
+		if check != nil {
+			return check(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return client
+}
+
+// httpProxyURL returns the http(s) URL a message asks the server to fetch.
+func httpProxyURL(message *CoAPMessage) (*url.URL, bool) {
+	raw := message.GetOptionProxyURIasString()
+	if !strings.HasPrefix(raw, "http://") && !strings.HasPrefix(raw, "https://") {
+		return nil, false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+// httpProxyResource returns the resource answering a request with an http(s) Proxy-Uri,
+// nil for other messages.
+func (s *Server) httpProxyResource(message *CoAPMessage) *CoAPResource {
+	if _, ok := httpProxyURL(message); !ok {
+		return nil
+	}
+	return &CoAPResource{Method: message.GetMethod(), Handler: s.proxyHTTP}
+}
+
+var httpMethods = map[CoapMethod]string{
+	CoapMethodGet:    http.MethodGet,
+	CoapMethodPost:   http.MethodPost,
+	CoapMethodPut:    http.MethodPut,
+	CoapMethodDelete: http.MethodDelete,
+}
+
+// proxyHTTP performs the HTTP request of a message with an http(s) Proxy-Uri.
+func (s *Server) proxyHTTP(message *CoAPMessage) *CoAPResourceHandlerResult {
+	cfg := s.config()
+	if len(cfg.httpProxyAllow) == 0 {
+		return NewResponse(NewStringPayload("HTTP proxying is not enabled"), CoapCodeProxyingNotSupported)
+	}
+	u, _ := httpProxyURL(message)
+	if !cfg.httpProxyAllowed(u) {
+		return NewResponse(NewStringPayload("host "+u.Host+" is not allowed"), CoapCodeForbidden)
+	}
+
+	var body io.Reader
+	if message.Payload != nil && message.Payload.Length() > 0 {
+		body = bytes.NewReader(message.Payload.Bytes())
+	}
+	ctx, cancel := context.WithTimeout(message.getContext(), cfg.httpProxyTimeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, httpMethods[message.GetMethod()], u.String(), body)
+	if err != nil {
+		return NewResponse(NewStringPayload(err.Error()), CoapCodeBadRequest)
+	}
+	if opt := message.GetOption(OptionContentFormat); opt != nil {
+		if t, ok := MediaType(opt.IntValue()).MIMEType(); ok {
+			req.Header.Set("Content-Type", t)
+		}
+	}
+	if opt := message.GetOption(OptionAccept); opt != nil {
+		if t, ok := MediaType(opt.IntValue()).MIMEType(); ok {
+			req.Header.Set("Accept", t)
+		}
+	}
+
+	resp, err := cfg.httpProxyHTTPClient().Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+			return NewResponse(NewStringPayload(err.Error()), CoapCodeGatewayTimeout)
+		}
+		return NewResponse(NewStringPayload(err.Error()), CoapCodeBadGateway)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, httpProxyMaxBody+1))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return NewResponse(NewStringPayload(err.Error()), CoapCodeGatewayTimeout)
+		}
+		return NewResponse(NewStringPayload(err.Error()), CoapCodeBadGateway)
+	}
+	if len(data) > httpProxyMaxBody {
+		return NewResponse(NewStringPayload("HTTP response too large"), CoapCodeBadGateway)
+	}
+
+	result := NewResponse(NewBytesPayload(data), coapCodeOf(resp.StatusCode, message.GetMethod()))
+	if mt, ok := MediaTypeOf(resp.Header.Get("Content-Type")); ok {
+		result.MediaType = mt
+	}
+	result.Options = httpResponseOptions(resp, u)
+	return result
+}
+
+// coapCodeOf maps an HTTP status to a CoAP response code (RFC 7252, section 10.2).
+func coapCodeOf(status int, method CoapMethod) CoapCode {
+	switch status {
+	case http.StatusCreated:
+		return CoapCodeCreated
+	case http.StatusNotModified:
+		return CoapCodeValid
+	case http.StatusBadRequest:
+		return CoapCodeBadRequest
+	case http.StatusUnauthorized:
+		return CoapCodeUnauthorized
+	case http.StatusForbidden:
+		return CoapCodeForbidden
+	case http.StatusNotFound:
+		return CoapCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CoapCodeMethodNotAllowed
+	case http.StatusNotAcceptable:
+		return CoapCodeNotAcceptable
+	case http.StatusConflict:
+		return CoapCodeConflict
+	case http.StatusPreconditionFailed:
+		return CoapCodePreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return CoapCodeRequestEntityTooLarge
+	case http.StatusUnsupportedMediaType:
+		return CoapCodeUnsupportedContentFormat
+	case http.StatusNotImplemented:
+		return CoapCodeNotImplemented
+	case http.StatusBadGateway:
+		return CoapCodeBadGateway
+	case http.StatusServiceUnavailable:
+		return CoapCodeServiceUnavailable
+	case http.StatusGatewayTimeout:
+		return CoapCodeGatewayTimeout
+	}
+	switch {
+	case status >= 200 && status < 300:
+		switch method {
+		case CoapMethodGet:
+			return CoapCodeContent
+		case CoapMethodDelete:
+			return CoapCodeDeleted
+		}
+		return CoapCodeChanged
+	case status >= 400 && status < 500:
+		return CoapCodeBadRequest
+	case status >= 500 && status < 600:
+		return CoapCodeInternalServerError
+	}
+	return CoapCodeBadGateway
+}
+
+// httpResponseOptions maps the ETag, Cache-Control max-age and Location headers of an
+// HTTP response to CoAP options. Locations on another host have no CoAP equivalent.
+func httpResponseOptions(resp *http.Response, requested *url.URL) []*CoAPMessageOption {
+	var options []*CoAPMessageOption
+	if etag := strings.TrimPrefix(resp.Header.Get("ETag"), "W/"); etag != "" {
+		if etag = strings.Trim(etag, `"`); len(etag) > 0 && len(etag) <= 8 {
+			options = append(options, NewOption(OptionEtag, etag))
+		}
+	}
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(directive), "max-age="); ok {
+			if age, err := strconv.Atoi(v); err == nil && age >= 0 {
+				options = append(options, NewOption(OptionMaxAge, age))
+			}
+		}
+	}
+	if location, err := resp.Location(); err == nil && location.Host == requested.Host {
+		for _, segment := range strings.Split(strings.Trim(location.Path, "/"), "/") {
+			if segment != "" {
+				options = append(options, NewOption(OptionLocationPath, segment))
+			}
+		}
+		if location.RawQuery != "" {
+			for _, q := range strings.Split(location.RawQuery, "&") {
+				options = append(options, NewOption(OptionLocationQuery, q))
+			}
+		}
+	}
+	return options
+}
@@ -0,0 +1,214 @@
+package coalago
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func proxyRequest(code CoapCode, uri string) *CoAPMessage {
+	message := NewCoAPMessage(CON, code)
+	message.AddOption(OptionProxyURI, uri)
+	return message
+}
+
+func TestHTTPProxy(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1500)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/small", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		io.WriteString(w, `{"ok":true}`)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(big)
+	})
+	mux.HandleFunc("/items", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Location", "/items/7?rev=1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+	mux.HandleFunc("/away", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://example.com/", http.StatusFound)
+	})
+	api := httptest.NewServer(mux)
+	defer api.Close()
+
+	s := NewServer(WithHTTPProxy(nil, "127.0.0.1"))
+	addr := startTestServer(t, s)
+	client := NewClient()
+
+	resp, err := client.Send(proxyRequest(GET, api.URL+"/small"), addr)
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if resp.Code != CoapCodeContent || string(resp.Body) != `{"ok":true}` {
+		t.Fatalf("response = %v %q", resp.Code, resp.Body)
+	}
+	want := map[OptionCode]interface{}{OptionContentFormat: int(MediaTypeApplicationJSON), OptionEtag: "v1", OptionMaxAge: 60}
+	for code, value := range want {
+		var opt *CoAPMessageOption
+		for _, o := range resp.Options {
+			if o.Code == code {
+				opt = o
+			}
+		}
+		if opt == nil {
+			t.Fatalf("response lacks option %v", code)
+		}
+		if v, ok := value.(int); ok && opt.IntValue() != v || !ok && opt.StringValue() != value {
+			t.Fatalf("option %v = %v, want %v", code, opt.Value, value)
+		}
+	}
+
+	// Large bodies come back through Block2, over coaps as well.
+	message := proxyRequest(GET, api.URL+"/big")
+	message.SetSchemeCOAPS()
+	resp, err = client.Send(message, addr)
+	if err != nil {
+		t.Fatalf("Send() of a large body error = %v", err)
+	}
+	if !bytes.Equal(resp.Body, big) {
+		t.Fatalf("body = %d bytes, want %d", len(resp.Body), len(big))
+	}
+
+	message = proxyRequest(POST, api.URL+"/items")
+	message.SetMediaType(MediaTypeApplicationJSON)
+	message.Payload = NewStringPayload(`{"name":"lamp"}`)
+	resp, err = client.Send(message, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeCreated || string(resp.Body) != `{"name":"lamp"}` {
+		t.Fatalf("POST response = %v %q", resp.Code, resp.Body)
+	}
+	var location []string
+	for _, o := range resp.Options {
+		if o.Code == OptionLocationPath || o.Code == OptionLocationQuery {
+			location = append(location, o.StringValue())
+		}
+	}
+	if len(location) != 3 || location[0] != "items" || location[1] != "7" || location[2] != "rev=1" {
+		t.Fatalf("location options = %q", location)
+	}
+
+	for _, tt := range []struct {
+		uri  string
+		want CoapCode
+	}{
+		{"http://example.com/", CoapCodeForbidden},
+		{api.URL + "/away", CoapCodeBadGateway},
+		{api.URL + "/missing", CoapCodeNotFound},
+	} {
+		resp, err := client.Send(proxyRequest(GET, tt.uri), addr)
+		if err != nil {
+			t.Fatalf("%s: Send() error = %v", tt.uri, err)
+		}
+		if resp.Code != tt.want {
+			t.Fatalf("%s: code = %v, want %v", tt.uri, resp.Code, tt.want)
+		}
+	}
+
+	disabled := startTestServer(t, NewServer())
+	resp, err = client.Send(proxyRequest(GET, api.URL+"/small"), disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeProxyingNotSupported {
+		t.Fatalf("code without WithHTTPProxy = %v, want %v", resp.Code, CoapCodeProxyingNotSupported)
+	}
+}
+
+func TestHTTPProxyTimeout(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer api.Close()
+
+	// The upstream request gets half of the ACK timeout, so the 5.04 is piggybacked
+	// on the ACK before the device retransmits.
+	s := NewServer(WithHTTPProxy(&http.Client{Timeout: time.Minute}, "127.0.0.1"), WithAckTimeout(200*time.Millisecond))
+	addr := startTestServer(t, s)
+
+	start := time.Now()
+	resp, err := NewClient(WithAckTimeout(200*time.Millisecond)).Send(proxyRequest(GET, api.URL+"/slow"), addr)
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if resp.Code != CoapCodeGatewayTimeout {
+		t.Fatalf("code = %v, want %v", resp.Code, CoapCodeGatewayTimeout)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Fatalf("response after %v, want it within the ACK timeout", elapsed)
+	}
+}
+
+func TestHTTPProxyAllowed(t *testing.T) {
+	opts := newCoalaopts(WithHTTPProxy(nil, "api.example.com", "*.example.org", "10.0.0.1:8080"))
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://api.example.com/v1", true},
+		{"http://api.example.com:8443/v1", true},
+		{"https://example.com/", false},
+		{"https://dev.example.org/", true},
+		{"https://example.org/", false},
+		{"https://evilexample.org/", false},
+		{"http://10.0.0.1:8080/", true},
+		{"http://10.0.0.1/", false},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := opts.httpProxyAllowed(u); got != tt.want {
+			t.Errorf("httpProxyAllowed(%s) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestCoapCodeOf(t *testing.T) {
+	tests := []struct {
+		status int
+		method CoapMethod
+		want   CoapCode
+	}{
+		{http.StatusOK, CoapMethodGet, CoapCodeContent},
+		{http.StatusOK, CoapMethodPut, CoapCodeChanged},
+		{http.StatusNoContent, CoapMethodDelete, CoapCodeDeleted},
+		{http.StatusNotModified, CoapMethodGet, CoapCodeValid},
+		{http.StatusTeapot, CoapMethodGet, CoapCodeBadRequest},
+		{http.StatusServiceUnavailable, CoapMethodGet, CoapCodeServiceUnavailable},
+		{599, CoapMethodGet, CoapCodeInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := coapCodeOf(tt.status, tt.method); got != tt.want {
+			t.Errorf("coapCodeOf(%d, %v) = %v, want %v", tt.status, tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestMediaTypeMIME(t *testing.T) {
+	for mt, mimeType := range mimeTypes {
+		got, ok := MediaTypeOf(mimeType)
+		if !ok || got != mt {
+			t.Errorf("MediaTypeOf(%q) = %d, %v, want %d", mimeType, got, ok, mt)
+		}
+	}
+	if _, ok := MediaTypeOf("text/plain; charset=iso-8859-1"); ok {
+		t.Error("MediaTypeOf() accepted text/plain in another charset")
+	}
+}
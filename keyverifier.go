@@ -0,0 +1,144 @@
+package coalago
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// KeyVerifier decides which peers may establish a coaps session. It is consulted with
+// the peer's public key during every handshake, on both sides: a Client verifies the
+// key of the server it connects to, a Server the key of each connecting client. A
+// non-nil error aborts the handshake.
+type KeyVerifier interface {
+	VerifyPeerKey(publicKey []byte, addr net.Addr) error
+}
+
+// KeyVerifierFunc adapts a function to the KeyVerifier interface.
+type KeyVerifierFunc func(publicKey []byte, addr net.Addr) error
+
+func (f KeyVerifierFunc) VerifyPeerKey(publicKey []byte, addr net.Addr) error {
+	return f(publicKey, addr)
+}
+
+// WithKeyVerifier makes the Client or Server accept coaps peers only when v accepts
+// their public key. A rejected client gets 4.03 Forbidden in reply to its ClientHello
+// and its request fails with ErrorPeerKeyRejected; a rejected server makes the request
+// fail with ErrorUntrustedPeerKey.
+func WithKeyVerifier(v KeyVerifier) Opt {
+	return func(opts *coalaopts) {
+		opts.keyVerifier = v
+	}
+}
+
+// keySet is a set of public keys indexed by their raw bytes.
+type keySet map[string]struct{}
+
+func newKeySet(keys ...[]byte) keySet {
+	set := make(keySet, len(keys))
+	for _, key := range keys {
+		set[string(key)] = struct{}{}
+	}
+	return set
+}
+
+func (set keySet) VerifyPeerKey(publicKey []byte, _ net.Addr) error {
+	if _, ok := set[string(publicKey)]; !ok {
+		return ErrorUntrustedPeerKey
+	}
+	return nil
+}
+
+// AllowKeys returns a KeyVerifier accepting exactly the given public keys (pinning).
+func AllowKeys(keys ...[]byte) KeyVerifier {
+	return newKeySet(keys...)
+}
+
+// TrustStore is a KeyVerifier backed by a file of trusted public keys: one hex-encoded
+// key per line, optionally followed by a comment. Empty lines and lines starting with
+// # are ignored:
+//
+//	# gateway
+//	9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 gw-01
+//
+// Edit the file and call Reload to change the trusted keys of a running process.
+// Established sessions are not affected until they handshake again.
+type TrustStore struct {
+	path string
+	mx   sync.RWMutex
+	keys keySet
+}
+
+// LoadTrustStore reads the trusted keys from path.
+func LoadTrustStore(path string) (*TrustStore, error) {
+	ts := &TrustStore{path: path}
+	if err := ts.Reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// Reload reads the file again. On error the previous keys are kept.
+func (ts *TrustStore) Reload() error {
+	f, err := os.Open(ts.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", ts.path, line, err)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ts.mx.Lock()
+	ts.keys = newKeySet(keys...)
+	ts.mx.Unlock()
+	return nil
+}
+
+func (ts *TrustStore) VerifyPeerKey(publicKey []byte, addr net.Addr) error {
+	ts.mx.RLock()
+	defer ts.mx.RUnlock()
+	return ts.keys.VerifyPeerKey(publicKey, addr)
+}
+
+// verifyPeerKey applies the configured KeyVerifier, if any.
+func (tr *transport) verifyPeerKey(publicKey []byte, addr net.Addr) error {
+	v := tr.config().keyVerifier
+	if v == nil {
+		return nil
+	}
+	if err := v.VerifyPeerKey(publicKey, addr); err != nil {
+		if errors.Is(err, ErrorUntrustedPeerKey) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrorUntrustedPeerKey, err)
+	}
+	return nil
+}
+
+// PeerIdentity returns the public key of the coaps peer that sent the message and
+// whether the KeyVerifier of the receiving Client or Server accepted it. Without a
+// KeyVerifier any peer can complete the handshake, so the key then only tells peers
+// apart. The key is nil for messages that did not arrive over coaps.
+func (m *CoAPMessage) PeerIdentity() (publicKey []byte, verified bool) {
+	return m.PeerPublicKey, m.peerVerified
+}
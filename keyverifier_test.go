@@ -0,0 +1,94 @@
+package coalago
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coalalib/coalago/session"
+)
+
+func publicKeyOf(t *testing.T, privateKey []byte) []byte {
+	t.Helper()
+	ses, err := session.NewSecuredSession(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ses.Curve.GetPublicKey()
+}
+
+func TestKeyVerifierHandshake(t *testing.T) {
+	serverKey, trustedKey := []byte("server-key"), []byte("trusted-device")
+
+	type identity struct {
+		key      []byte
+		verified bool
+	}
+	identities := make(chan identity, 1)
+	s := NewServer(WithPrivateKey(serverKey), WithKeyVerifier(AllowKeys(publicKeyOf(t, trustedKey))))
+	s.GET("/whoami", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		key, verified := message.PeerIdentity()
+		identities <- identity{key, verified}
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	})
+	uri := "coaps://" + startTestServer(t, s) + "/whoami"
+
+	trusted := NewClient(WithPrivateKey(trustedKey), WithKeyVerifier(AllowKeys(publicKeyOf(t, serverKey))))
+	if _, err := trusted.GET(uri); err != nil {
+		t.Fatalf("trusted GET() error = %v", err)
+	}
+	if got := <-identities; !got.verified || !bytes.Equal(got.key, publicKeyOf(t, trustedKey)) {
+		t.Fatalf("PeerIdentity() = %x, %v, want the trusted key, true", got.key, got.verified)
+	}
+
+	stranger := NewClient(WithPrivateKey([]byte("stranger")))
+	if _, err := stranger.GET(uri); !errors.Is(err, ErrorPeerKeyRejected) {
+		t.Fatalf("untrusted GET() error = %v, want %v", err, ErrorPeerKeyRejected)
+	}
+
+	pinned := NewClient(WithPrivateKey(trustedKey), WithKeyVerifier(AllowKeys(publicKeyOf(t, []byte("other-server")))))
+	if _, err := pinned.GET(uri); !errors.Is(err, ErrorUntrustedPeerKey) {
+		t.Fatalf("GET() to an unpinned server error = %v, want %v", err, ErrorUntrustedPeerKey)
+	}
+}
+
+func TestTrustStore(t *testing.T) {
+	first, second := publicKeyOf(t, []byte("first")), publicKeyOf(t, []byte("second"))
+	path := filepath.Join(t.TempDir(), "trusted_keys")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# devices\n\n" + hex.EncodeToString(first) + " sensor-01\n")
+	store, err := LoadTrustStore(path)
+	if err != nil {
+		t.Fatalf("LoadTrustStore() error = %v", err)
+	}
+	if err := store.VerifyPeerKey(first, nil); err != nil {
+		t.Fatalf("VerifyPeerKey(first) error = %v", err)
+	}
+	if err := store.VerifyPeerKey(second, nil); err != ErrorUntrustedPeerKey {
+		t.Fatalf("VerifyPeerKey(second) error = %v, want %v", err, ErrorUntrustedPeerKey)
+	}
+
+	write(hex.EncodeToString(second) + "\n")
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if store.VerifyPeerKey(first, nil) == nil || store.VerifyPeerKey(second, nil) != nil {
+		t.Fatal("Reload() did not replace the trusted keys")
+	}
+
+	write("not-hex\n")
+	if err := store.Reload(); err == nil {
+		t.Fatal("Reload() accepted an invalid key")
+	}
+	if err := store.VerifyPeerKey(second, nil); err != nil {
+		t.Fatalf("failed Reload() dropped the previous keys: %v", err)
+	}
+}
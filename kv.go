@@ -0,0 +1,165 @@
+package coalago
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+// KV is a key-value store shared by the nodes of a cluster, e.g. a client of Redis or
+// etcd. Values expire after ttl. NewMemoryKV returns an in-process implementation for
+// tests and single-node setups.
+type KV interface {
+	Get(key string) (value []byte, ok bool, err error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+type memoryKV struct {
+	cache *shardedCache
+}
+
+// NewMemoryKV returns a KV kept in the memory of the process.
+func NewMemoryKV() KV {
+	return &memoryKV{cache: newShardedCache(SESSIONS_POOL_EXPIRATION)}
+}
+
+func (m *memoryKV) Get(key string) ([]byte, bool, error) {
+	v, ok := m.cache.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	return v.([]byte), true, nil
+}
+
+func (m *memoryKV) Set(key string, value []byte, ttl time.Duration) error {
+	m.cache.setItem(key, cacheItem{value: append([]byte(nil), value...), expiresAt: time.Now().Add(ttl)})
+	return nil
+}
+
+func (m *memoryKV) Delete(key string) error {
+	m.cache.Delete(key)
+	return nil
+}
+
+// kvSessionPrefix namespaces the sessions in a shared KV.
+const kvSessionPrefix = "coala/session/"
+
+// kvMissTTL is how long a kvSessionStore remembers that the KV had no session for a
+// key, so packets from unknown peers do not each query the KV.
+const kvMissTTL = 10 * time.Second
+
+// kvSessionStore keeps the sessions in memory and writes them through to a KV, so
+// another node can continue a session after the peer moves to it.
+type kvSessionStore struct {
+	memorySessionStore
+	kv  KV
+	ttl time.Duration
+
+	written *shardedCache // key -> kvWritten, what the KV holds for the sessions of this node
+	misses  *shardedCache // KV keys the KV did not have
+}
+
+// kvWritten describes the copy of a session this node last wrote to the KV.
+type kvWritten struct {
+	key  []byte // AEAD.MyKey: a handshake or rekey gives new keys
+	sent uint64 // send sequence written; a node loading the copy resumes past it
+	at   time.Time
+}
+
+// NewKVSessionStore returns a SessionStore that shares sessions through kv. A node uses
+// its in-memory copy while it has one and loads the session from kv otherwise; a
+// loaded session resumes sending session.RestoredSequenceGap sequence numbers ahead
+// and is written back at once, so two nodes never seal with the same nonce. Only one
+// node should serve a peer at a time, see WithCluster. Sessions are shared by peer,
+// whatever address a node listens on. Sessions without sequence-number nonces stay
+// local. Range only covers the sessions in memory.
+//
+// Using a session only updates the copy in memory. The KV is written when a session is
+// established or rekeyed, when half of the sequence numbers reserved by the last write
+// are used, and when half of ttl passed since it, so the copy does not expire while
+// the session is in use.
+func NewKVSessionStore(kv KV, ttl time.Duration) SessionStore {
+	return &kvSessionStore{
+		memorySessionStore: memorySessionStore{cache: newShardedCache(ttl)},
+		kv:                 kv,
+		ttl:                ttl,
+		written:            newShardedCache(ttl),
+		misses:             newShardedCache(kvMissTTL),
+	}
+}
+
+func (s *kvSessionStore) Get(key string) (session.SecuredSession, bool) {
+	if ses, ok := s.memorySessionStore.Get(key); ok {
+		return ses, true
+	}
+
+	kvKey := kvSessionPrefix + sharedSessionKey(key)
+	if _, miss := s.misses.Get(kvKey); miss {
+		return session.SecuredSession{}, false
+	}
+	data, ok, err := s.kv.Get(kvKey)
+	if err != nil {
+		fmt.Println("session store error:", err)
+		return session.SecuredSession{}, false
+	}
+	if !ok {
+		s.misses.Set(kvKey, struct{}{})
+		return session.SecuredSession{}, false
+	}
+	var ses session.SecuredSession
+	if err := ses.UnmarshalBinary(data); err != nil {
+		fmt.Println("session store error:", err)
+		return session.SecuredSession{}, false
+	}
+	s.memorySessionStore.Set(key, ses)
+	// The loaded session sends from a new block of sequence numbers: reserve it
+	s.write(key, ses)
+	return ses, true
+}
+
+func (s *kvSessionStore) Set(key string, ses session.SecuredSession) {
+	s.memorySessionStore.Set(key, ses)
+	if ses.Features.Has(session.FeatureSequenceNonce) && s.stale(key, ses) {
+		s.write(key, ses)
+	}
+}
+
+// stale reports whether the KV copy of ses has to be written again.
+func (s *kvSessionStore) stale(key string, ses session.SecuredSession) bool {
+	v, ok := s.written.Get(key)
+	if !ok {
+		return true
+	}
+	w := v.(kvWritten)
+	return !bytes.Equal(w.key, ses.AEAD.MyKey) ||
+		ses.SentSequence() >= w.sent+session.RestoredSequenceGap/2 ||
+		time.Since(w.at) >= s.ttl/2
+}
+
+func (s *kvSessionStore) write(key string, ses session.SecuredSession) {
+	sent := ses.SentSequence()
+	data, err := ses.MarshalBinary()
+	if err == nil {
+		err = s.kv.Set(kvSessionPrefix+sharedSessionKey(key), data, s.ttl)
+	}
+	if err != nil {
+		fmt.Println("session store error:", err)
+		return
+	}
+	s.written.Set(key, kvWritten{key: ses.AEAD.MyKey, sent: sent, at: time.Now()})
+	s.misses.Delete(kvSessionPrefix + sharedSessionKey(key))
+}
+
+func (s *kvSessionStore) Delete(key string) {
+	s.memorySessionStore.Delete(key)
+	s.written.Delete(key)
+	kvKey := kvSessionPrefix + sharedSessionKey(key)
+	if err := s.kv.Delete(kvKey); err != nil {
+		fmt.Println("session store error:", err)
+		return
+	}
+	s.misses.Set(kvKey, struct{}{})
+}
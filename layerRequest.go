@@ -1,6 +1,8 @@
 package coalago
 
-func requestOnReceive(resource *CoAPResource, sr *transport, message *CoAPMessage) bool {
+// requestOnReceive answers a request with resource; handler is the resource handler
+// wrapped in its middleware chain.
+func requestOnReceive(resource *CoAPResource, handler CoAPResourceHandler, sr *transport, message *CoAPMessage) bool {
 	if message.Code > 4 {
 		return true
 	}
@@ -20,11 +22,15 @@ func requestOnReceive(resource *CoAPResource, sr *transport, message *CoAPMessag
 		return methodNotAllowed(sr, message)
 	}
 
-	if handlerResult := resource.Handler(message); handlerResult != nil {
+	if handlerResult := handler(message); handlerResult != nil {
+		var options []*CoAPMessageOption
+		if resource.observable != nil {
+			options = resource.observable.handleRequest(sr, message, handlerResult)
+		}
 		if message.Type == NON {
 			return false
 		}
-		return returnResultFromResource(sr, message, handlerResult)
+		return returnResultFromResource(sr, message, handlerResult, options...)
 	}
 
 	if message.Type == CON {
@@ -57,7 +63,7 @@ func methodNotAllowed(sr *transport, message *CoAPMessage) bool {
 	return false
 }
 
-func returnResultFromResource(sr *transport, message *CoAPMessage, handlerResult *CoAPResourceHandlerResult) bool {
+func returnResultFromResource(sr *transport, message *CoAPMessage, handlerResult *CoAPResourceHandlerResult, options ...*CoAPMessageOption) bool {
 	// @TODO: Validate Response code! handlerResult.Code
 
 	// Create ACK response with the same ID and given reponse Code
@@ -72,10 +78,9 @@ func returnResultFromResource(sr *transport, message *CoAPMessage, handlerResult
 		responseMessage.AddOption(OptionContentFormat, handlerResult.MediaType)
 	}
 
-	// validate Observe option (add Option in Response upon registration!)
-	if option := message.GetOption(OptionObserve); option != nil && option.IntValue() == 0 {
-		responseMessage.AddOption(OptionObserve, 1)
-	}
+	responseMessage.AddOptions(handlerResult.Options)
+	// Observe and Max-Age of an observable resource (see ObservableResource.handleRequest)
+	responseMessage.AddOptions(options)
 
 	// Validate message scheme
 	if message.GetScheme() == COAPS_SCHEME {
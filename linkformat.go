@@ -0,0 +1,198 @@
+package coalago
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidLinkFormat is returned by ParseLinkFormat for a malformed CoRE Link Format document.
+var ErrInvalidLinkFormat = errors.New("invalid link format")
+
+// Link is one entry of a CoRE Link Format document (RFC 6690), as served by /.well-known/core.
+type Link struct {
+	Target         string      // URI reference between < and >, e.g. "/sensors/temp"
+	ResourceTypes  []string    // rt
+	Interfaces     []string    // if
+	ContentFormats []MediaType // ct
+	Observable     bool        // obs
+	Size           int         // sz, 0 when absent
+	// Attributes holds the remaining link parameters (title, anchor, ...) by name.
+	// A parameter without a value maps to "".
+	Attributes map[string]string
+}
+
+// String encodes the link in CoRE Link Format.
+func (l Link) String() string {
+	var b strings.Builder
+	b.WriteString("<" + l.Target + ">")
+	if len(l.ResourceTypes) > 0 {
+		b.WriteString(`;rt="` + strings.Join(l.ResourceTypes, " ") + `"`)
+	}
+	if len(l.Interfaces) > 0 {
+		b.WriteString(`;if="` + strings.Join(l.Interfaces, " ") + `"`)
+	}
+	switch len(l.ContentFormats) {
+	case 0:
+	case 1:
+		b.WriteString(";ct=" + strconv.Itoa(int(l.ContentFormats[0])))
+	default:
+		formats := make([]string, len(l.ContentFormats))
+		for i, ct := range l.ContentFormats {
+			formats[i] = strconv.Itoa(int(ct))
+		}
+		b.WriteString(`;ct="` + strings.Join(formats, " ") + `"`)
+	}
+	if l.Size > 0 {
+		b.WriteString(";sz=" + strconv.Itoa(l.Size))
+	}
+	if l.Observable {
+		b.WriteString(";obs")
+	}
+	for _, name := range slices.Sorted(maps.Keys(l.Attributes)) {
+		if value := l.Attributes[name]; value == "" {
+			b.WriteString(";" + name)
+		} else {
+			b.WriteString(";" + name + `="` + value + `"`)
+		}
+	}
+	return b.String()
+}
+
+// params returns the link parameters as the lists used for query filtering.
+func (l Link) params() map[string][]string {
+	params := map[string][]string{
+		"href": {l.Target},
+		"rt":   l.ResourceTypes,
+		"if":   l.Interfaces,
+	}
+	for _, ct := range l.ContentFormats {
+		params["ct"] = append(params["ct"], strconv.Itoa(int(ct)))
+	}
+	if l.Size > 0 {
+		params["sz"] = []string{strconv.Itoa(l.Size)}
+	}
+	if l.Observable {
+		params["obs"] = []string{""}
+	}
+	for name, value := range l.Attributes {
+		params[name] = strings.Fields(value)
+		if value == "" {
+			params[name] = []string{""}
+		}
+	}
+	return params
+}
+
+// matchesQuery applies RFC 6690 §4.1 filtering: the link has the parameter name with a
+// value equal to value, or starting with it when value ends with "*". An empty value
+// only requires the parameter to be present.
+func (l Link) matchesQuery(name, value string) bool {
+	values, ok := l.params()[name]
+	if !ok || len(values) == 0 {
+		return false
+	}
+	if value == "" {
+		return true
+	}
+	prefix, wildcard := strings.CutSuffix(value, "*")
+	for _, v := range values {
+		if v == value || (wildcard && strings.HasPrefix(v, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatLinks encodes links as a CoRE Link Format document.
+func FormatLinks(links []Link) string {
+	encoded := make([]string, len(links))
+	for i, l := range links {
+		encoded[i] = l.String()
+	}
+	return strings.Join(encoded, ",")
+}
+
+// ParseLinkFormat decodes a CoRE Link Format document.
+func ParseLinkFormat(data []byte) ([]Link, error) {
+	var links []Link
+	for _, entry := range splitUnquoted(string(data), ',') {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		link, err := parseLink(entry)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func parseLink(entry string) (Link, error) {
+	parts := splitUnquoted(entry, ';')
+	target := strings.TrimSpace(parts[0])
+	if len(target) < 2 || target[0] != '<' || target[len(target)-1] != '>' {
+		return Link{}, ErrInvalidLinkFormat
+	}
+
+	link := Link{Target: target[1 : len(target)-1]}
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			return Link{}, ErrInvalidLinkFormat
+		}
+		value = strings.Trim(value, `"`)
+
+		switch name {
+		case "rt":
+			link.ResourceTypes = strings.Fields(value)
+		case "if":
+			link.Interfaces = strings.Fields(value)
+		case "ct":
+			for _, f := range strings.Fields(value) {
+				ct, err := strconv.Atoi(f)
+				if err != nil {
+					return Link{}, ErrInvalidLinkFormat
+				}
+				link.ContentFormats = append(link.ContentFormats, MediaType(ct))
+			}
+		case "sz":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return Link{}, ErrInvalidLinkFormat
+			}
+			link.Size = size
+		case "obs":
+			link.Observable = true
+		default:
+			if link.Attributes == nil {
+				link.Attributes = make(map[string]string)
+			}
+			link.Attributes[name] = value
+		}
+	}
+	return link, nil
+}
+
+// splitUnquoted splits s at sep, ignoring separators inside double quotes.
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,98 @@
+package coalago
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLinkFormat(t *testing.T) {
+	doc := `</sensors/temp>;rt="temperature-c sensor";if="core.s";ct=0;sz=12;obs,` +
+		`</fw>;ct="42 50";title="firmware, signed",</empty>`
+
+	links, err := ParseLinkFormat([]byte(doc))
+	if err != nil {
+		t.Fatalf("ParseLinkFormat() error = %v", err)
+	}
+	want := []Link{
+		{
+			Target:         "/sensors/temp",
+			ResourceTypes:  []string{"temperature-c", "sensor"},
+			Interfaces:     []string{"core.s"},
+			ContentFormats: []MediaType{MediaTypeTextPlain},
+			Size:           12,
+			Observable:     true,
+		},
+		{
+			Target:         "/fw",
+			ContentFormats: []MediaType{MediaTypeApplicationOctetStream, MediaTypeApplicationJSON},
+			Attributes:     map[string]string{"title": "firmware, signed"},
+		},
+		{Target: "/empty"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Fatalf("ParseLinkFormat() = %+v, want %+v", links, want)
+	}
+
+	reparsed, err := ParseLinkFormat([]byte(FormatLinks(links)))
+	if err != nil || !reflect.DeepEqual(reparsed, want) {
+		t.Fatalf("round trip = %+v, %v", reparsed, err)
+	}
+
+	if _, err := ParseLinkFormat([]byte(`/no-brackets;rt=x`)); err != ErrInvalidLinkFormat {
+		t.Fatalf("ParseLinkFormat(invalid) error = %v, want %v", err, ErrInvalidLinkFormat)
+	}
+}
+
+func TestServerWellKnownCoreAndDiscover(t *testing.T) {
+	handler := func(*CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("21"), CoapCodeContent)
+	}
+	s := NewServer()
+	s.OBSERVE("/sensors/temp", handler, WithResourceType("temperature-c"), WithInterface("sensor"), WithContentFormat(MediaTypeTextPlain))
+	s.PUT("/sensors/temp", handler, WithContentFormat(MediaTypeApplicationJSON))
+	s.GET("/sensors/light", handler, WithResourceType("light-lux"), WithSize(4))
+	s.GET("/devices/{id}", handler)
+	addr := startTestServer(t, s)
+	client := NewClient()
+
+	links, err := client.Discover("coap://" + addr)
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	want := []Link{
+		{
+			Target:         "/sensors/temp",
+			ResourceTypes:  []string{"temperature-c"},
+			Interfaces:     []string{"sensor"},
+			ContentFormats: []MediaType{MediaTypeTextPlain, MediaTypeApplicationJSON},
+			Observable:     true,
+		},
+		{Target: "/sensors/light", ResourceTypes: []string{"light-lux"}, Size: 4},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Fatalf("Discover() = %+v, want %+v", links, want)
+	}
+
+	filters := map[string][]string{
+		"?rt=temp*":          {"/sensors/temp"},
+		"?rt=light-lux":      {"/sensors/light"},
+		"?href=/sensors/l*":  {"/sensors/light"},
+		"?ct=50":             {"/sensors/temp"},
+		"?obs":               {"/sensors/temp"},
+		"?rt=humidity":       nil,
+		"?if=sensor&rt=temp": nil,
+	}
+	for query, targets := range filters {
+		links, err := client.Discover("coap://" + addr + query)
+		if err != nil {
+			t.Fatalf("Discover(%s) error = %v", query, err)
+		}
+		var got []string
+		for _, l := range links {
+			got = append(got, l.Target)
+		}
+		if !reflect.DeepEqual(got, targets) {
+			t.Errorf("Discover(%s) = %v, want %v", query, got, targets)
+		}
+	}
+}
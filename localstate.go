@@ -10,7 +10,7 @@ import (
 var StorageLocalStates = newShardedCache(3 * time.Minute)
 
 // ProcessedMessages — лёгкий дедупер уже обработанных запросов.
-// Ключ: sender+token, значение: struct{}{}. Запись живёт processedTTL и
+// Ключ: sender+token, значение: MessageID обработанного запроса (uint16). Запись живёт processedTTL и
 // нужна, чтобы отбросить запоздалые ретрансмиты без создания localState.
 var ProcessedMessages = newShardedCache(processedTTL)
 
@@ -19,7 +19,9 @@ const processedTTL = 10 * time.Second
 type LocalStateFn func(*CoAPMessage)
 
 type Resourcer interface {
-	getResourceForPathAndMethod(path string, method CoapMethod) *CoAPResource
+	matchResource(path string, method CoapMethod) (*CoAPResource, map[string]string)
+	httpProxyResource(message *CoAPMessage) *CoAPResource
+	resourceHandler(res *CoAPResource) CoAPResourceHandler
 }
 
 type localState struct {
@@ -51,6 +53,13 @@ func (ls *localState) processMessage(message *CoAPMessage) {
 		return
 	}
 
+	// Повтор блока legacy-сессии подтверждается заново, только если блок уже есть в
+	// этой передаче: иначе это повтор старой передачи, который нельзя запускать снова.
+	if message.duplicate && !ls.hasBlock1(message) {
+		MetricReplayedMessages.Inc()
+		return
+	}
+
 	MetricReceivedMessages.Inc()
 
 	// Локальный обработчик, запускаемый вне критической секции.
@@ -67,7 +76,7 @@ func (ls *localState) processMessage(message *CoAPMessage) {
 		id := msg.Sender.String() + msg.GetTokenString()
 		defer func() {
 			StorageLocalStates.Delete(id)
-			ProcessedMessages.Set(id, struct{}{})
+			ProcessedMessages.Set(id, msg.MessageID)
 		}()
 
 		if err != nil {
@@ -79,12 +88,30 @@ func (ls *localState) processMessage(message *CoAPMessage) {
 			return
 		}
 
-		requestOnReceive(ls.r.getResourceForPathAndMethod(msg.GetURIPath(), msg.GetMethod()), ls.tr, msg)
+		// Запрос с http(s) Proxy-Uri сервер выполняет сам, см. WithHTTPProxy
+		resource := ls.r.httpProxyResource(msg)
+		if resource == nil {
+			resource, msg.pathParams = ls.r.matchResource(msg.GetURIPath(), msg.GetMethod())
+		}
+		var handler CoAPResourceHandler
+		if resource != nil {
+			handler = ls.r.resourceHandler(resource)
+		}
+		requestOnReceive(resource, handler, ls.tr, msg)
 	}
 	// Обновляем состояние (фрагментация/сборка блоков)
 	ls.totalBlocks, ls.bufBlock1 = localStateMessageHandlerSelector(ls.tr, ls.totalBlocks, ls.bufBlock1, message, localRespHandler)
 }
 
+func (ls *localState) hasBlock1(message *CoAPMessage) bool {
+	block := message.GetBlock1()
+	if block == nil {
+		return false
+	}
+	_, ok := ls.bufBlock1[block.BlockNumber]
+	return ok
+}
+
 func MakeLocalStateFn(r Resourcer, tr *transport, _ func(*CoAPMessage, error)) LocalStateFn {
 	ls := newLocalState(r, tr)
 	return ls.processMessage
@@ -0,0 +1,50 @@
+package coalago
+
+import "mime"
+
+// mimeTypes maps CoAP Content-Formats to Internet media types (RFC 8075, section 6.1).
+var mimeTypes = map[MediaType]string{
+	MediaTypeTextPlain:              "text/plain; charset=utf-8",
+	MediaTypeTextXML:                "text/xml",
+	MediaTypeTextCsv:                "text/csv",
+	MediaTypeTextHTML:               "text/html",
+	MediaTypeImageGif:               "image/gif",
+	MediaTypeImageJpeg:              "image/jpeg",
+	MediaTypeImagePng:               "image/png",
+	MediaTypeImageTiff:              "image/tiff",
+	MediaTypeApplicationLinkFormat:  "application/link-format",
+	MediaTypeApplicationXML:         "application/xml",
+	MediaTypeApplicationOctetStream: "application/octet-stream",
+	MediaTypeApplicationExi:         "application/exi",
+	MediaTypeApplicationJSON:        "application/json",
+	MediaTypeApplicationCBOR:        "application/cbor",
+}
+
+// MIMEType returns the Internet media type of a Content-Format, and false for formats
+// without one.
+func (mt MediaType) MIMEType() (string, bool) {
+	t, ok := mimeTypes[mt]
+	return t, ok
+}
+
+// MediaTypeOf returns the Content-Format of an Internet media type, as found in a
+// Content-Type or Accept header. Parameters other than the charset of text/plain are
+// ignored.
+func MediaTypeOf(mimeType string) (MediaType, bool) {
+	t, params, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return 0, false
+	}
+	if t == "text/plain" {
+		if charset, ok := params["charset"]; ok && charset != "utf-8" && charset != "UTF-8" {
+			return 0, false
+		}
+		return MediaTypeTextPlain, true
+	}
+	for mt, m := range mimeTypes {
+		if known, _, _ := mime.ParseMediaType(m); known == t {
+			return mt, true
+		}
+	}
+	return 0, false
+}
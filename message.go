@@ -36,12 +36,18 @@ type CoAPMessage struct {
 
 	BreakConnectionOnPK func(actualPK []byte) bool // BreakConnectionOnPK is a function to break the connection based on the peer's public key.
 	PeerPublicKey       []byte                     // PeerPublicKey is the public key of the peer.
+	peerVerified        bool                       // PeerPublicKey was accepted by a KeyVerifier, see PeerIdentity
+	pskIdentity         string                     // identity of the PSK session the message arrived on
+	duplicate           bool                       // a legacy coaps message with a MessageID already received, see decrypt
 
 	ProxyAddr string          // ProxyAddr is the address of the proxy server.
 	Context   context.Context // Context carries deadlines, cancellation signals, and other request-scoped values.
 
 	// AddChecksumOnSend enables automatic OptionChecksum calculation in the send path.
 	AddChecksumOnSend bool
+
+	pathParams map[string]string // route parameters of the matched server resource, see PathParam
+	stream     *responseStream   // receives the response body as it arrives, see Client.Stream
 }
 
 func NewCoAPMessage(messageType CoapType, messageCode CoapCode) *CoAPMessage {
@@ -187,7 +193,8 @@ func deserialize(data []byte) (*CoAPMessage, error) {
 			switch optCode {
 			case OptionURIScheme, OptionProxyScheme, OptionURIPort, OptionContentFormat, OptionMaxAge, OptionAccept, OptionSize1,
 				OptionSize2, OptionBlock1, OptionBlock2, OptionHandshakeType, OptionObserve,
-				OptionSessionNotFound, OptionSessionExpired, OptionSelectiveRepeatWindowSize, OptionProxySecurityID:
+				OptionSessionNotFound, OptionSessionExpired, OptionSelectiveRepeatWindowSize, OptionProxySecurityID,
+				OptionHandshakeFeatures:
 				// OptionWindowtOffset
 
 				intVal, err := decodeInt(optionValue)
@@ -196,8 +203,10 @@ func deserialize(data []byte) (*CoAPMessage, error) {
 				}
 				msg.Options = append(msg.Options, NewOption(optCode, intVal))
 
-			case OptionURIHost, OptionEtag, OptionLocationPath, OptionURIPath, OptionURIQuery,
-				OptionLocationQuery, OptionProxyURI, OptionСoapsUri, OptionChecksum:
+			case OptionIfMatch, OptionURIHost, OptionEtag, OptionLocationPath, OptionURIPath, OptionURIQuery,
+				OptionLocationQuery, OptionProxyURI, OptionСoapsUri, OptionChecksum,
+				OptionSequenceNumber, OptionPSKIdentity, OptionHandshakeNonce,
+				OptionHandshakeEphemeral:
 				msg.Options = append(msg.Options, NewOption(optCode, string(optionValue)))
 			default:
 				if lastOptionID&0x01 == 1 {
@@ -362,12 +371,21 @@ func (m *CoAPMessage) Clone(includePayload bool) *CoAPMessage {
 	cloneMessage.ProxyAddr = m.ProxyAddr
 	cloneMessage.BreakConnectionOnPK = m.BreakConnectionOnPK
 	cloneMessage.AddChecksumOnSend = m.AddChecksumOnSend
+	cloneMessage.Context = m.Context
 	if includePayload {
 		cloneMessage.Payload = m.Payload
 	}
 	return cloneMessage
 }
 
+// getContext returns the message Context, or context.Background() when none is set.
+func (m *CoAPMessage) getContext() context.Context {
+	if m.Context == nil {
+		return context.Background()
+	}
+	return m.Context
+}
+
 func (m *CoAPMessage) GetScheme() int {
 	option := m.GetOption(OptionURIScheme)
 	if option != nil && option.Value != nil && option.IntValue() == COAPS_SCHEME {
@@ -739,6 +757,6 @@ func (p *JSONPayload) String() string {
 	return string(p.Bytes())
 }
 
-func isBigPayload(msg *CoAPMessage) bool {
-	return msg.Payload != nil && msg.Payload.Length() > MAX_PAYLOAD_SIZE
+func isBigPayload(msg *CoAPMessage, blockSize int) bool {
+	return msg.Payload != nil && msg.Payload.Length() > blockSize
 }
@@ -14,6 +14,7 @@ var (
 	MetricSuccessfulHandhshakes,
 	MetricProxySessions,
 	MetricProxySessionsRate,
+	MetricReplayedMessages,
 	MetricMaxMTU counterImpl
 )
 
@@ -0,0 +1,45 @@
+package coalago
+
+import "fmt"
+
+// Middleware wraps a resource handler. It can inspect or change the request, answer it
+// itself by not calling next (authentication, rate limiting) or post-process the result
+// (logging, metrics).
+type Middleware func(next CoAPResourceHandler) CoAPResourceHandler
+
+// ResourceOption configures a resource registered with Server.GET, POST, PUT, DELETE or OBSERVE.
+type ResourceOption func(*CoAPResource)
+
+// WithMiddleware adds middleware that runs only for this resource, inside the middleware
+// installed with Server.Use. The first one given is the outermost.
+func WithMiddleware(mw ...Middleware) ResourceOption {
+	return func(res *CoAPResource) {
+		res.middleware = append(res.middleware, mw...)
+	}
+}
+
+// Recover returns middleware that turns a panic in the handler into a 5.00 Internal
+// Server Error response. A Server wraps every resource in it outside all other
+// middleware; install it with Use to recover inside middleware that should see the
+// 5.00, such as request logging.
+func Recover() Middleware {
+	return func(next CoAPResourceHandler) CoAPResourceHandler {
+		return func(message *CoAPMessage) (result *CoAPResourceHandlerResult) {
+			defer func() {
+				if r := recover(); r != nil {
+					fmt.Printf("panic in handler: %v\n", r)
+					result = NewResponse(NewStringPayload("Internal server error"), CoapCodeInternalServerError)
+				}
+			}()
+			return next(message)
+		}
+	}
+}
+
+// chain wraps handler so that mw[0] runs first.
+func chain(handler CoAPResourceHandler, mw []Middleware) CoAPResourceHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+	return handler
+}
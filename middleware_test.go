@@ -0,0 +1,87 @@
+package coalago
+
+import (
+	"strings"
+	"testing"
+)
+
+func tagMiddleware(tag string, trace *[]string) Middleware {
+	return func(next CoAPResourceHandler) CoAPResourceHandler {
+		return func(message *CoAPMessage) *CoAPResourceHandlerResult {
+			*trace = append(*trace, tag)
+			return next(message)
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var trace []string
+	s := NewServer()
+	s.Use(tagMiddleware("global1", &trace), tagMiddleware("global2", &trace))
+	s.GET("/ordered", func(*CoAPMessage) *CoAPResourceHandlerResult {
+		trace = append(trace, "handler")
+		return NewResponse(NewEmptyPayload(), CoapCodeContent)
+	}, WithMiddleware(tagMiddleware("route", &trace)))
+
+	res, _ := s.matchResource("ordered", CoapMethodGet)
+	s.resourceHandler(res)(NewCoAPMessage(CON, GET))
+
+	if got := strings.Join(trace, ","); got != "global1,global2,route,handler" {
+		t.Fatalf("call order = %s", got)
+	}
+}
+
+func TestMiddlewareShortCircuitAndRecover(t *testing.T) {
+	s := NewServer()
+	s.Use(Recover())
+	requireKey := func(next CoAPResourceHandler) CoAPResourceHandler {
+		return func(message *CoAPMessage) *CoAPResourceHandlerResult {
+			if message.GetURIQuery("key") != "secret" {
+				return NewResponse(NewStringPayload("no key"), CoapCodeUnauthorized)
+			}
+			return next(message)
+		}
+	}
+	s.GET("/private", func(*CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	}, WithMiddleware(requireKey))
+	s.GET("/panic", func(*CoAPMessage) *CoAPResourceHandlerResult {
+		panic("boom")
+	})
+	addr := startTestServer(t, s)
+	client := NewClient()
+
+	tests := []struct {
+		uri  string
+		code CoapCode
+	}{
+		{uri: "/private", code: CoapCodeUnauthorized},
+		{uri: "/private?key=secret", code: CoapCodeContent},
+		{uri: "/panic", code: CoapCodeInternalServerError},
+	}
+	for _, tt := range tests {
+		resp, err := client.GET("coap://" + addr + tt.uri)
+		if err != nil {
+			t.Fatalf("GET(%s) error = %v", tt.uri, err)
+		}
+		if resp.Code != tt.code {
+			t.Fatalf("GET(%s) code = %v, want %v", tt.uri, resp.Code, tt.code)
+		}
+	}
+}
+
+func TestHandlerPanicWithoutRecover(t *testing.T) {
+	s := NewServer()
+	s.GET("/panic", func(*CoAPMessage) *CoAPResourceHandlerResult {
+		panic("boom")
+	})
+	addr := startTestServer(t, s)
+
+	resp, err := NewClient().GET("coap://" + addr + "/panic")
+	if err != nil {
+		t.Fatalf("GET() error = %v", err)
+	}
+	if resp.Code != CoapCodeInternalServerError {
+		t.Fatalf("GET() code = %v, want %v", resp.Code, CoapCodeInternalServerError)
+	}
+}
@@ -0,0 +1,328 @@
+package coalago
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// observeSequenceMask keeps Observe option values within the 24 bits allowed by RFC 7641.
+const observeSequenceMask = 0xFFFFFF
+
+// ObservableResource is a GET resource whose representation is pushed to every
+// registered observer (RFC 7641) each time Notify is called. It is created by
+// Server.OBSERVE.
+type ObservableResource struct {
+	resource *CoAPResource
+	registry *observeRegistry
+
+	mx         sync.Mutex
+	observers  map[string]*observer // sender + token -> observer
+	seq        uint32
+	notifyType CoapType
+	maxAge     time.Duration
+}
+
+type observer struct {
+	key     string
+	addr    net.Addr
+	tr      *transport   // transport the registration arrived on: the UDP listener or a TCP connection
+	request *CoAPMessage // registration request, passed to the handler again for every notification
+	lastMID uint16       // MessageID of the last notification, an RST for it cancels the observation
+}
+
+// observeRegistry holds the observable resources of one Server and routes ACK/RST
+// replies to the notifications waiting for them.
+type observeRegistry struct {
+	handler func(*CoAPResource) CoAPResourceHandler // resource handler wrapped in the server middleware
+
+	mx        sync.Mutex
+	resources map[string]*ObservableResource // path -> resource
+	pending   map[string]chan *CoAPMessage   // peer address + MessageID -> waiting CON notification
+}
+
+func newObserveRegistry(handler func(*CoAPResource) CoAPResourceHandler) *observeRegistry {
+	return &observeRegistry{
+		handler:   handler,
+		resources: make(map[string]*ObservableResource),
+		pending:   make(map[string]chan *CoAPMessage),
+	}
+}
+
+func newObservableResource(registry *observeRegistry, resource *CoAPResource) *ObservableResource {
+	return &ObservableResource{
+		resource:   resource,
+		registry:   registry,
+		observers:  make(map[string]*observer),
+		notifyType: CON,
+	}
+}
+
+// SetConfirmable selects CON (the default) or NON notifications. Observers that do
+// not acknowledge a CON notification are removed.
+func (r *ObservableResource) SetConfirmable(confirmable bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if confirmable {
+		r.notifyType = CON
+	} else {
+		r.notifyType = NON
+	}
+}
+
+// SetMaxAge sets the Max-Age option of registration responses and notifications,
+// telling observers how long a representation stays fresh. Zero omits the option.
+func (r *ObservableResource) SetMaxAge(maxAge time.Duration) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.maxAge = maxAge
+}
+
+// ObserversCount returns the number of registered observers.
+func (r *ObservableResource) ObserversCount() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return len(r.observers)
+}
+
+// Notify runs the resource handler for every observer and sends the result as a
+// notification with the next sequence number. Delivery happens in the background.
+func (r *ObservableResource) Notify() {
+	r.notifyObservers("")
+}
+
+// notifyObservers notifies the observers of a templated resource that registered
+// with the concrete path, or every observer when path is empty.
+func (r *ObservableResource) notifyObservers(path string) {
+	path = strings.Trim(path, "/ ")
+
+	r.mx.Lock()
+	r.seq = (r.seq + 1) & observeSequenceMask
+	seq := r.seq
+	notifyType := r.notifyType
+	maxAge := r.maxAge
+	observers := make([]*observer, 0, len(r.observers))
+	for _, o := range r.observers {
+		if path == "" || strings.Trim(o.request.GetURIPath(), "/ ") == path {
+			observers = append(observers, o)
+		}
+	}
+	r.mx.Unlock()
+
+	for _, o := range observers {
+		go r.notifyObserver(o, seq, notifyType, maxAge)
+	}
+}
+
+// handleRequest applies the Observe option of a GET to the observer list and returns
+// the options to add to the response.
+func (r *ObservableResource) handleRequest(tr *transport, message *CoAPMessage, result *CoAPResourceHandlerResult) []*CoAPMessageOption {
+	key := message.Sender.String() + message.GetTokenString()
+
+	option := message.GetOption(OptionObserve)
+	if option == nil || option.IntValue() != 0 || result.Code.Group() != "2.xx" {
+		// A plain GET, a deregistration or an error response all end the observation.
+		r.remove(key)
+		return nil
+	}
+
+	r.mx.Lock()
+	r.observers[key] = &observer{
+		key:     key,
+		addr:    message.Sender,
+		tr:      tr,
+		request: message,
+	}
+	options := r.responseOptions(r.seq, r.maxAge)
+	r.mx.Unlock()
+
+	return options
+}
+
+func (r *ObservableResource) responseOptions(seq uint32, maxAge time.Duration) []*CoAPMessageOption {
+	options := []*CoAPMessageOption{NewOption(OptionObserve, seq)}
+	if maxAge > 0 {
+		options = append(options, NewOption(OptionMaxAge, uint32(maxAge/time.Second)))
+	}
+	return options
+}
+
+func (r *ObservableResource) remove(key string) {
+	r.mx.Lock()
+	delete(r.observers, key)
+	r.mx.Unlock()
+}
+
+func (r *ObservableResource) notifyObserver(o *observer, seq uint32, notifyType CoapType, maxAge time.Duration) {
+	// A panicking handler returns 5.00 (see Server.resourceHandler), which ends the
+	// observation like any error notification.
+	result := r.registry.handler(r.resource)(o.request)
+	if result == nil {
+		return
+	}
+
+	message := NewCoAPMessage(notifyType, result.Code)
+	message.Token = o.request.Token
+	message.Payload = result.Payload
+	message.Recipient = o.request.Sender
+	if result.MediaType >= 0 {
+		message.AddOption(OptionContentFormat, result.MediaType)
+	}
+	message.AddOptions(r.responseOptions(seq, maxAge))
+	if o.request.GetScheme() == COAPS_SCHEME {
+		message.SetSchemeCOAPS()
+	}
+	message.CloneOptions(o.request, OptionProxySecurityID)
+
+	r.mx.Lock()
+	o.lastMID = message.MessageID
+	r.mx.Unlock()
+
+	// RFC 7641 §3.2: an error notification ends the observation.
+	if result.Code.Group() != "2.xx" {
+		defer r.remove(o.key)
+	}
+
+	if notifyType == NON {
+		if err := o.tr.sendToSocketByAddress(message, o.addr); err != nil {
+			r.remove(o.key)
+		}
+		return
+	}
+
+	if !r.registry.sendConfirmable(o.tr, message, o.addr) {
+		r.remove(o.key)
+	}
+}
+
+// sendConfirmable sends a CON notification and retransmits it until it is acknowledged.
+// It returns false when the observer rejected the notification with RST or never answered.
+func (reg *observeRegistry) sendConfirmable(tr *transport, message *CoAPMessage, addr net.Addr) bool {
+	key := addr.String() + message.GetMessageIDString()
+	ch := make(chan *CoAPMessage, 1)
+
+	reg.mx.Lock()
+	reg.pending[key] = ch
+	reg.mx.Unlock()
+
+	defer func() {
+		reg.mx.Lock()
+		delete(reg.pending, key)
+		reg.mx.Unlock()
+	}()
+
+	cfg := tr.config()
+	backoff := cfg.backoff(cfg.ackTimeout)
+	for attempt := 0; attempt < cfg.maxAttempts(); attempt++ {
+		if attempt > 0 {
+			MetricRetransmitMessages.Inc()
+		}
+		if err := tr.sendToSocketByAddress(message, addr); err != nil {
+			return false
+		}
+
+		select {
+		case reply := <-ch:
+			return reply.Type == ACK
+		case <-cfg.clock.After(backoff.Next()):
+		}
+	}
+
+	MetricExpiredMessages.Inc()
+	return false
+}
+
+// handleReply consumes ACK and RST messages that answer a notification. It returns
+// false for any other message so the regular processing continues.
+func (reg *observeRegistry) handleReply(message *CoAPMessage, tr *transport) bool {
+	if reg == nil || (message.Type != ACK && message.Type != RST) {
+		return false
+	}
+
+	addr := message.Sender.String()
+	reg.mx.Lock()
+	ch, waiting := reg.pending[addr+message.GetMessageIDString()]
+	var rejected *ObservableResource
+	var rejectedKey string
+	if !waiting && message.Type == RST {
+		rejected, rejectedKey = reg.findByLastMID(addr, message.MessageID)
+	}
+	reg.mx.Unlock()
+
+	if !waiting && rejected == nil {
+		return false
+	}
+
+	if ok, _ := localStateSecurityInputLayer(tr, message, ""); !ok {
+		return true
+	}
+
+	if waiting {
+		select {
+		case ch <- message:
+		default:
+		}
+		return true
+	}
+
+	rejected.remove(rejectedKey)
+	return true
+}
+
+// findByLastMID looks up the observer whose last (NON) notification carried mid.
+// Must be called with reg.mx held.
+func (reg *observeRegistry) findByLastMID(addr string, mid uint16) (*ObservableResource, string) {
+	for _, res := range reg.resources {
+		res.mx.Lock()
+		for key, o := range res.observers {
+			if o.addr.String() == addr && o.lastMID == mid {
+				res.mx.Unlock()
+				return res, key
+			}
+		}
+		res.mx.Unlock()
+	}
+	return nil, ""
+}
+
+// dropTransport removes every observer registered through tr, used when a TCP connection closes.
+func (reg *observeRegistry) dropTransport(tr *transport) {
+	if reg == nil {
+		return
+	}
+	reg.mx.Lock()
+	defer reg.mx.Unlock()
+	for _, res := range reg.resources {
+		res.mx.Lock()
+		for key, o := range res.observers {
+			if o.tr == tr {
+				delete(res.observers, key)
+			}
+		}
+		res.mx.Unlock()
+	}
+}
+
+func (reg *observeRegistry) add(res *ObservableResource) {
+	reg.mx.Lock()
+	reg.resources[res.resource.Path] = res
+	reg.mx.Unlock()
+}
+
+func (reg *observeRegistry) get(path string) (*ObservableResource, bool) {
+	if reg == nil {
+		return nil, false
+	}
+	reg.mx.Lock()
+	defer reg.mx.Unlock()
+	res, ok := reg.resources[strings.Trim(path, "/ ")]
+	return res, ok
+}
+
+// isObserveRequest reports whether message is a GET carrying the Observe option.
+// Such requests with a new MessageID bypass retransmission deduplication: an observer
+// deregisters and re-registers with the token of its original registration.
+func isObserveRequest(message *CoAPMessage) bool {
+	return message.Code == GET && message.GetOption(OptionObserve) != nil
+}
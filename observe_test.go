@@ -0,0 +1,226 @@
+package coalago
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestServer runs s.Listen on a loopback port and returns the bound address.
+func startTestServer(t *testing.T, s *Server) string {
+	t.Helper()
+	return startTestServerAt(t, s, "127.0.0.1:0")
+}
+
+func startTestServerAt(t *testing.T, s *Server, addr string) string {
+	t.Helper()
+	go s.Listen(addr)
+	t.Cleanup(func() { s.Close() })
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.srMu.Lock()
+		sr := s.sr
+		s.srMu.Unlock()
+		if sr != nil {
+			return sr.conn.LocalAddr().String()
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start listening in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// rawPeer is a bare UDP socket used to drive the server with hand-made messages.
+type rawPeer struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func newRawPeer(t *testing.T, addr string) *rawPeer {
+	t.Helper()
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawPeer{t: t, conn: conn}
+}
+
+func (p *rawPeer) send(message *CoAPMessage) {
+	p.t.Helper()
+	buf, err := Serialize(message)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if _, err := p.conn.Write(buf); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *rawPeer) receive(timeout time.Duration) (*CoAPMessage, error) {
+	buf := make([]byte, MTU+1)
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := p.conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return Deserialize(buf[:n])
+}
+
+func observeRequest(token string, observe int) *CoAPMessage {
+	message := NewCoAPMessage(CON, GET)
+	message.SetToken(token)
+	message.SetURIPath("/temperature")
+	message.AddOption(OptionObserve, observe)
+	return message
+}
+
+func TestServerObserveRegisterNotifyAndCancel(t *testing.T) {
+	var value atomic.Int32
+	s := NewServer()
+	res := s.OBSERVE("/temperature", func(*CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload(string(rune('0'+value.Load()))), CoapCodeContent)
+	})
+	res.SetMaxAge(30 * time.Second)
+	peer := newRawPeer(t, startTestServer(t, s))
+
+	peer.send(observeRequest("obs1", 0))
+	resp, err := peer.receive(time.Second)
+	if err != nil {
+		t.Fatalf("registration response: %v", err)
+	}
+	if resp.Type != ACK || resp.Code != CoapCodeContent || resp.GetOption(OptionObserve) == nil {
+		t.Fatalf("registration response = %s, want 2.05 ACK with Observe", resp.ToReadableString())
+	}
+	if maxAge := resp.GetOption(OptionMaxAge); maxAge == nil || maxAge.IntValue() != 30 {
+		t.Fatalf("Max-Age = %v, want 30", maxAge)
+	}
+	if res.ObserversCount() != 1 {
+		t.Fatalf("ObserversCount() = %d, want 1", res.ObserversCount())
+	}
+
+	value.Store(7)
+	if err := s.Notify("temperature"); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	notification, err := peer.receive(time.Second)
+	if err != nil {
+		t.Fatalf("notification: %v", err)
+	}
+	if notification.Type != CON || notification.GetTokenString() != "obs1" || notification.Payload.String() != "7" {
+		t.Fatalf("notification = %s, want CON with token obs1 and payload 7", notification.ToReadableString())
+	}
+	if seq := notification.GetOption(OptionObserve).IntValue(); seq != 1 {
+		t.Fatalf("notification Observe = %d, want 1", seq)
+	}
+	peer.send(NewCoAPMessageId(ACK, CoapCodeEmpty, notification.MessageID))
+
+	peer.send(observeRequest("obs1", 1))
+	if _, err := peer.receive(time.Second); err != nil {
+		t.Fatalf("deregistration response: %v", err)
+	}
+	if res.ObserversCount() != 0 {
+		t.Fatalf("ObserversCount() = %d after deregistration, want 0", res.ObserversCount())
+	}
+}
+
+func TestServerObserveRetransmissionRunsHandlerOnce(t *testing.T) {
+	var calls atomic.Int32
+	s := NewServer()
+	s.OBSERVE("/temperature", func(*CoAPMessage) *CoAPResourceHandlerResult {
+		calls.Add(1)
+		return NewResponse(NewStringPayload("7"), CoapCodeContent)
+	})
+	peer := newRawPeer(t, startTestServer(t, s))
+
+	register := observeRequest("obs1", 0)
+	peer.send(register)
+	if _, err := peer.receive(time.Second); err != nil {
+		t.Fatalf("registration response: %v", err)
+	}
+	// The ACK got lost: the client retransmits with the same MessageID.
+	peer.send(register)
+	peer.receive(200 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler calls = %d, want 1", n)
+	}
+}
+
+func TestServerObserveRSTRemovesObserver(t *testing.T) {
+	s := NewServer()
+	res := s.OBSERVE("/temperature", func(*CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("20"), CoapCodeContent)
+	})
+	peer := newRawPeer(t, startTestServer(t, s))
+
+	peer.send(observeRequest("obs2", 0))
+	if _, err := peer.receive(time.Second); err != nil {
+		t.Fatalf("registration response: %v", err)
+	}
+
+	res.Notify()
+	notification, err := peer.receive(time.Second)
+	if err != nil {
+		t.Fatalf("notification: %v", err)
+	}
+	peer.send(NewCoAPMessageId(RST, CoapCodeEmpty, notification.MessageID))
+
+	deadline := time.Now().Add(time.Second)
+	for res.ObserversCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("observer was not removed after RST")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerNotifyUnknownPath(t *testing.T) {
+	s := NewServer()
+	s.GET("/plain", func(*CoAPMessage) *CoAPResourceHandlerResult { return nil })
+
+	if err := s.Notify("/plain"); !errors.Is(err, ErrNoMatchingRoute) {
+		t.Fatalf("Notify() error = %v, want %v", err, ErrNoMatchingRoute)
+	}
+}
+
+func TestServerNotifyConcretePathOfTemplate(t *testing.T) {
+	s := NewServer()
+	s.OBSERVE("/devices/{id}", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload(message.PathParam("id")), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+
+	peers := map[string]*rawPeer{}
+	for _, id := range []string{"1", "2"} {
+		peer := newRawPeer(t, addr)
+		request := observeRequest("dev"+id, 0)
+		request.RemoveOptions(OptionURIPath)
+		request.SetURIPath("/devices/" + id)
+		peer.send(request)
+		if _, err := peer.receive(time.Second); err != nil {
+			t.Fatalf("registration of device %s: %v", id, err)
+		}
+		peers[id] = peer
+	}
+
+	if err := s.Notify("/devices/2"); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	notification, err := peers["2"].receive(time.Second)
+	if err != nil || notification.Payload.String() != "2" {
+		t.Fatalf("device 2 notification = %v, %v", notification, err)
+	}
+	peers["2"].send(NewCoAPMessageId(ACK, CoapCodeEmpty, notification.MessageID))
+
+	if _, err := peers["1"].receive(100 * time.Millisecond); err == nil {
+		t.Fatal("device 1 was notified about device 2")
+	}
+}
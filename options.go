@@ -162,8 +162,9 @@ func (opt *CoAPMessageOption) IsValidOption() bool {
 		OptionEtag, OptionIfMatch, OptionObserve, OptionURIPort, OptionLocationPath,
 		OptionURIPath, OptionContentFormat, OptionMaxAge, OptionURIQuery, OptionAccept,
 		OptionLocationQuery, OptionBlock2, OptionBlock1, OptionProxyURI, OptionProxySecurityID, OptionProxyScheme, OptionSize1,
-		OptionHandshakeType, OptionSessionNotFound, OptionSessionExpired, OptionSelectiveRepeatWindowSize,
-		OptionChecksum:
+		OptionSize2, OptionHandshakeType, OptionSessionNotFound, OptionSessionExpired, OptionSelectiveRepeatWindowSize,
+		OptionChecksum, OptionSequenceNumber, OptionHandshakeFeatures, OptionPSKIdentity,
+		OptionHandshakeNonce, OptionHandshakeEphemeral:
 		// OptionWindowtOffset
 		return true
 	default:
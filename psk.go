@@ -0,0 +1,157 @@
+package coalago
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+// PSKLookup returns the pre-shared key of identity, or false when the identity is unknown.
+type PSKLookup func(identity string) (key []byte, ok bool)
+
+// WithPSK makes coaps sessions initiated by the Client (or Server) use the pre-shared
+// key handshake with the given identity instead of X25519. A Server given WithPSK also
+// accepts PSK handshakes for that identity.
+func WithPSK(identity string, key []byte) Opt {
+	return func(opts *coalaopts) {
+		opts.pskIdentity = identity
+		opts.psk = key
+	}
+}
+
+// WithPSKLookup makes a Server accept PSK handshakes from every identity lookup knows.
+// X25519 handshakes are accepted as before.
+func WithPSKLookup(lookup PSKLookup) Opt {
+	return func(opts *coalaopts) {
+		opts.pskLookup = lookup
+	}
+}
+
+func (opts *coalaopts) lookupPSK(identity string) ([]byte, bool) {
+	if opts.pskLookup != nil {
+		if key, ok := opts.pskLookup(identity); ok && len(key) > 0 {
+			return key, true
+		}
+	}
+	if opts.pskIdentity != "" && identity == opts.pskIdentity {
+		return opts.psk, true
+	}
+	return nil, false
+}
+
+// PSKIdentity returns the pre-shared key identity of the coaps session the message
+// arrived on, or "" when the session was established with X25519.
+func (m *CoAPMessage) PSKIdentity() string {
+	return m.pskIdentity
+}
+
+// pskHandshake runs the initiator side of the PSK handshake:
+//
+//	PSKClientHello: identity option, payload = client nonce
+//	PSKPeerHello:   payload = server nonce || key confirmation tag
+//
+// Both sides derive the session keys from the PSK with the two nonces as HKDF salt.
+// send transmits the hello and returns the reply.
+func pskHandshake(cfg *coalaopts, origMessage *CoAPMessage, send func(*CoAPMessage) (*CoAPMessage, error)) (session.SecuredSession, error) {
+	clientNonce, err := session.NewHandshakeNonce()
+	if err != nil {
+		return session.SecuredSession{}, err
+	}
+
+	respMsg, err := send(newPSKClientHelloMessage(origMessage, cfg.pskIdentity, clientNonce))
+	if err != nil {
+		return session.SecuredSession{}, err
+	}
+	if respMsg == nil {
+		return session.SecuredSession{}, ErrorHandshake
+	}
+	if respMsg.Code == CoapCodeForbidden {
+		return session.SecuredSession{}, ErrorPSKRejected
+	}
+
+	option := respMsg.GetOption(OptionHandshakeType)
+	if option == nil || option.IntValue() != CoapHandshakeTypePSKPeerHello || respMsg.Payload == nil {
+		return session.SecuredSession{}, ErrorHandshake
+	}
+	payload := respMsg.Payload.Bytes()
+	if len(payload) <= session.HandshakeNonceSize {
+		return session.SecuredSession{}, ErrorHandshake
+	}
+	serverNonce, tag := payload[:session.HandshakeNonceSize], payload[session.HandshakeNonceSize:]
+	negotiated, _ := handshakeFeatures(respMsg)
+	if err := session.VerifyPSKConfirmation(tag, cfg.psk, cfg.pskIdentity, clientNonce, serverNonce, session.SupportedFeatures, negotiated); err != nil {
+		return session.SecuredSession{}, fmt.Errorf("%w: %v", ErrorHandshake, err)
+	}
+	if negotiated &= session.SupportedFeatures; !negotiated.Has(cfg.requiredFeatures()) {
+		return session.SecuredSession{}, ErrorHandshake
+	}
+
+	ses, err := session.NewPSKSession(cfg.psk, cfg.pskIdentity, clientNonce, serverNonce, true)
+	if err != nil {
+		return session.SecuredSession{}, err
+	}
+	ses.Features = negotiated
+	return ses, nil
+}
+
+func newPSKClientHelloMessage(origMessage *CoAPMessage, identity string, nonce []byte) *CoAPMessage {
+	message := newClientHelloMessage(origMessage, nonce)
+	message.RemoveOptions(OptionHandshakeType)
+	message.AddOption(OptionHandshakeType, CoapHandshakeTypePSKClientHello)
+	message.AddOption(OptionPSKIdentity, identity)
+	return message
+}
+
+// receivePSKHandshake answers a PSKClientHello and stores the new session.
+func receivePSKHandshake(tr *transport, message *CoAPMessage, proxyAddr string) error {
+	identity := message.GetOptionAsString(OptionPSKIdentity)
+	psk, ok := tr.config().lookupPSK(identity)
+	if !ok {
+		rejectHandshake(tr, message)
+		return ErrorUnknownPSKIdentity
+	}
+	if message.Payload == nil || message.Payload.Length() != session.HandshakeNonceSize {
+		return ErrorHandshake
+	}
+
+	offered, hasFeatures := handshakeFeatures(message)
+	features := offered & session.SupportedFeatures
+	if !features.Has(tr.config().requiredFeatures()) {
+		rejectHandshake(tr, message)
+		return ErrorHandshake
+	}
+
+	clientNonce := message.Payload.Bytes()
+	serverNonce, err := session.NewHandshakeNonce()
+	if err != nil {
+		return ErrorHandshake
+	}
+	ses, err := session.NewPSKSession(psk, identity, clientNonce, serverNonce, false)
+	if err != nil {
+		return ErrorHandshake
+	}
+	ses.Features = features
+
+	ses.UpdatedAt = int(time.Now().Unix())
+	setSessionForAddress(tr, ses, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+	MetricSuccessfulHandhshakes.Inc()
+	tr.hooks.sessionEstablished(tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr, ses)
+
+	reply := NewCoAPMessageId(ACK, CoapCodeContent, message.MessageID)
+	reply.AddOption(OptionHandshakeType, CoapHandshakeTypePSKPeerHello)
+	var negotiated session.Features
+	if hasFeatures {
+		negotiated = features
+		reply.AddOption(OptionHandshakeFeatures, uint32(features))
+	}
+	confirmation := session.PSKConfirmation(psk, identity, clientNonce, serverNonce, offered, negotiated)
+	reply.Payload = NewBytesPayload(append(serverNonce, confirmation...))
+	reply.Token = message.Token
+	reply.CloneOptions(message, OptionProxySecurityID)
+	reply.ProxyAddr = message.ProxyAddr
+	if _, err := tr.SendTo(reply, message.Sender); err != nil {
+		return err
+	}
+	return nil
+}
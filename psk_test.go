@@ -0,0 +1,43 @@
+package coalago
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPSKHandshake(t *testing.T) {
+	keys := map[string][]byte{"sensor-7": []byte("0123456789abcdef")}
+	identities := make(chan string, 1)
+	s := NewServer(WithPSKLookup(func(identity string) ([]byte, bool) {
+		key, ok := keys[identity]
+		return key, ok
+	}))
+	s.GET("/whoami", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		identities <- message.PSKIdentity()
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	})
+	uri := "coaps://" + startTestServer(t, s) + "/whoami"
+
+	resp, err := NewClient(WithPSK("sensor-7", keys["sensor-7"])).GET(uri)
+	if err != nil {
+		t.Fatalf("PSK GET() error = %v", err)
+	}
+	if string(resp.Body) != "ok" || <-identities != "sensor-7" {
+		t.Fatalf("PSK GET() = %q", resp.Body)
+	}
+
+	// X25519 clients keep working against the same server.
+	if _, err := NewClient().GET(uri); err != nil {
+		t.Fatalf("X25519 GET() error = %v", err)
+	}
+	if identity := <-identities; identity != "" {
+		t.Fatalf("PSKIdentity() of an X25519 session = %q", identity)
+	}
+
+	if _, err := NewClient(WithPSK("sensor-8", keys["sensor-7"])).GET(uri); !errors.Is(err, ErrorPSKRejected) {
+		t.Fatalf("unknown identity GET() error = %v, want %v", err, ErrorPSKRejected)
+	}
+	if _, err := NewClient(WithPSK("sensor-7", []byte("wrong key"))).GET(uri); !errors.Is(err, ErrorHandshake) {
+		t.Fatalf("wrong key GET() error = %v, want %v", err, ErrorHandshake)
+	}
+}
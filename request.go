@@ -0,0 +1,139 @@
+package coalago
+
+import (
+	"context"
+	"time"
+)
+
+// Request describes a request for Client.Do. NewRequest starts one; the With methods
+// add to it and return it, so a request is built in one expression:
+//
+//	req := coalago.NewRequest(coalago.PUT, "coaps://10.0.0.7:5683/config").
+//		WithPayload(data).
+//		WithContentFormat(coalago.MediaTypeApplicationJSON).
+//		WithIfMatch(etag).
+//		WithTimeout(5 * time.Second)
+type Request struct {
+	method        CoapCode
+	uri           string
+	payload       []byte
+	contentFormat MediaType
+	accept        MediaType
+	options       []*CoAPMessageOption
+	timeout       time.Duration
+	nonConfirm    bool
+	ctx           context.Context
+}
+
+// NewRequest returns a confirmable request with method (GET, POST, PUT or DELETE) for
+// uri, e.g. "coap://host:port/path?query" or "coaps://...".
+func NewRequest(method CoapCode, uri string) *Request {
+	return &Request{method: method, uri: uri, contentFormat: -1, accept: -1}
+}
+
+// WithPayload sets the body of the request.
+func (r *Request) WithPayload(payload []byte) *Request {
+	r.payload = payload
+	return r
+}
+
+// WithContentFormat sets the Content-Format of the payload.
+func (r *Request) WithContentFormat(mt MediaType) *Request {
+	r.contentFormat = mt
+	return r
+}
+
+// WithAccept asks for a response in the given Content-Format.
+func (r *Request) WithAccept(mt MediaType) *Request {
+	r.accept = mt
+	return r
+}
+
+// WithETag adds an ETag the client holds for the resource; the server answers 2.03
+// Valid when one of them is current.
+func (r *Request) WithETag(etag []byte) *Request {
+	return r.WithOption(OptionEtag, string(etag))
+}
+
+// WithIfMatch makes the request conditional on the resource having etag; an empty etag
+// only requires the resource to exist.
+func (r *Request) WithIfMatch(etag []byte) *Request {
+	return r.WithOption(OptionIfMatch, string(etag))
+}
+
+// WithOption adds an option to the request.
+func (r *Request) WithOption(code OptionCode, value interface{}) *Request {
+	r.options = append(r.options, NewOption(code, value))
+	return r
+}
+
+// WithOptions adds options to the request.
+func (r *Request) WithOptions(options ...*CoAPMessageOption) *Request {
+	r.options = append(r.options, options...)
+	return r
+}
+
+// WithTimeout bounds the whole exchange, retransmissions and blockwise transfers
+// included; Do then fails with context.DeadlineExceeded.
+func (r *Request) WithTimeout(timeout time.Duration) *Request {
+	r.timeout = timeout
+	return r
+}
+
+// NonConfirmable sends the request as NON: it is sent once, and Do returns without
+// waiting for a response.
+func (r *Request) NonConfirmable() *Request {
+	r.nonConfirm = true
+	return r
+}
+
+// WithContext binds the request to ctx, see SendContext.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r.ctx = ctx
+	return r
+}
+
+// message builds the CoAP message of the request.
+func (r *Request) message() (*CoAPMessage, error) {
+	msg, err := constructMessage(r.method, r.uri)
+	if err != nil {
+		return nil, err
+	}
+	if r.nonConfirm {
+		msg.Type = NON
+	}
+	if r.contentFormat >= 0 {
+		msg.SetMediaType(r.contentFormat)
+	}
+	if r.accept >= 0 {
+		msg.AddOption(OptionAccept, r.accept)
+	}
+	msg.AddOptions(r.options)
+	if len(r.payload) > 0 {
+		msg.Payload = NewBytesPayload(r.payload)
+	}
+	return msg, nil
+}
+
+// Do sends req and returns the response; NON requests return a nil Response.
+func (c *Client) Do(req *Request) (*Response, error) {
+	msg, err := req.message()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := req.context()
+	defer cancel()
+	return c.SendContext(ctx, msg, msg.Recipient.String())
+}
+
+// context returns the context of the request, bounded by its timeout.
+func (r *Request) context() (context.Context, context.CancelFunc) {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if r.timeout > 0 {
+		return context.WithTimeout(ctx, r.timeout)
+	}
+	return ctx, func() {}
+}
@@ -0,0 +1,112 @@
+package coalago
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClientDo(t *testing.T) {
+	echo := func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		format := -1
+		if opt := message.GetOption(OptionContentFormat); opt != nil {
+			format = opt.IntValue()
+		}
+		accept := -1
+		if opt := message.GetOption(OptionAccept); opt != nil {
+			accept = opt.IntValue()
+		}
+		body := fmt.Sprintf("%s %s %d %d %s %s %s", message.Code, message.Payload.Bytes(), format, accept,
+			message.GetOptionAsString(OptionEtag), message.GetOptionAsString(OptionIfMatch), message.GetURIQuery("q"))
+		return NewResponse(NewStringPayload(body), CoapCodeContent)
+	}
+	received := make(chan string, 1)
+	s := NewServer()
+	s.GET("/echo", echo)
+	s.POST("/echo", echo)
+	s.PUT("/echo", echo)
+	s.DELETE("/echo", echo)
+	s.POST("/notify", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		received <- string(message.Payload.Bytes())
+		return NewResponse(NewEmptyPayload(), CoapCodeChanged)
+	})
+	addr := startTestServer(t, s)
+	uri := "coap://" + addr + "/echo"
+	client := NewClient()
+
+	for _, tt := range []struct {
+		name string
+		do   func() (*Response, error)
+		want string
+	}{
+		{"GET", func() (*Response, error) { return client.GET(uri + "?q=1") }, "GET  -1 -1   1"},
+		{"PUT", func() (*Response, error) { return client.PUT([]byte("v"), uri) }, "PUT v -1 -1   "},
+		{"DELETE", func() (*Response, error) { return client.DELETE([]byte("d"), uri) }, "DELETE d -1 -1   "},
+		{"Do", func() (*Response, error) {
+			return client.Do(NewRequest(PUT, uri).
+				WithPayload([]byte(`{}`)).
+				WithContentFormat(MediaTypeApplicationJSON).
+				WithAccept(MediaTypeTextPlain).
+				WithETag([]byte("e1")).
+				WithIfMatch([]byte("m1")).
+				WithOption(OptionURIQuery, "q=2").
+				WithTimeout(5 * time.Second))
+		}, fmt.Sprintf("PUT {} %d %d e1 m1 2", MediaTypeApplicationJSON, MediaTypeTextPlain)},
+	} {
+		resp, err := tt.do()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := string(resp.Body); got != tt.want {
+			t.Fatalf("%s: body = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	resp, err := client.Do(NewRequest(POST, "coap://"+addr+"/notify").WithPayload([]byte("non")).NonConfirmable())
+	if err != nil || resp != nil {
+		t.Fatalf("NON Do() = %v, %v, want nil, nil", resp, err)
+	}
+	select {
+	case got := <-received:
+		if got != "non" {
+			t.Fatalf("NON payload = %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("NON request was not received")
+	}
+
+	// A NON coaps request performs the handshake first.
+	_, err = NewClient(WithPrivateKey([]byte("do-test"))).
+		Do(NewRequest(POST, "coaps://"+addr+"/notify").WithPayload([]byte("secure non")).NonConfirmable())
+	if err != nil {
+		t.Fatalf("NON coaps Do() error = %v", err)
+	}
+	select {
+	case got := <-received:
+		if got != "secure non" {
+			t.Fatalf("NON coaps payload = %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("NON coaps request was not received")
+	}
+
+	if _, err := client.Do(NewRequest(GET, "http://"+addr+"/echo")); err != ErrUndefinedScheme {
+		t.Fatalf("Do() with an http URI error = %v, want %v", err, ErrUndefinedScheme)
+	}
+}
+
+func TestClientDoTimeout(t *testing.T) {
+	addr := silentPeer(t)
+	client := NewClient()
+
+	start := time.Now()
+	_, err := client.Do(NewRequest(GET, "coap://"+addr+"/silent").WithTimeout(100 * time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Do() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed >= timeWait {
+		t.Fatalf("Do() returned after %v, want well under one retransmission interval", elapsed)
+	}
+}
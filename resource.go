@@ -14,6 +14,14 @@ type CoAPResource struct {
 	Handler    CoAPResourceHandler
 	MediaTypes []MediaType
 	Hash       string // Unique Resource ID
+
+	observable *ObservableResource // set for resources registered with Server.OBSERVE
+	middleware []Middleware        // per-resource middleware, see WithMiddleware
+
+	// /.well-known/core attributes, see WithResourceType, WithInterface and WithSize
+	resourceTypes []string
+	interfaces    []string
+	size          int
 }
 
 type CoAPResourceHandler func(message *CoAPMessage) *CoAPResourceHandlerResult
@@ -22,6 +30,8 @@ type CoAPResourceHandlerResult struct {
 	Payload   CoAPMessagePayload
 	Code      CoapCode
 	MediaType MediaType
+	// Options are added to the response, e.g. OptionEtag or OptionMaxAge
+	Options []*CoAPMessageOption
 }
 
 func NewResponse(payload CoAPMessagePayload, code CoapCode) *CoAPResourceHandlerResult {
@@ -38,6 +48,14 @@ func NewCoAPResource(method CoapMethod, path string, handler CoAPResourceHandler
 	return &CoAPResource{Method: method, Path: path, Handler: handler, Hash: string(hash)}
 }
 
+func newResource(method CoapMethod, path string, handler CoAPResourceHandler, opts []ResourceOption) *CoAPResource {
+	res := NewCoAPResource(method, path, handler)
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
 func (resource *CoAPResource) DoesMatchPath(path string) bool {
 	path = strings.Trim(path, "/ ")
 	return (resource.Path == path)
@@ -0,0 +1,151 @@
+package coalago
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// DefaultMaxAge is the freshness lifetime of a response without a Max-Age option
+// (RFC 7252 §5.10.5).
+const DefaultMaxAge = 60 * time.Second
+
+func (r *Response) option(code OptionCode) *CoAPMessageOption {
+	for _, opt := range r.Options {
+		if opt.Code == code {
+			return opt
+		}
+	}
+	return nil
+}
+
+func (r *Response) optionStrings(code OptionCode) []string {
+	var values []string
+	for _, opt := range r.Options {
+		if opt.Code == code {
+			values = append(values, opt.StringValue())
+		}
+	}
+	return values
+}
+
+// ContentFormat returns the Content-Format of the body; ok is false if the response
+// has none.
+func (r *Response) ContentFormat() (mt MediaType, ok bool) {
+	if opt := r.option(OptionContentFormat); opt != nil {
+		return MediaType(opt.IntValue()), true
+	}
+	return 0, false
+}
+
+// ETag returns the ETag of the response, nil if it has none.
+func (r *Response) ETag() []byte {
+	if opt := r.option(OptionEtag); opt != nil {
+		return []byte(opt.StringValue())
+	}
+	return nil
+}
+
+// MaxAge returns how long the response stays fresh, DefaultMaxAge if it has no
+// Max-Age option.
+func (r *Response) MaxAge() time.Duration {
+	if opt := r.option(OptionMaxAge); opt != nil {
+		return time.Duration(opt.Uint32Value()) * time.Second
+	}
+	return DefaultMaxAge
+}
+
+// LocationPath returns the Location-Path of a created resource, e.g. "/items/7"; ""
+// if the response has none.
+func (r *Response) LocationPath() string {
+	segments := r.optionStrings(OptionLocationPath)
+	if len(segments) == 0 {
+		return ""
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// LocationQuery returns the Location-Query arguments of a created resource.
+func (r *Response) LocationQuery() []string {
+	return r.optionStrings(OptionLocationQuery)
+}
+
+// Observe returns the sequence number of a notification; ok is false if the response
+// is not one.
+func (r *Response) Observe() (seq int, ok bool) {
+	if opt := r.option(OptionObserve); opt != nil {
+		return opt.IntValue(), true
+	}
+	return 0, false
+}
+
+// Size2 returns the size of the whole body of a response as announced by the server,
+// which is also set on Block2 transfers; ok is false if it is not known.
+func (r *Response) Size2() (size int, ok bool) {
+	if opt := r.option(OptionSize2); opt != nil {
+		return opt.IntValue(), true
+	}
+	return 0, false
+}
+
+// DecodeJSON decodes the JSON body into v.
+func (r *Response) DecodeJSON(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// DecodeCBOR decodes the CBOR body into v. v follows the encoding/json rules, struct
+// tags included; byte strings decode into []byte fields and CBOR tags are ignored.
+func (r *Response) DecodeCBOR(v interface{}) error {
+	return unmarshalCBOR(r.Body, v)
+}
+
+// Decode decodes the body into v by its Content-Format, JSON or CBOR; other formats
+// fail with ErrUnsupportedContentFormat.
+func (r *Response) Decode(v interface{}) error {
+	mt, _ := r.ContentFormat()
+	switch mt {
+	case MediaTypeApplicationJSON:
+		return r.DecodeJSON(v)
+	case MediaTypeApplicationCBOR:
+		return r.DecodeCBOR(v)
+	default:
+		return ErrUnsupportedContentFormat
+	}
+}
+
+// exchangeStats collects the metadata of a client exchange for its Response; a nil
+// *exchangeStats (server transports) collects nothing.
+type exchangeStats struct {
+	rtt             time.Duration
+	retransmissions int
+	blocks          int
+}
+
+// replied records the round-trip time of a request sent at sent, unless the exchange
+// already has one.
+func (s *exchangeStats) replied(sent time.Time) {
+	if s != nil && s.rtt == 0 {
+		s.rtt = time.Since(sent)
+	}
+}
+
+func (s *exchangeStats) retransmitted() {
+	if s != nil {
+		s.retransmissions++
+	}
+}
+
+func (s *exchangeStats) addBlocks(n int) {
+	if s != nil {
+		s.blocks += n
+	}
+}
+
+func (s *exchangeStats) fill(r *Response) {
+	if s == nil || r == nil {
+		return
+	}
+	r.RTT = s.rtt
+	r.Retransmissions = s.retransmissions
+	r.Blocks = s.blocks
+}
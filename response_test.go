@@ -0,0 +1,185 @@
+package coalago
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResponseMetadata(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 3000)
+	s := NewServer()
+	s.POST("/items", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		result := NewResponse(NewStringPayload(`{"id":7,"name":"lamp"}`), CoapCodeCreated)
+		result.MediaType = MediaTypeApplicationJSON
+		result.Options = []*CoAPMessageOption{
+			NewOption(OptionEtag, "v1"),
+			NewOption(OptionMaxAge, 30),
+			NewOption(OptionLocationPath, "items"),
+			NewOption(OptionLocationPath, "7"),
+			NewOption(OptionLocationQuery, "rev=1"),
+		}
+		return result
+	})
+	s.GET("/big", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewBytesPayload(big), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+	client := NewClient()
+
+	resp, err := client.POST(big, "coap://"+addr+"/items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt, ok := resp.ContentFormat(); !ok || mt != MediaTypeApplicationJSON {
+		t.Errorf("ContentFormat() = %v, %v", mt, ok)
+	}
+	if got := string(resp.ETag()); got != "v1" {
+		t.Errorf("ETag() = %q", got)
+	}
+	if got := resp.MaxAge(); got != 30*time.Second {
+		t.Errorf("MaxAge() = %v", got)
+	}
+	if got := resp.LocationPath(); got != "/items/7" {
+		t.Errorf("LocationPath() = %q", got)
+	}
+	if got := resp.LocationQuery(); !reflect.DeepEqual(got, []string{"rev=1"}) {
+		t.Errorf("LocationQuery() = %q", got)
+	}
+	if _, ok := resp.Observe(); ok {
+		t.Error("Observe() of a plain response ok")
+	}
+	if resp.Addr != addr {
+		t.Errorf("Addr = %q, want %q", resp.Addr, addr)
+	}
+	if resp.RTT <= 0 || resp.Blocks != 3 {
+		t.Errorf("RTT = %v, Blocks = %d, want > 0 and 3", resp.RTT, resp.Blocks)
+	}
+	var item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := resp.Decode(&item); err != nil || item.ID != 7 || item.Name != "lamp" {
+		t.Errorf("Decode() = %+v, %v", item, err)
+	}
+
+	resp, err = client.GET("coap://" + addr + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, ok := resp.Size2(); !ok || size != len(big) {
+		t.Errorf("Size2() = %d, %v, want %d", size, ok, len(big))
+	}
+	if resp.MaxAge() != DefaultMaxAge || resp.ETag() != nil || resp.Blocks != 3 {
+		t.Errorf("MaxAge() = %v, ETag() = %q, Blocks = %d", resp.MaxAge(), resp.ETag(), resp.Blocks)
+	}
+	if err := resp.Decode(&item); err != ErrUnsupportedContentFormat {
+		t.Errorf("Decode() of a body without Content-Format error = %v", err)
+	}
+}
+
+func TestResponseRetransmissions(t *testing.T) {
+	// A peer that ignores the first copy of every request
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, MTU)
+		seen := make(map[uint16]bool)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			message, err := Deserialize(buf[:n])
+			if err != nil || !seen[message.MessageID] {
+				if err == nil {
+					seen[message.MessageID] = true
+				}
+				continue
+			}
+			reply := ackTo(nil, message, CoapCodeContent)
+			reply.Payload = NewStringPayload("late")
+			data, _ := Serialize(reply)
+			conn.WriteToUDP(data, from)
+		}
+	}()
+
+	client := NewClient(WithAckTimeout(50 * time.Millisecond))
+	resp, err := client.GET("coap://" + conn.LocalAddr().String() + "/late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Retransmissions != 1 || string(resp.Body) != "late" {
+		t.Fatalf("Retransmissions = %d, Body = %q, want 1 and late", resp.Retransmissions, resp.Body)
+	}
+	if resp.RTT >= 50*time.Millisecond {
+		t.Fatalf("RTT = %v, want the time since the retransmission", resp.RTT)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	// Examples from RFC 8949, Appendix A
+	for _, tt := range []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", uint64(0)},
+		{"1903e8", uint64(1000)},
+		{"1bffffffffffffffff", uint64(18446744073709551615)},
+		{"3863", int64(-100)},
+		{"f93c00", 1.0},
+		{"f9c400", -4.0},
+		{"fa47c35000", 100000.0},
+		{"fb3ff199999999999a", 1.1},
+		{"f4", false},
+		{"f6", nil},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"83010203", []interface{}{uint64(1), uint64(2), uint64(3)}},
+		{"a201020304", map[string]interface{}{"1": uint64(2), "3": uint64(4)}},
+		{"a26161016162820203", map[string]interface{}{"a": uint64(1), "b": []interface{}{uint64(2), uint64(3)}}},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9f018202039f0405ffff", []interface{}{uint64(1), []interface{}{uint64(2), uint64(3)}, []interface{}{uint64(4), uint64(5)}}},
+		{"bf6346756ef563416d7421ff", map[string]interface{}{"Fun": true, "Amt": int64(-2)}},
+	} {
+		data, _ := hex.DecodeString(tt.hex)
+		var got interface{}
+		if err := unmarshalCBOR(data, &got); err != nil {
+			t.Errorf("%s: %v", tt.hex, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.hex, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "18", "62ff", "9b00000000ffffffff", "1c", "0000", "7f01ff"} {
+		data, _ := hex.DecodeString(bad)
+		var got interface{}
+		if err := unmarshalCBOR(data, &got); !errors.Is(err, ErrInvalidCBOR) {
+			t.Errorf("%q: error = %v, want %v", bad, err, ErrInvalidCBOR)
+		}
+	}
+
+	// {"id": 7, "tags": ["a"], "raw": h'0102'} into a struct
+	data, _ := hex.DecodeString("a362696407647461677381616163726177420102")
+	var v struct {
+		ID   int      `json:"id"`
+		Tags []string `json:"tags"`
+		Raw  []byte   `json:"raw"`
+	}
+	if err := (&Response{Body: data}).DecodeCBOR(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.ID != 7 || !reflect.DeepEqual(v.Tags, []string{"a"}) || !bytes.Equal(v.Raw, []byte{1, 2}) {
+		t.Fatalf("DecodeCBOR() = %+v", v)
+	}
+}
@@ -0,0 +1,80 @@
+package coalago
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetransmitPolicy decides how long a confirmable message waits for its ACK before it
+// is sent again. A message is given up with ErrMaxAttempts after WithMaxRetransmits
+// retransmissions whatever the policy.
+type RetransmitPolicy interface {
+	// NewBackoff starts the schedule of one message. ackTimeout is WithAckTimeout, or
+	// the Timeout set on the message.
+	NewBackoff(ackTimeout time.Duration) Backoff
+}
+
+// Backoff is the retransmission schedule of one confirmable message.
+type Backoff interface {
+	// Next returns how long the next transmission waits for its ACK.
+	Next() time.Duration
+}
+
+// RFC7252Retransmit is the retransmission of RFC 7252 §4.2 and the default policy:
+// the first ACK wait is random between the ACK timeout and ACK_RANDOM_FACTOR times
+// it, and every retransmission doubles it.
+func RFC7252Retransmit() RetransmitPolicy {
+	return rfc7252Policy{randomFactor: ACK_RANDOM_FACTOR, rand: rand.Float64}
+}
+
+// FixedRetransmit waits interval for every ACK; a zero interval waits the ACK timeout.
+func FixedRetransmit(interval time.Duration) RetransmitPolicy {
+	return fixedPolicy(interval)
+}
+
+type rfc7252Policy struct {
+	randomFactor float64
+	rand         func() float64 // uniform in [0, 1)
+}
+
+func (p rfc7252Policy) NewBackoff(ackTimeout time.Duration) Backoff {
+	initial := float64(ackTimeout) * (1 + (p.randomFactor-1)*p.rand())
+	return &doublingBackoff{next: time.Duration(initial)}
+}
+
+type doublingBackoff struct {
+	next time.Duration
+}
+
+func (b *doublingBackoff) Next() time.Duration {
+	timeout := b.next
+	b.next *= 2
+	return timeout
+}
+
+type fixedPolicy time.Duration
+
+func (p fixedPolicy) NewBackoff(ackTimeout time.Duration) Backoff {
+	if p > 0 {
+		return fixedBackoff(p)
+	}
+	return fixedBackoff(ackTimeout)
+}
+
+type fixedBackoff time.Duration
+
+func (b fixedBackoff) Next() time.Duration {
+	return time.Duration(b)
+}
+
+// clock runs the retransmission timers that are not socket read deadlines; tests
+// replace it to walk through a schedule without waiting.
+type clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,146 @@
+package coalago
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetransmitPolicies(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy RetransmitPolicy
+		want   []time.Duration
+	}{
+		{"rfc7252 low", rfc7252Policy{randomFactor: 1.5, rand: func() float64 { return 0 }},
+			[]time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second}},
+		{"rfc7252 middle", rfc7252Policy{randomFactor: 1.5, rand: func() float64 { return 0.5 }},
+			[]time.Duration{2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 20 * time.Second}},
+		{"fixed", FixedRetransmit(300 * time.Millisecond),
+			[]time.Duration{300 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}},
+		{"fixed ack timeout", FixedRetransmit(0),
+			[]time.Duration{2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second}},
+	} {
+		backoff := tt.policy.NewBackoff(2 * time.Second)
+		for i, want := range tt.want {
+			if got := backoff.Next(); got != want {
+				t.Errorf("%s: timeout %d = %v, want %v", tt.name, i, got, want)
+			}
+		}
+	}
+
+	backoff := RFC7252Retransmit().NewBackoff(time.Second)
+	if first := backoff.Next(); first < time.Second || first >= 1500*time.Millisecond {
+		t.Fatalf("RFC7252Retransmit() first timeout = %v, want in [1s, 1.5s)", first)
+	}
+}
+
+func TestSendCONFollowsRetransmitPolicy(t *testing.T) {
+	conn := &silentTransport{
+		local:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5683},
+		remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5684},
+	}
+	tr := newtransport(conn)
+	tr.opts = newCoalaopts(
+		WithRetransmitPolicy(rfc7252Policy{randomFactor: 1.5, rand: func() float64 { return 0.5 }}),
+		WithMaxRetransmits(3),
+	)
+
+	message := NewCoAPMessage(CON, GET)
+	message.SetURIPath("/test")
+	if _, err := tr.sendCON(message); !errors.Is(err, ErrMaxAttempts) {
+		t.Fatalf("sendCON() error = %v, want %v", err, ErrMaxAttempts)
+	}
+
+	want := []time.Duration{1250 * time.Millisecond, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second}
+	if conn.writes != len(want) || len(conn.timeouts) != len(want) {
+		t.Fatalf("sent %d times waiting %v, want %v", conn.writes, conn.timeouts, want)
+	}
+	for i := range want {
+		// The deadline is armed a moment after the wait starts.
+		if conn.timeouts[i] > want[i] || conn.timeouts[i] < want[i]-100*time.Millisecond {
+			t.Fatalf("waits = %v, want %v", conn.timeouts, want)
+		}
+	}
+}
+
+func TestServerSendFollowsRetransmitPolicy(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	s := NewServer(WithAckTimeout(time.Second), WithRetransmitPolicy(rfc7252Policy{randomFactor: 1.5, rand: func() float64 { return 0 }}))
+	clk := &instantClock{}
+	s.opts.clock = clk
+	startTestServer(t, s)
+
+	message := NewCoAPMessage(CON, GET)
+	message.SetURIPath("/silent")
+	if _, err := s.Send(message, peer.LocalAddr().String(), WithRetries(2)); !errors.Is(err, ErrMaxAttempts) {
+		t.Fatalf("Send() error = %v, want %v", err, ErrMaxAttempts)
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if waits := clk.waits(); len(waits) != len(want) || waits[0] != want[0] || waits[1] != want[1] || waits[2] != want[2] {
+		t.Fatalf("waits = %v, want %v", waits, want)
+	}
+	buf := make([]byte, MTU)
+	for i := 0; i < len(want); i++ {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := peer.ReadFromUDP(buf); err != nil {
+			t.Fatalf("transmission %d: %v", i+1, err)
+		}
+	}
+}
+
+// silentTransport accepts every datagram and never answers: each read times out at
+// once after recording the deadline it was given.
+type silentTransport struct {
+	checksumTransport
+	local, remote net.Addr
+
+	writes   int
+	timeouts []time.Duration
+}
+
+func (t *silentTransport) RemoteAddr() net.Addr { return t.remote }
+func (t *silentTransport) LocalAddr() net.Addr  { return t.local }
+
+func (t *silentTransport) Write(buf []byte) (int, error) {
+	t.writes++
+	return len(buf), nil
+}
+
+func (t *silentTransport) SetReadDeadlineSec(timeout time.Duration) {
+	t.timeouts = append(t.timeouts, timeout)
+}
+
+func (t *silentTransport) Read([]byte) (int, error) {
+	return 0, os.ErrDeadlineExceeded
+}
+
+// instantClock expires every timer at once and records its duration.
+type instantClock struct {
+	mx sync.Mutex
+	d  []time.Duration
+}
+
+func (c *instantClock) After(d time.Duration) <-chan time.Time {
+	c.mx.Lock()
+	c.d = append(c.d, d)
+	c.mx.Unlock()
+	ch := make(chan time.Time, 1)
+	ch <- time.Time{}
+	return ch
+}
+
+func (c *instantClock) waits() []time.Duration {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return append([]time.Duration(nil), c.d...)
+}
@@ -0,0 +1,193 @@
+package coalago
+
+import (
+	"strings"
+	"sync"
+)
+
+// Route patterns are resource paths whose segments are one of:
+//
+//	literal   devices        matches the same segment only
+//	{name}    {id}           matches any single segment, available as PathParam("id")
+//	*         fw/*           as the last segment matches the rest of the path (zero or more
+//	                         segments), available as PathParam("*")
+//
+// When several patterns match a path the most specific one wins: patterns are compared
+// segment by segment and at the first difference a literal beats a parameter, and a
+// parameter beats a wildcard. So "devices/42" prefers "devices/42" over "devices/{id}",
+// "devices/{id}" over "devices/*", and "fw/beta/*" over "fw/*". The catch-all "*" has
+// the lowest precedence of all.
+
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+// wildcardParam is the PathParam name holding the part of the path matched by "*".
+const wildcardParam = "*"
+
+type routeSegment struct {
+	kind  segmentKind
+	value string // literal text or parameter name
+}
+
+type route struct {
+	resource *CoAPResource
+	segments []routeSegment
+}
+
+// router maps request paths and methods to resources. The zero value is ready to use.
+type router struct {
+	mx     sync.RWMutex
+	routes []*route
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/ ")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func parseRoute(res *CoAPResource) *route {
+	parts := splitPath(res.Path)
+	r := &route{resource: res, segments: make([]routeSegment, len(parts))}
+	for i, part := range parts {
+		switch {
+		case part == "*" && i == len(parts)-1:
+			r.segments[i] = routeSegment{kind: segmentWildcard}
+		case len(part) > 2 && strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			r.segments[i] = routeSegment{kind: segmentParam, value: part[1 : len(part)-1]}
+		default:
+			r.segments[i] = routeSegment{kind: segmentLiteral, value: part}
+		}
+	}
+	return r
+}
+
+// isTemplate reports whether the route matches more than one path.
+func (r *route) isTemplate() bool {
+	for _, seg := range r.segments {
+		if seg.kind != segmentLiteral {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the path parameters when the route matches path.
+func (r *route) match(path []string) (map[string]string, bool) {
+	var params map[string]string
+	for i, seg := range r.segments {
+		if seg.kind == segmentWildcard {
+			if params == nil {
+				params = make(map[string]string, 1)
+			}
+			params[wildcardParam] = strings.Join(path[i:], "/")
+			return params, true
+		}
+		if i >= len(path) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if seg.value != path[i] {
+				return nil, false
+			}
+		case segmentParam:
+			if params == nil {
+				params = make(map[string]string, len(r.segments))
+			}
+			params[seg.value] = path[i]
+		}
+	}
+	if len(path) != len(r.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// moreSpecific reports whether r takes precedence over other when both match a path.
+func (r *route) moreSpecific(other *route) bool {
+	for i := 0; i < len(r.segments) && i < len(other.segments); i++ {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind < other.segments[i].kind
+		}
+	}
+	return len(r.segments) > len(other.segments)
+}
+
+// add registers res, replacing a resource with the same pattern and method.
+func (rt *router) add(res *CoAPResource) {
+	rt.mx.Lock()
+	defer rt.mx.Unlock()
+	for i, r := range rt.routes {
+		if r.resource.Path == res.Path && r.resource.Method == res.Method {
+			rt.routes[i] = parseRoute(res)
+			return
+		}
+	}
+	rt.routes = append(rt.routes, parseRoute(res))
+}
+
+// match finds the most specific resource for path and method. When the path is only
+// served for other methods, one of those resources is returned so the caller can
+// answer 4.05 Method Not Allowed instead of 4.04 Not Found.
+func (rt *router) match(path string, method CoapMethod) (*CoAPResource, map[string]string) {
+	segments := splitPath(path)
+
+	rt.mx.RLock()
+	defer rt.mx.RUnlock()
+
+	var best, other *route
+	var bestParams, otherParams map[string]string
+	for _, r := range rt.routes {
+		params, ok := r.match(segments)
+		if !ok {
+			continue
+		}
+		if r.resource.Method != method {
+			if other == nil || r.moreSpecific(other) {
+				other, otherParams = r, params
+			}
+			continue
+		}
+		if best == nil || r.moreSpecific(best) {
+			best, bestParams = r, params
+		}
+	}
+
+	if best != nil {
+		return best.resource, bestParams
+	}
+	if other != nil {
+		return other.resource, otherParams
+	}
+	return nil, nil
+}
+
+// resources returns the resources with literal paths (no parameters or wildcard) in
+// registration order.
+func (rt *router) resources() []*CoAPResource {
+	rt.mx.RLock()
+	defer rt.mx.RUnlock()
+
+	var resources []*CoAPResource
+	for _, r := range rt.routes {
+		if !r.isTemplate() {
+			resources = append(resources, r.resource)
+		}
+	}
+	return resources
+}
+
+// PathParam returns the value of the path parameter name captured by the route of the
+// resource handling this request: "{name}" segments and "*" for the wildcard tail.
+// It returns "" when the parameter is absent.
+func (m *CoAPMessage) PathParam(name string) string {
+	return m.pathParams[name]
+}
@@ -0,0 +1,97 @@
+package coalago
+
+import (
+	"testing"
+)
+
+func TestRouterPrecedenceAndParams(t *testing.T) {
+	var rt router
+	for _, path := range []string{
+		"*",
+		"devices/{id}",
+		"devices/42",
+		"devices/{id}/sensors/{sensor}",
+		"devices/*",
+		"fw/*",
+		"fw/beta/*",
+	} {
+		rt.add(NewCoAPResource(CoapMethodGet, path, nil))
+	}
+
+	tests := []struct {
+		path   string
+		want   string
+		params map[string]string
+	}{
+		{path: "/devices/42", want: "devices/42"},
+		{path: "/devices/7", want: "devices/{id}", params: map[string]string{"id": "7"}},
+		{path: "devices/7/sensors/temp", want: "devices/{id}/sensors/{sensor}", params: map[string]string{"id": "7", "sensor": "temp"}},
+		{path: "/devices/7/config", want: "devices/*", params: map[string]string{"*": "7/config"}},
+		{path: "/fw/1.2/image.bin", want: "fw/*", params: map[string]string{"*": "1.2/image.bin"}},
+		{path: "/fw/beta/2.0", want: "fw/beta/*", params: map[string]string{"*": "2.0"}},
+		{path: "/fw", want: "fw/*", params: map[string]string{"*": ""}},
+		{path: "/status", want: "*", params: map[string]string{"*": "status"}},
+	}
+	for _, tt := range tests {
+		res, params := rt.match(tt.path, CoapMethodGet)
+		if res == nil || res.Path != tt.want {
+			t.Errorf("match(%q) = %v, want %q", tt.path, res, tt.want)
+			continue
+		}
+		if len(params) != len(tt.params) {
+			t.Errorf("match(%q) params = %v, want %v", tt.path, params, tt.params)
+			continue
+		}
+		for k, v := range tt.params {
+			if params[k] != v {
+				t.Errorf("match(%q) params[%q] = %q, want %q", tt.path, k, params[k], v)
+			}
+		}
+	}
+}
+
+func TestRouterOtherMethodAndReplace(t *testing.T) {
+	var rt router
+	rt.add(NewCoAPResource(CoapMethodPost, "devices/{id}", nil))
+
+	if res, _ := rt.match("devices/1", CoapMethodGet); res == nil || res.Method != CoapMethodPost {
+		t.Fatalf("match() = %v, want the POST resource so the server answers 4.05", res)
+	}
+	if res, _ := rt.match("other", CoapMethodGet); res != nil {
+		t.Fatalf("match() = %v, want nil for an unknown path", res)
+	}
+
+	replacement := NewCoAPResource(CoapMethodPost, "/devices/{id}/", nil)
+	rt.add(replacement)
+	if len(rt.routes) != 1 {
+		t.Fatalf("routes = %d, want the pattern replaced", len(rt.routes))
+	}
+	if res, _ := rt.match("devices/1", CoapMethodPost); res != replacement {
+		t.Fatal("match() did not return the replacement resource")
+	}
+}
+
+func TestServerPathParamAndMethodNotAllowed(t *testing.T) {
+	s := NewServer()
+	s.GET("/devices/{id}/sensors/{sensor}", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload(message.PathParam("id")+":"+message.PathParam("sensor")), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+	client := NewClient()
+
+	resp, err := client.GET("coap://" + addr + "/devices/7/sensors/temp")
+	if err != nil {
+		t.Fatalf("GET() error = %v", err)
+	}
+	if string(resp.Body) != "7:temp" {
+		t.Fatalf("GET() body = %q, want %q", resp.Body, "7:temp")
+	}
+
+	resp, err = client.POST(nil, "coap://"+addr+"/devices/7/sensors/temp")
+	if err != nil {
+		t.Fatalf("POST() error = %v", err)
+	}
+	if resp.Code != CoapCodeMethodNotAllowed {
+		t.Fatalf("POST() code = %v, want %v", resp.Code, CoapCodeMethodNotAllowed)
+	}
+}
@@ -1,10 +1,12 @@
 package coalago
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/coalalib/coalago/session"
@@ -31,7 +33,12 @@ func securityOutputLayer(tr *transport, message *CoAPMessage, addr string) error
 		return ErrorClientSessionNotFound
 	}
 
-	if err := encrypt(message, addr, currentSession.AEAD); err != nil {
+	if err := encrypt(message, addr, currentSession); err != nil {
+		if err == session.ErrSequenceExhausted {
+			// The caller renegotiates the session and sends again
+			deleteSessionForAddress(tr, currentAddr, addr, proxyAddr)
+			return ErrorClientSessionExpired
+		}
 		return err
 	}
 	return nil
@@ -62,6 +69,7 @@ func getSessionForAddress(tr *transport, senderAddr, receiverAddr, proxyAddr str
 	sessions := tr.sessionStorage()
 	securedSession, ok := sessions.Get(senderAddr, receiverAddr, proxyAddr)
 	if ok {
+		securedSession.UpdatedAt = int(time.Now().Unix())
 		sessions.Set(senderAddr, receiverAddr, proxyAddr, securedSession)
 	}
 	return securedSession, ok
@@ -91,6 +99,14 @@ func securityInputLayer(tr *transport, message *CoAPMessage, proxyAddr string) e
 	return handleCoapsScheme(tr, message, proxyAddr)
 }
 
+// isRepeatedBlock reports whether a duplicate legacy coaps message is an ARQ block that
+// the sender retransmits until it is acknowledged. Such a duplicate is passed on so it
+// is acknowledged again; the receiver of the transfer keeps it from being used twice.
+// Any other duplicate is dropped as a replay.
+func isRepeatedBlock(message *CoAPMessage) bool {
+	return message.Type == CON && (message.GetBlock1() != nil || message.GetBlock2() != nil)
+}
+
 func handleCoapsScheme(tr *transport, message *CoAPMessage, proxyAddr string) error {
 	// Check if the message has coaps:// scheme and requires a new Session
 	if message.GetScheme() == COAPS_SCHEME {
@@ -110,7 +126,16 @@ func handleCoapsScheme(tr *transport, message *CoAPMessage, proxyAddr string) er
 		}
 
 		// Decrypt message payload
-		err := decrypt(message, currentSession.AEAD)
+		err := decrypt(message, currentSession)
+		if errors.Is(err, ErrorReplayedMessage) {
+			// A duplicate or replayed datagram: the session is fine, just drop it
+			MetricReplayedMessages.Inc()
+			return err
+		}
+		if err == nil && message.duplicate && !isRepeatedBlock(message) {
+			MetricReplayedMessages.Inc()
+			return replayed(session.ErrReplayedMessageID)
+		}
 		if err != nil {
 			deleteSessionForAddress(tr, tr.conn.LocalAddr().String(), addressSession, proxyAddr)
 			responseMessage := NewCoAPMessageId(ACK, CoapCodeUnauthorized, message.MessageID)
@@ -124,6 +149,12 @@ func handleCoapsScheme(tr *transport, message *CoAPMessage, proxyAddr string) er
 		}
 
 		message.PeerPublicKey = currentSession.PeerPublicKey
+		message.peerVerified = tr.config().keyVerifier != nil && len(currentSession.PeerPublicKey) > 0
+		message.pskIdentity = currentSession.PSKIdentity
+
+		if option := message.GetOption(OptionHandshakeType); option != nil && isSessionControl(option.IntValue()) {
+			return receiveSessionControl(tr, message, currentSession, proxyAddr)
+		}
 	}
 
 	/* Receive Errors */
@@ -147,26 +178,87 @@ func receiveHandshake(tr *transport, privatekey []byte, message *CoAPMessage, pr
 	if message.IsProxies {
 		return true, nil
 	}
+	defer func() {
+		if err != nil {
+			tr.hooks.handshakeFailed(message.Sender, err)
+		}
+	}()
 	option := message.GetOption(OptionHandshakeType)
 	if option == nil {
 		return true, nil
 	}
 
 	value := option.IntValue()
+	if value == CoapHandshakeTypePSKClientHello {
+		return false, receivePSKHandshake(tr, message, proxyAddr)
+	}
+	if isSessionControl(value) {
+		// Encrypted like any coaps message, see handleCoapsScheme
+		return true, nil
+	}
 	if value != CoapHandshakeTypeClientSignature && value != CoapHandshakeTypeClientHello {
 		return false, nil
 	}
 
-	peerSession, ok := getSessionForAddress(tr, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
-	if !ok {
-		if peerSession, err = session.NewSecuredSession(tr.privateKey); err != nil {
+	if value == CoapHandshakeTypeClientHello && message.Payload != nil {
+		// Every ClientHello starts a new session: the sequence numbers of the previous
+		// one must not carry over when the peer rekeys (retransmitted hellos carry the
+		// same token and are dropped before reaching here).
+		peerSession, err := session.NewSecuredSession(tr.privateKey)
+		if err != nil {
 			return false, ErrorHandshake
 		}
-	}
-	if value == CoapHandshakeTypeClientHello && message.Payload != nil {
 		peerSession.PeerPublicKey = message.Payload.Bytes()
+		if err := tr.verifyPeerKey(peerSession.PeerPublicKey, message.Sender); err != nil {
+			rejectHandshake(tr, message)
+			return false, err
+		}
+
+		theirs := readKeyExchange(message)
+		var features *session.Features
+		if theirs.hasFeatures {
+			negotiated := theirs.features & session.SupportedFeatures
+			if len(theirs.nonce) != session.HandshakeNonceSize {
+				negotiated &^= session.FeatureHandshakeNonce
+			}
+			if !negotiated.Has(session.FeatureHandshakeNonce) {
+				// Sequence numbers restart with every session: without the nonces two
+				// sessions between the same static keys would reuse AES-GCM nonces.
+				negotiated &^= session.FeatureSequenceNonce
+			}
+			if len(theirs.ephemeral) != session.KEY_SIZE {
+				negotiated &^= session.FeatureEphemeralKey
+			}
+			features = &negotiated
+			peerSession.Features = negotiated
+		}
+		if !peerSession.Features.Has(tr.config().requiredFeatures()) {
+			// WithStrictSessions: no fallback to a weaker session
+			rejectHandshake(tr, message)
+			return false, ErrorHandshake
+		}
+
+		ours := keyExchange{publicKey: peerSession.Curve.GetPublicKey()}
+		if peerSession.Features.Has(session.FeatureHandshakeNonce) {
+			if ours.nonce, err = session.NewHandshakeNonce(); err != nil {
+				return false, ErrorHandshake
+			}
+		}
+		if theirs.hasFeatures {
+			if err := bindHandshake(&peerSession, peerSession.PeerPublicKey, ours.publicKey, theirs.nonce, ours.nonce, theirs.features); err != nil {
+				return false, ErrorHandshake
+			}
+		}
+		if peerSession.Features.Has(session.FeatureEphemeralKey) {
+			ephemeral, err := session.NewCurve25519()
+			if err != nil {
+				return false, ErrorHandshake
+			}
+			ours.ephemeral = ephemeral.GetPublicKey()
+			peerSession.BindEphemeral(ephemeral, theirs.ephemeral)
+		}
 
-		if err := incomingHandshake(tr, peerSession.Curve.GetPublicKey(), message); err != nil {
+		if err := incomingHandshake(tr, ours, features, message); err != nil {
 			return false, ErrorHandshake
 		}
 		if signature, err := peerSession.GetSignature(); err == nil {
@@ -181,6 +273,7 @@ func receiveHandshake(tr *transport, privatekey []byte, message *CoAPMessage, pr
 
 		peerSession.UpdatedAt = int(time.Now().Unix())
 		setSessionForAddress(tr, peerSession, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+		tr.hooks.sessionEstablished(tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr, peerSession)
 		return false, nil
 	}
 
@@ -189,33 +282,54 @@ func receiveHandshake(tr *transport, privatekey []byte, message *CoAPMessage, pr
 
 func handshake(tr *transport, message *CoAPMessage, address net.Addr, proxyAddr string) (session.SecuredSession, error) {
 	ses, ok := getSessionForAddress(tr, tr.conn.LocalAddr().String(), address.String(), proxyAddr)
-	if ok {
+	if ok && !tr.config().needsRekey(ses) {
+		return ses, nil
+	}
+
+	// Exchanges sharing a socket share its session: the first one negotiates it and
+	// the others wait for it.
+	unlock, err := handshakeLocks.lock(message.getContext(), sessionKey(tr.conn.LocalAddr().String(), address.String(), proxyAddr))
+	if err != nil {
+		return session.SecuredSession{}, err
+	}
+	defer unlock()
+	ses, ok = getSessionForAddress(tr, tr.conn.LocalAddr().String(), address.String(), proxyAddr)
+	if ok && !tr.config().needsRekey(ses) {
+		return ses, nil
+	}
+
+	if cfg := tr.config(); cfg.pskIdentity != "" {
+		ses, err := pskHandshake(cfg, message, tr.Send)
+		if err != nil {
+			return session.SecuredSession{}, err
+		}
+		tr.sessionStorage().Set(tr.conn.LocalAddr().String(), address.String(), proxyAddr, ses)
+		MetricSuccessfulHandhshakes.Inc()
 		return ses, nil
+	}
 
+	ses, err = session.NewSecuredSession(tr.privateKey)
+	if err != nil {
+		return session.SecuredSession{}, err
 	}
 
-	ses, err := session.NewSecuredSession(tr.privateKey)
+	ours, ephemeral, err := newKeyExchange(tr.config(), ses)
 	if err != nil {
 		return session.SecuredSession{}, err
 	}
 
 	// Sending my Public Key.
 	// Receiving Peer's Public Key as a Response!
-	peerPublicKey, err := sendHelloFromClient(tr, message, ses.Curve.GetPublicKey(), address)
+	theirs, err := sendHelloFromClient(tr, message, ours, address)
 	if err != nil {
 		return session.SecuredSession{}, err
 	}
 
-	// assign new value
-	ses.PeerPublicKey = peerPublicKey
-
-	signature, err := ses.GetSignature()
-	if err != nil {
+	if err := tr.verifyPeerKey(theirs.publicKey, address); err != nil {
 		return session.SecuredSession{}, err
 	}
 
-	err = ses.Verify(signature)
-	if err != nil {
+	if err := completeHandshake(&ses, ours, ephemeral, theirs, tr.config().requiredFeatures()); err != nil {
 		return session.SecuredSession{}, err
 	}
 
@@ -225,57 +339,241 @@ func handshake(tr *transport, message *CoAPMessage, address net.Addr, proxyAddr
 	return ses, nil
 }
 
-func sendHelloFromClient(tr *transport, origMessage *CoAPMessage, myPublicKey []byte, address net.Addr) ([]byte, error) {
-	var peerPublicKey []byte
-	message := newClientHelloMessage(origMessage, myPublicKey)
+// handshakeLocks serializes the handshakes initiated for one session key.
+var handshakeLocks = keyedLocks{locks: make(map[string]*keyedLock)}
+
+type keyedLocks struct {
+	mx    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// lock acquires the lock of key, or fails with ctx.Err() when ctx is done first.
+func (k *keyedLocks) lock(ctx context.Context, key string) (unlock func(), err error) {
+	k.mx.Lock()
+	l := k.locks[key]
+	if l == nil {
+		l = &keyedLock{ch: make(chan struct{}, 1)}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mx.Unlock()
+
+	release := func() {
+		k.mx.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mx.Unlock()
+	}
+	select {
+	case l.ch <- struct{}{}:
+		return func() {
+			<-l.ch
+			release()
+		}, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// keyExchange is the key material one side of an X25519 handshake sends in its hello.
+type keyExchange struct {
+	publicKey   []byte           // static key, the identity of the peer
+	features    session.Features // as sent: offered by the client, negotiated by the server
+	hasFeatures bool             // false for legacy peers
+	nonce       []byte           // with session.FeatureHandshakeNonce
+	ephemeral   []byte           // ephemeral public key, with session.FeatureEphemeralKey
+}
+
+// addOptions puts the nonce and the ephemeral key into a hello message.
+func (kx keyExchange) addOptions(message *CoAPMessage) {
+	if kx.nonce != nil {
+		message.AddOption(OptionHandshakeNonce, string(kx.nonce))
+	}
+	if kx.ephemeral != nil {
+		message.AddOption(OptionHandshakeEphemeral, string(kx.ephemeral))
+	}
+}
+
+func readKeyExchange(message *CoAPMessage) keyExchange {
+	kx := keyExchange{
+		nonce:     []byte(message.GetOptionAsString(OptionHandshakeNonce)),
+		ephemeral: []byte(message.GetOptionAsString(OptionHandshakeEphemeral)),
+	}
+	if message.Payload != nil {
+		kx.publicKey = message.Payload.Bytes()
+	}
+	kx.features, kx.hasFeatures = handshakeFeatures(message)
+	return kx
+}
+
+// newKeyExchange prepares the ClientHello of the handshake initiator. The ephemeral
+// key pair is only generated with WithForwardSecrecy.
+func newKeyExchange(cfg *coalaopts, ses session.SecuredSession) (keyExchange, *session.Curve25519, error) {
+	nonce, err := session.NewHandshakeNonce()
+	if err != nil {
+		return keyExchange{}, nil, err
+	}
+	kx := keyExchange{publicKey: ses.Curve.GetPublicKey(), features: session.SupportedFeatures, hasFeatures: true, nonce: nonce}
+	if !cfg.forwardSecrecy {
+		return kx, nil, nil
+	}
+
+	ephemeral, err := session.NewCurve25519()
+	if err != nil {
+		return keyExchange{}, nil, err
+	}
+	kx.ephemeral = ephemeral.GetPublicKey()
+	return kx, &ephemeral, nil
+}
+
+// completeHandshake derives the session keys of the initiator from the PeerHello. It
+// fails when the PeerHello lacks one of the required features.
+func completeHandshake(ses *session.SecuredSession, ours keyExchange, ephemeral *session.Curve25519, theirs keyExchange, required session.Features) error {
+	// assign new value
+	ses.PeerPublicKey = theirs.publicKey
+	ses.Features = theirs.features & session.SupportedFeatures
+	if !ses.Features.Has(required) {
+		return ErrorHandshake
+	}
+	if ses.Features.Has(session.FeatureSequenceNonce) && !ses.Features.Has(session.FeatureHandshakeNonce) {
+		// Sequence numbers without per-session keys reuse AES-GCM nonces
+		return ErrorHandshake
+	}
+	if theirs.hasFeatures {
+		if err := bindHandshake(ses, ours.publicKey, theirs.publicKey, ours.nonce, theirs.nonce, ours.features); err != nil {
+			return err
+		}
+	}
+	if ses.Features.Has(session.FeatureEphemeralKey) {
+		if ephemeral == nil || len(theirs.ephemeral) != session.KEY_SIZE {
+			return ErrorHandshake
+		}
+		ses.BindEphemeral(*ephemeral, theirs.ephemeral)
+	} else if ephemeral != nil {
+		// WithForwardSecrecy: no fallback to the static-only handshake
+		return ErrorHandshake
+	}
+
+	signature, err := ses.GetSignature()
+	if err != nil {
+		return err
+	}
+	return ses.Verify(signature)
+}
+
+func sendHelloFromClient(tr *transport, origMessage *CoAPMessage, ours keyExchange, address net.Addr) (keyExchange, error) {
+	message := newClientHelloMessage(origMessage, ours.publicKey)
+	ours.addOptions(message)
 
 	respMsg, err := tr.Send(message)
 	if err != nil {
-		return nil, err
+		return keyExchange{}, err
 	}
 
+	return readPeerHello(origMessage, respMsg)
+}
+
+// readPeerHello extracts the peer public key, the negotiated features, the peer nonce
+// and ephemeral key from a PeerHello. A peer that does not answer with features only
+// speaks the legacy protocol.
+func readPeerHello(origMessage, respMsg *CoAPMessage) (keyExchange, error) {
+	var hello keyExchange
 	if respMsg == nil {
-		return nil, nil
+		return hello, nil
+	}
+	if respMsg.Code == CoapCodeForbidden {
+		return hello, ErrorPeerKeyRejected
 	}
 
 	optHandshake := respMsg.GetOption(OptionHandshakeType)
 	if optHandshake != nil {
 		if optHandshake.IntValue() == CoapHandshakeTypePeerHello {
-			peerPublicKey = respMsg.Payload.Bytes()
+			hello = readKeyExchange(respMsg)
 		}
 	}
 
 	if origMessage.BreakConnectionOnPK != nil {
-		if origMessage.BreakConnectionOnPK(peerPublicKey) {
-			return nil, errors.New(ERR_KEYS_NOT_MATCH)
+		if origMessage.BreakConnectionOnPK(hello.publicKey) {
+			return keyExchange{}, errors.New(ERR_KEYS_NOT_MATCH)
 		}
 	}
 
-	return peerPublicKey, err
+	return hello, nil
+}
+
+// bindHandshake derives the keys of ses from the transcript of a handshake whose hellos
+// carried features, so features changed on the way give the two sides different keys.
+// The nonces are bound too when session.FeatureHandshakeNonce was negotiated. offered is
+// what the ClientHello carried. Call it before Verify/PeerVerify.
+func bindHandshake(ses *session.SecuredSession, clientPublicKey, serverPublicKey, clientNonce, serverNonce []byte, offered session.Features) error {
+	if !ses.Features.Has(session.FeatureHandshakeNonce) {
+		clientNonce, serverNonce = nil, nil
+	} else if len(clientNonce) != session.HandshakeNonceSize || len(serverNonce) != session.HandshakeNonceSize {
+		return ErrorHandshake
+	}
+	transcript := session.HandshakeTranscript(clientPublicKey, serverPublicKey, clientNonce, serverNonce, offered, ses.Features)
+	ses.BindHandshake(clientNonce, serverNonce, transcript)
+	return nil
+}
+
+// handshakeFeatures returns the features a hello carries, including ones this side does
+// not support, and whether the hello carried the option at all (legacy peers omit it).
+func handshakeFeatures(message *CoAPMessage) (session.Features, bool) {
+	option := message.GetOption(OptionHandshakeFeatures)
+	if option == nil {
+		return 0, false
+	}
+	return session.Features(option.Uint32Value()), true
 }
 
 func newClientHelloMessage(origMessage *CoAPMessage, myPublicKey []byte) *CoAPMessage {
 	message := NewCoAPMessage(CON, GET)
 	message.AddOption(OptionHandshakeType, CoapHandshakeTypeClientHello)
+	message.AddOption(OptionHandshakeFeatures, uint32(session.SupportedFeatures))
 	message.Payload = NewBytesPayload(myPublicKey)
 	message.Token = generateToken(6)
 	message.CloneOptions(origMessage, OptionProxyURI, OptionProxySecurityID)
 	message.ProxyAddr = origMessage.ProxyAddr
+	message.Context = origMessage.Context
+	message.Timeout = origMessage.Timeout
 	return message
 }
 
-func newServerHelloMessage(origMessage *CoAPMessage, publicKey []byte) *CoAPMessage {
+func newServerHelloMessage(origMessage *CoAPMessage, ours keyExchange, features *session.Features) *CoAPMessage {
 	message := NewCoAPMessageId(ACK, CoapCodeContent, origMessage.MessageID)
 	message.AddOption(OptionHandshakeType, CoapHandshakeTypePeerHello)
-	message.Payload = NewBytesPayload(publicKey)
+	if features != nil {
+		message.AddOption(OptionHandshakeFeatures, uint32(*features))
+	}
+	ours.addOptions(message)
+	message.Payload = NewBytesPayload(ours.publicKey)
 	message.Token = origMessage.Token
 	message.CloneOptions(origMessage, OptionProxySecurityID)
 	message.ProxyAddr = origMessage.ProxyAddr
 	return message
 }
 
-func incomingHandshake(tr *transport, publicKey []byte, origMessage *CoAPMessage) error {
-	message := newServerHelloMessage(origMessage, publicKey)
+// rejectHandshake answers a ClientHello from a peer whose key is not trusted, or that
+// does not offer the features WithStrictSessions requires.
+func rejectHandshake(tr *transport, origMessage *CoAPMessage) {
+	message := NewCoAPMessageId(ACK, CoapCodeForbidden, origMessage.MessageID)
+	message.Token = origMessage.Token
+	message.CloneOptions(origMessage, OptionProxySecurityID)
+	message.ProxyAddr = origMessage.ProxyAddr
+	if _, err := tr.SendTo(message, origMessage.Sender); err != nil {
+		fmt.Println("sendTo error:", err.Error())
+	}
+}
+
+func incomingHandshake(tr *transport, ours keyExchange, features *session.Features, origMessage *CoAPMessage) error {
+	message := newServerHelloMessage(origMessage, ours, features)
 	if _, err := tr.SendTo(message, origMessage.Sender); err != nil {
 		return err
 	}
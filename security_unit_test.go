@@ -3,6 +3,9 @@ package coalago
 import (
 	"bytes"
 	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
 )
 
 func TestNewClientHelloMessageUsesGet(t *testing.T) {
@@ -20,7 +23,156 @@ func TestNewClientHelloMessageUsesGet(t *testing.T) {
 	if option := message.GetOption(OptionHandshakeType); option == nil || option.IntValue() != CoapHandshakeTypeClientHello {
 		t.Fatalf("HandshakeType = %#v, want ClientHello", option)
 	}
+	if option := message.GetOption(OptionHandshakeFeatures); option == nil || session.Features(option.Uint32Value()) != session.SupportedFeatures {
+		t.Fatalf("HandshakeFeatures = %#v, want %v", option, session.SupportedFeatures)
+	}
 	if !bytes.Equal(message.Payload.Bytes(), publicKey) {
 		t.Fatalf("Payload = %x, want %x", message.Payload.Bytes(), publicKey)
 	}
 }
+
+func TestServerHelloNegotiation(t *testing.T) {
+	peer := newRawPeer(t, startTestServer(t, NewServer()))
+	nonce, _ := session.NewHandshakeNonce()
+	ephemeral, _ := session.NewCurve25519()
+	ephemeralKey := ephemeral.GetPublicKey()
+	static := session.SupportedFeatures &^ session.FeatureEphemeralKey
+
+	tests := []struct {
+		name         string
+		offer        bool
+		nonce        []byte
+		ephemeral    []byte
+		wantFeatures *session.Features
+	}{
+		{"legacy peer", false, nil, nil, nil},
+		{"features without nonce", true, nil, nil, ptr(static &^ session.FeatureHandshakeNonce &^ session.FeatureSequenceNonce)},
+		{"features and nonce", true, nonce, nil, ptr(static)},
+		{"ephemeral key", true, nonce, ephemeralKey, ptr(session.SupportedFeatures)},
+		{"short ephemeral key", true, nonce, ephemeralKey[:16], ptr(static)},
+	}
+	for _, tt := range tests {
+		client, _ := session.NewSecuredSession(nil)
+		hello := newClientHelloMessage(NewCoAPMessage(CON, GET), client.Curve.GetPublicKey())
+		if !tt.offer {
+			hello.RemoveOptions(OptionHandshakeFeatures)
+		}
+		if tt.nonce != nil {
+			hello.AddOption(OptionHandshakeNonce, string(tt.nonce))
+		}
+		if tt.ephemeral != nil {
+			hello.AddOption(OptionHandshakeEphemeral, string(tt.ephemeral))
+		}
+		peer.send(hello)
+
+		reply, err := peer.receive(time.Second)
+		if err != nil {
+			t.Fatalf("%s: no PeerHello: %v", tt.name, err)
+		}
+		features, offered := handshakeFeatures(reply)
+		switch {
+		case tt.wantFeatures == nil && offered:
+			t.Errorf("%s: PeerHello offers features %v to a legacy peer", tt.name, features)
+		case tt.wantFeatures != nil && (!offered || features != *tt.wantFeatures):
+			t.Errorf("%s: PeerHello features = %v, want %v", tt.name, features, *tt.wantFeatures)
+		}
+		serverNonce := reply.GetOptionAsString(OptionHandshakeNonce)
+		if wantNonce := tt.nonce != nil; (len(serverNonce) == session.HandshakeNonceSize) != wantNonce {
+			t.Errorf("%s: PeerHello nonce = %x, want one: %v", tt.name, serverNonce, wantNonce)
+		}
+		serverEphemeral := reply.GetOptionAsString(OptionHandshakeEphemeral)
+		if wantEphemeral := len(tt.ephemeral) == session.KEY_SIZE; (len(serverEphemeral) == session.KEY_SIZE) != wantEphemeral {
+			t.Errorf("%s: PeerHello ephemeral key = %x, want one: %v", tt.name, serverEphemeral, wantEphemeral)
+		}
+	}
+}
+
+func TestHandshakeBindsOfferedFeatures(t *testing.T) {
+	establish := func(offered session.Features) (client, server session.SecuredSession) {
+		client, _ = session.NewSecuredSession([]byte("client-key"))
+		server, _ = session.NewSecuredSession([]byte("server-key"))
+		client.PeerPublicKey = server.Curve.GetPublicKey()
+		server.PeerPublicKey = client.Curve.GetPublicKey()
+		// No handshake nonces: only the transcript binds the features.
+		negotiated := offered & session.FeatureAuthenticatedHeader
+		client.Features, server.Features = negotiated, negotiated
+		clientKey, serverKey := client.Curve.GetPublicKey(), server.Curve.GetPublicKey()
+		if err := bindHandshake(&client, clientKey, serverKey, nil, nil, session.SupportedFeatures); err != nil {
+			t.Fatal(err)
+		}
+		if err := bindHandshake(&server, clientKey, serverKey, nil, nil, offered); err != nil {
+			t.Fatal(err)
+		}
+		signature, _ := client.GetSignature()
+		client.Verify(signature)
+		signature, _ = server.GetSignature()
+		server.PeerVerify(signature)
+		return client, server
+	}
+
+	client, server := establish(session.SupportedFeatures)
+	if !bytes.Equal(client.AEAD.MyKey, server.AEAD.PeerKey) {
+		t.Fatal("untouched hellos give the two sides different keys")
+	}
+	client, server = establish(session.FeatureAuthenticatedHeader)
+	if bytes.Equal(client.AEAD.MyKey, server.AEAD.PeerKey) {
+		t.Fatal("features changed on the way give the two sides the same keys")
+	}
+}
+
+func TestStrictSessions(t *testing.T) {
+	peer := newRawPeer(t, startTestServer(t, NewServer(WithStrictSessions())))
+	client, _ := session.NewSecuredSession(nil)
+	hello := newClientHelloMessage(NewCoAPMessage(CON, GET), client.Curve.GetPublicKey())
+	hello.RemoveOptions(OptionHandshakeFeatures)
+	peer.send(hello)
+	reply, err := peer.receive(time.Second)
+	if err != nil {
+		t.Fatalf("no reply to a legacy ClientHello: %v", err)
+	}
+	if reply.Code != CoapCodeForbidden {
+		t.Fatalf("reply to a legacy ClientHello = %v, want %v", reply.Code, CoapCodeForbidden)
+	}
+
+	// A legacy PeerHello fails the strict initiator.
+	server, _ := session.NewSecuredSession(nil)
+	ours, _, _ := newKeyExchange(newCoalaopts(), client)
+	theirs := keyExchange{publicKey: server.Curve.GetPublicKey()}
+	if err := completeHandshake(&client, ours, nil, theirs, newCoalaopts(WithStrictSessions()).requiredFeatures()); err != ErrorHandshake {
+		t.Fatalf("completeHandshake(legacy PeerHello) error = %v, want %v", err, ErrorHandshake)
+	}
+}
+
+func TestSequenceNonceNeedsHandshakeNonce(t *testing.T) {
+	client, _ := session.NewSecuredSession(nil)
+	server, _ := session.NewSecuredSession(nil)
+	ours, _, _ := newKeyExchange(newCoalaopts(), client)
+	theirs := keyExchange{
+		publicKey:   server.Curve.GetPublicKey(),
+		features:    session.FeatureSequenceNonce | session.FeatureAuthenticatedHeader,
+		hasFeatures: true,
+	}
+	if err := completeHandshake(&client, ours, nil, theirs, 0); err != ErrorHandshake {
+		t.Fatalf("completeHandshake(sequence numbers without nonces) error = %v, want %v", err, ErrorHandshake)
+	}
+}
+
+func TestForwardSecrecyWithoutEphemeralPeer(t *testing.T) {
+	client, _ := session.NewSecuredSession(nil)
+	server, _ := session.NewSecuredSession(nil)
+	ours, ephemeral, _ := newKeyExchange(newCoalaopts(WithForwardSecrecy()), client)
+	nonce, _ := session.NewHandshakeNonce()
+	theirs := keyExchange{
+		publicKey:   server.Curve.GetPublicKey(),
+		features:    session.SupportedFeatures &^ session.FeatureEphemeralKey,
+		hasFeatures: true,
+		nonce:       nonce,
+	}
+	if err := completeHandshake(&client, ours, ephemeral, theirs, 0); err != ErrorHandshake {
+		t.Fatalf("completeHandshake(static-only PeerHello) error = %v, want %v", err, ErrorHandshake)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -28,8 +28,9 @@ type proxyNote struct {
 type Server struct {
 	proxyEnable    bool
 	sr             *transport
-	resources      sync.Map
+	routes         router
 	privatekey     []byte
+	opts           *coalaopts   // таймауты, окна ARQ, MTU и TTL сессий этого сервера
 	addr           string       // сохраняем адрес для Refresh()
 	connectionType uint8        // битовая маска для TCP/UDP
 	proxyCache     *cache.Cache // token + addr -> proxyNote
@@ -38,6 +39,15 @@ type Server struct {
 	// два сервера в одном бинарнике (со своими ключами) перетирали бы сессии друг друга
 	// для одного и того же peer+proxy.
 	sessions *sessionStorageImpl
+	// tcpConns — TCP-соединения пиров этого сервера по адресу; живут sessionTTL сервера
+	tcpConns *connectionStorage
+	// hooks — колбэки жизненного цикла сессий, см. OnSessionEstablished
+	hooks *sessionHooks
+	// observe — наблюдаемые ресурсы (RFC 7641) и нотификации, ждущие ACK от подписчиков
+	observe *observeRegistry
+
+	middleware []Middleware // глобальные middleware, см. Use
+	mwMu       sync.RWMutex
 
 	tcpLn net.Listener // TCP-accept-листенер из listenTCP; нужен только чтобы Close() мог его закрыть
 	srMu  sync.Mutex   // защищает s.sr и s.tcpLn от гонки между Close/Refresh/Listen/listenTCP
@@ -47,22 +57,49 @@ type Server struct {
 }
 
 func NewServer(opts ...Opt) *Server {
-	options := &coalaopts{}
-	for _, opt := range opts {
-		opt(options)
-	}
+	options := newCoalaopts(opts...)
 
-	return &Server{
+	s := &Server{
 		privatekey: options.privatekey,
+		opts:       options,
 		proxyCache: cache.New(time.Minute, time.Second), // token + addr -> proxyNote
-		sessions:   newSessionStorageImpl(SESSIONS_POOL_EXPIRATION),
+		sessions:   newSessionStorageImpl(options.sessionTTL),
+		tcpConns:   newConnectionStorage(options.sessionTTL),
+		hooks:      new(sessionHooks),
+	}
+	if options.sessionStore != nil {
+		s.sessions = newSessionStorage(options.sessionStore)
+	}
+	s.observe = newObserveRegistry(s.resourceHandler)
+	// список ресурсов для discovery (RFC 6690); свой GET на этот путь его заменяет
+	s.GET(wellKnownCorePath, s.wellKnownCore, WithContentFormat(MediaTypeApplicationLinkFormat))
+	return s
+}
+
+// config возвращает настройки сервера; сервер, собранный не через NewServer, работает на умолчаниях.
+func (s *Server) config() *coalaopts {
+	if s.opts != nil {
+		return s.opts
+	}
+	return defaultOptions
+}
+
+// tcpConnections возвращает TCP-соединения пиров этого сервера; сервер, собранный не
+// через NewServer, использует общее хранилище процесса.
+func (s *Server) tcpConnections() *connectionStorage {
+	if s.tcpConns != nil {
+		return s.tcpConns
 	}
+	return connStorage
 }
 
-// newServerTransport создает transport, привязанный к хранилищу сессий этого сервера.
+// newServerTransport создает transport, привязанный к хранилищу сессий и настройкам этого сервера.
 func (s *Server) newServerTransport(conn Transport) *transport {
 	tr := newtransport(conn)
 	tr.sessions = s.sessions
+	tr.opts = s.opts
+	tr.hooks = s.hooks
+	setAckTimeout(conn, s.config().ackTimeout)
 	return tr
 }
 
@@ -76,9 +113,7 @@ func (s *Server) Listen(addr string) error {
 	s.addr = addr                         // сохраняем адрес для будущего рестарта
 	s.connectionType |= ConnectionTypeUDP // устанавливаем бит UDP = 1
 
-	var conn Transport
-	var err error
-	conn, err = newListener(addr)
+	conn, err := s.newUDPListener(addr)
 	if err != nil {
 		return err
 	}
@@ -87,14 +122,30 @@ func (s *Server) Listen(addr string) error {
 	s.sr = s.newServerTransport(conn)
 	s.sr.privateKey = s.privatekey
 	s.srMu.Unlock()
+	cfg := s.config()
 	fmt.Printf(
 		"COALA server start ADDR: %s, WS: %d, MinWS: %d, MaxWS: %d, Retransmit:%d, timeWait:%d, poolExpiration:%d\n",
-		addr, DEFAULT_WINDOW_SIZE, MIN_WiNDOW_SIZE, MAX_WINDOW_SIZE, maxSendAttempts, timeWait, SESSIONS_POOL_EXPIRATION)
+		addr, cfg.windowSize, cfg.minWindowSize, cfg.maxWindowSize, cfg.maxAttempts(), cfg.ackTimeout, cfg.sessionTTL)
 
 	s.listenLoop() // блокирующий цикл прослушивания
 	return nil
 }
 
+// newUDPListener открывает UDP-сокет сервера; узел кластера (WithCluster) получает
+// обертку, пересылающую чужие датаграммы узлу-владельцу.
+func (s *Server) newUDPListener(addr string) (Transport, error) {
+	conn, err := newListener(addr)
+	if err != nil || s.config().clusterSelf == "" {
+		return conn, err
+	}
+	cluster, err := newClusterConn(conn, s.config())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return cluster, nil
+}
+
 func (s *Server) listenTCP(addr string) error {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -125,15 +176,17 @@ func (s *Server) listenTCP(addr string) error {
 }
 
 func (s *Server) HandleTCPConn(conn net.Conn) {
-	connStorage.SetTCP(conn.RemoteAddr().String(), conn)
+	s.tcpConnections().SetTCP(conn.RemoteAddr().String(), conn)
+
+	tcpTr := s.newServerTransport(&tcpConnection{conn: conn.(*net.TCPConn)})
 
 	defer func() {
 		conn.Close()
-		connStorage.DeleteTCP(conn.RemoteAddr().String())
+		s.tcpConnections().DeleteTCP(conn.RemoteAddr().String())
+		// подписки, пришедшие по этому соединению, больше некуда доставлять
+		s.observe.dropTransport(tcpTr)
 	}()
 
-	tcpTr := s.newServerTransport(&tcpConnection{conn: conn.(*net.TCPConn)})
-
 	buf := make([]byte, 65536)
 	for {
 		n, err := ReadTcpFrame(conn, buf)
@@ -144,7 +197,7 @@ func (s *Server) HandleTCPConn(conn net.Conn) {
 			return
 		}
 
-		connStorage.SetTCP(conn.RemoteAddr().String(), conn)
+		s.tcpConnections().SetTCP(conn.RemoteAddr().String(), conn)
 
 		msg, err := Deserialize(buf[:n])
 		if err != nil {
@@ -154,6 +207,10 @@ func (s *Server) HandleTCPConn(conn net.Conn) {
 
 		msg.Sender = conn.RemoteAddr()
 		proxyUri := msg.GetOptionProxyURIasString()
+		if _, ok := httpProxyURL(msg); ok {
+			// http(s) Proxy-Uri сервер обрабатывает сам, см. WithHTTPProxy
+			proxyUri = ""
+		}
 		if proxyUri == "" {
 			if v, ok := s.proxyCache.Get(msg.GetTokenString() + conn.RemoteAddr().String()); ok {
 				note := v.(*proxyNote)
@@ -211,7 +268,7 @@ func (s *Server) Refresh() error {
 	if s.IsTCP() {
 		conn, err = newListenerTCP(s.addr)
 	} else {
-		conn, err = newListener(s.addr)
+		conn, err = s.newUDPListener(s.addr)
 	}
 	if err != nil {
 		s.srMu.Unlock()
@@ -258,24 +315,83 @@ func (s *Server) Close() error {
 				s.closeErr = err
 			}
 		}
+
+		// Хранилище с сохранением на диск (FileSessionStore) сбрасывает сессии, чтобы
+		// после перезапуска устройства не повторяли хендшейк все разом.
+		if saver, ok := s.config().sessionStore.(interface{ Save() error }); ok {
+			if err := saver.Save(); err != nil && s.closeErr == nil {
+				s.closeErr = err
+			}
+		}
 	})
 	return s.closeErr
 }
 
-func (s *Server) GET(path string, handler CoAPResourceHandler) {
-	s.addResource(NewCoAPResource(CoapMethodGet, path, handler))
+func (s *Server) GET(path string, handler CoAPResourceHandler, opts ...ResourceOption) {
+	s.addResource(newResource(CoapMethodGet, path, handler, opts))
 }
 
-func (s *Server) POST(path string, handler CoAPResourceHandler) {
-	s.addResource(NewCoAPResource(CoapMethodPost, path, handler))
+func (s *Server) POST(path string, handler CoAPResourceHandler, opts ...ResourceOption) {
+	s.addResource(newResource(CoapMethodPost, path, handler, opts))
 }
 
-func (s *Server) PUT(path string, handler CoAPResourceHandler) {
-	s.addResource(NewCoAPResource(CoapMethodPut, path, handler))
+func (s *Server) PUT(path string, handler CoAPResourceHandler, opts ...ResourceOption) {
+	s.addResource(newResource(CoapMethodPut, path, handler, opts))
+}
+
+func (s *Server) DELETE(path string, handler CoAPResourceHandler, opts ...ResourceOption) {
+	s.addResource(newResource(CoapMethodDelete, path, handler, opts))
+}
+
+// Use добавляет middleware, которое оборачивает хэндлеры всех ресурсов сервера, в том
+// числе зарегистрированных раньше. Первое переданное выполняется первым; middleware
+// ресурса (WithMiddleware) выполняется внутри серверного.
+func (s *Server) Use(mw ...Middleware) {
+	s.mwMu.Lock()
+	s.middleware = append(s.middleware, mw...)
+	s.mwMu.Unlock()
+}
+
+// resourceHandler собирает цепочку: Recover -> middleware сервера -> middleware ресурса
+// -> хэндлер. Recover снаружи всегда, чтобы паника в хэндлере или middleware давала
+// ответ 5.00, а не оставляла запрос (или нотификацию Observe) без ответа.
+func (s *Server) resourceHandler(res *CoAPResource) CoAPResourceHandler {
+	s.mwMu.RLock()
+	global := s.middleware
+	s.mwMu.RUnlock()
+	return Recover()(chain(chain(res.Handler, res.middleware), global))
+}
+
+// OBSERVE регистрирует GET-ресурс, на который клиенты могут подписаться опцией Observe
+// (RFC 7641). Каждый вызов Notify (у ресурса или Server.Notify) повторно вызывает handler
+// для всех подписчиков и рассылает результат нотификацией.
+func (s *Server) OBSERVE(path string, handler CoAPResourceHandler, opts ...ResourceOption) *ObservableResource {
+	if s.observe == nil {
+		s.observe = newObserveRegistry(s.resourceHandler)
+	}
+	res := newResource(CoapMethodGet, path, handler, opts)
+	res.observable = newObservableResource(s.observe, res)
+	s.observe.add(res.observable)
+	s.addResource(res)
+	return res.observable
 }
 
-func (s *Server) DELETE(path string, handler CoAPResourceHandler) {
-	s.addResource(NewCoAPResource(CoapMethodDelete, path, handler))
+// Notify рассылает нотификации подписчикам наблюдаемого ресурса path. Шаблон, с которым
+// ресурс регистрировался ("/devices/{id}"), оповещает всех его подписчиков, конкретный
+// путь ("/devices/42") — только подписавшихся на этот путь.
+// Возвращает ErrNoMatchingRoute, если ресурс не регистрировался через OBSERVE.
+func (s *Server) Notify(path string) error {
+	if res, ok := s.observe.get(path); ok {
+		res.Notify()
+		return nil
+	}
+
+	res, _ := s.matchResource(path, CoapMethodGet)
+	if res == nil || res.observable == nil {
+		return ErrNoMatchingRoute
+	}
+	res.observable.notifyObservers(path)
+	return nil
 }
 
 func (s *Server) Proxy(flag bool) {
@@ -299,7 +415,7 @@ func (s *Server) sendMultyProxy(message *CoAPMessage, addr string) error {
 	}
 
 	tr := s.sr
-	if conn, ok := connStorage.GetTCP(addr); ok {
+	if conn, ok := s.tcpConnections().GetTCP(addr); ok {
 		tr = s.newServerTransport(&tcpConnection{conn: conn.(*net.TCPConn)})
 	}
 
@@ -318,7 +434,7 @@ func (s *Server) sendMultyProxy(message *CoAPMessage, addr string) error {
 
 func (s *Server) sendTo(message *CoAPMessage, addr string) error {
 	tr := s.sr
-	if conn, ok := connStorage.GetTCP(addr); ok {
+	if conn, ok := s.tcpConnections().GetTCP(addr); ok {
 		tr = s.newServerTransport(&tcpConnection{conn: conn.(*net.TCPConn)})
 	}
 
@@ -352,6 +468,7 @@ type sendOpts struct {
 
 type SendOptions func(*sendOpts)
 
+// WithRetries задает число повторных отправок Send вместо WithMaxRetransmits сервера.
 func WithRetries(retries int) SendOptions {
 	return func(opts *sendOpts) {
 		opts.retries = retries
@@ -364,7 +481,7 @@ func (s *Server) Send(message *CoAPMessage, addr string, opts ...SendOptions) (*
 	}
 
 	tr := s.sr
-	if conn, ok := connStorage.GetTCP(addr); ok {
+	if conn, ok := s.tcpConnections().GetTCP(addr); ok {
 		tr = s.newServerTransport(&tcpConnection{conn: conn.(*net.TCPConn)})
 	}
 
@@ -376,11 +493,12 @@ func (s *Server) Send(message *CoAPMessage, addr string, opts ...SendOptions) (*
 
 	_, err := s.serverHandshake(tr, message, addr, proxyAddr)
 	if err != nil {
+		s.handshakeFailed(addr, err)
 		return nil, err
 	}
 
-	message.Timeout = time.Second
-	msg, err := s.send(message, addr)
+	message.Timeout = s.config().ackTimeout
+	msg, err := s.send(message, addr, opts...)
 	if err == nil {
 		return msg, nil
 	}
@@ -391,6 +509,7 @@ func (s *Server) Send(message *CoAPMessage, addr string, opts ...SendOptions) (*
 
 	_, err = s.serverHandshake(tr, message, addr, proxyAddr)
 	if err != nil {
+		s.handshakeFailed(addr, err)
 		return nil, err
 	}
 
@@ -400,17 +519,19 @@ func (s *Server) Send(message *CoAPMessage, addr string, opts ...SendOptions) (*
 // Send отправляет сообщение на указанный адрес и возвращает ответ
 // используется вместо клиента, когда нужно отправить запрос с занятого сервером порта
 func (s *Server) send(message *CoAPMessage, addr string, opts ...SendOptions) (*CoAPMessage, error) {
+	cfg := s.config()
 	o := &sendOpts{
-		retries: 0,
+		retries: cfg.maxRetransmits,
 	}
 
 	for _, opt := range opts {
 		opt(o)
 	}
 
-	if message.Timeout == 0 {
-		message.Timeout = time.Second
+	if message.Timeout == 0 || message.Timeout == timeWait {
+		message.Timeout = cfg.ackTimeout
 	}
+	backoff := cfg.backoff(message.Timeout)
 
 	if err := s.sendTo(message, addr); err != nil {
 		return nil, err
@@ -421,23 +542,49 @@ func (s *Server) send(message *CoAPMessage, addr string, opts ...SendOptions) (*
 
 	defer bq.Delete(message.GetTokenString() + resolved.String())
 
-	for range o.retries + 1 {
+	ctx := message.getContext()
+	for attempt := 0; ; attempt++ {
 		select {
 		case msg := <-ch:
 			return msg, nil
-		case <-time.After(message.Timeout):
-			if err := s.sendTo(message, addr); err != nil {
-				return nil, err
-			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-cfg.clock.After(backoff.Next()):
+		}
+		if attempt == o.retries {
+			MetricExpiredMessages.Inc()
+			return nil, ErrMaxAttempts
+		}
+		MetricRetransmitMessages.Inc()
+		if err := s.sendTo(message, addr); err != nil {
+			return nil, err
 		}
 	}
+}
 
-	return nil, errors.New("timeout")
+// handshakeFailed сообщает OnHandshakeFailed о неудачном хендшейке, начатом сервером.
+func (s *Server) handshakeFailed(addr string, err error) {
+	if resolved, rerr := net.ResolveUDPAddr("udp", addr); rerr == nil {
+		s.hooks.handshakeFailed(resolved, err)
+	}
 }
 
 func (s *Server) serverHandshake(tr *transport, message *CoAPMessage, address string, proxyAddr string) (session.SecuredSession, error) {
 	ses, ok := getSessionForAddress(tr, tr.conn.LocalAddr().String(), address, proxyAddr)
-	if ok {
+	if ok && !s.config().needsRekey(ses) {
+		return ses, nil
+	}
+
+	if cfg := s.config(); cfg.pskIdentity != "" {
+		ses, err := pskHandshake(cfg, message, func(hello *CoAPMessage) (*CoAPMessage, error) {
+			return s.Send(hello, address)
+		})
+		if err != nil {
+			return session.SecuredSession{}, err
+		}
+		tr.sessionStorage().Set(tr.conn.LocalAddr().String(), address, proxyAddr, ses)
+		MetricSuccessfulHandhshakes.Inc()
+		tr.hooks.sessionEstablished(tr.conn.LocalAddr().String(), address, proxyAddr, ses)
 		return ses, nil
 	}
 
@@ -446,59 +593,47 @@ func (s *Server) serverHandshake(tr *transport, message *CoAPMessage, address st
 		return session.SecuredSession{}, err
 	}
 
+	ours, ephemeral, err := newKeyExchange(s.config(), ses)
+	if err != nil {
+		return session.SecuredSession{}, err
+	}
+
 	// Sending my Public Key.
 	// Receiving Peer's Public Key as a Response!
-	peerPublicKey, err := s.sendHelloFromServer(message, ses.Curve.GetPublicKey(), address)
+	theirs, err := s.sendHelloFromServer(message, ours, address)
 	if err != nil {
 		return session.SecuredSession{}, err
 	}
 
-	// assign new value
-	ses.PeerPublicKey = peerPublicKey
-
-	signature, err := ses.GetSignature()
+	resolved, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
 		return session.SecuredSession{}, err
 	}
+	if err := tr.verifyPeerKey(theirs.publicKey, resolved); err != nil {
+		return session.SecuredSession{}, err
+	}
 
-	err = ses.Verify(signature)
-	if err != nil {
+	if err := completeHandshake(&ses, ours, ephemeral, theirs, s.config().requiredFeatures()); err != nil {
 		return session.SecuredSession{}, err
 	}
 
 	tr.sessionStorage().Set(tr.conn.LocalAddr().String(), address, proxyAddr, ses)
 	MetricSuccessfulHandhshakes.Inc()
+	tr.hooks.sessionEstablished(tr.conn.LocalAddr().String(), address, proxyAddr, ses)
 
 	return ses, nil
 }
 
-func (s *Server) sendHelloFromServer(origMessage *CoAPMessage, myPublicKey []byte, addr string) ([]byte, error) {
-	var peerPublicKey []byte
-	message := newClientHelloMessage(origMessage, myPublicKey)
+func (s *Server) sendHelloFromServer(origMessage *CoAPMessage, ours keyExchange, addr string) (keyExchange, error) {
+	message := newClientHelloMessage(origMessage, ours.publicKey)
+	ours.addOptions(message)
 
 	respMsg, err := s.Send(message, addr)
 	if err != nil {
-		return nil, err
-	}
-
-	if respMsg == nil {
-		return nil, nil
-	}
-
-	optHandshake := respMsg.GetOption(OptionHandshakeType)
-	if optHandshake != nil {
-		if optHandshake.IntValue() == CoapHandshakeTypePeerHello {
-			peerPublicKey = respMsg.Payload.Bytes()
-		}
+		return keyExchange{}, err
 	}
 
-	if origMessage.BreakConnectionOnPK != nil {
-		if origMessage.BreakConnectionOnPK(peerPublicKey) {
-			return nil, errors.New(ERR_KEYS_NOT_MATCH)
-		}
-	}
-
-	return peerPublicKey, err
+	return readPeerHello(origMessage, respMsg)
 }
 
 // Serve запускает сервер на указанном соединении (например, если нужно использовать свой UDP-сервер)
@@ -516,8 +651,16 @@ func (s *Server) ServeMessage(message *CoAPMessage) {
 }
 
 func (s *Server) processLocalState(message *CoAPMessage, tr *transport) {
+	// ACK/RST на нотификации Observe не относятся ни к одному localState
+	if s.observe.handleReply(message, tr) {
+		return
+	}
+
 	id := message.Sender.String() + message.GetTokenString()
-	if _, dup := ProcessedMessages.Get(id); dup {
+	// Отмена и повторная регистрация Observe идут с токеном исходной подписки, но с
+	// новым MessageID, поэтому такие GET дедупер пропускает; ретрансмит того же
+	// MessageID отбрасывается, как и любой другой.
+	if mid, dup := ProcessedMessages.Get(id); dup && (!isObserveRequest(message) || mid == message.MessageID) {
 		return
 	}
 	fnIfase, _ := StorageLocalStates.LoadOrStore(id, MakeLocalStateFn(s, tr, nil))
@@ -531,27 +674,21 @@ func (s *Server) processLocalState(message *CoAPMessage, tr *transport) {
 }
 
 func (s *Server) addResource(res *CoAPResource) {
-	key := res.Path + fmt.Sprint(res.Method)
-	s.resources.Store(key, res)
+	s.routes.add(res)
 }
 
-func (s *Server) getResourceForPathAndMethod(path string, method CoapMethod) *CoAPResource {
-	path = strings.Trim(path, "/ ")
-	if res, ok := s.resources.Load("*" + fmt.Sprint(method)); ok {
-		return res.(*CoAPResource)
-	}
-	key := path + fmt.Sprint(method)
-	if res, ok := s.resources.Load(key); ok {
-		return res.(*CoAPResource)
-	}
-	return nil
+// matchResource ищет ресурс по шаблонам маршрутов (см. router.go) и возвращает
+// параметры пути, извлечённые из запроса.
+func (s *Server) matchResource(path string, method CoapMethod) (*CoAPResource, map[string]string) {
+	return s.routes.match(path, method)
 }
 
 func (s *Server) listenLoop() {
 	semaphore := make(chan struct{}, maxParallel)
+	mtu := s.config().mtu
 
 	for {
-		readBuf := make([]byte, MTU+1)
+		readBuf := make([]byte, mtu+1)
 		n, senderAddr, err := s.sr.conn.Listen(readBuf)
 		if err != nil {
 			if strings.Contains(err.Error(), "use of closed network connection") {
@@ -562,8 +699,8 @@ func (s *Server) listenLoop() {
 			continue
 		}
 
-		if n == 0 || n > MTU {
-			if n > MTU {
+		if n == 0 || n > mtu {
+			if n > mtu {
 				MetricMaxMTU.Inc()
 			}
 			continue
@@ -583,7 +720,8 @@ func (s *Server) listenLoop() {
 
 		semaphore <- struct{}{}
 
-		if message.GetOptionProxyURIasString() != "" {
+		// http(s) Proxy-Uri сервер обрабатывает сам, см. WithHTTPProxy
+		if _, local := httpProxyURL(message); !local && message.GetOptionProxyURIasString() != "" {
 			go func() {
 				// Слот семафора освобождается на ЛЮБОМ выходе: ранний return при ошибке
 				// парсинга/отправки иначе навсегда съедает слот, и после maxParallel
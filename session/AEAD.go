@@ -65,3 +65,23 @@ func makeNonce(iv []byte, counter uint16) []byte {
 	binary.LittleEndian.PutUint16(res[4:12], counter)
 	return res
 }
+
+// OpenSequence decrypts a message part sealed with SealSequence by the peer.
+func (aead *AEAD) OpenSequence(cipherText []byte, seq uint64, part byte, associatedData []byte) ([]byte, error) {
+	return aead.decrypter.Open(nil, makeSequenceNonce(aead.PeerIV, seq, part), cipherText, associatedData)
+}
+
+// SealSequence encrypts one part of a message under the session sequence number seq.
+// Each part of a message (payload, URI) uses its own part number, so no nonce is ever
+// used twice under the same key as long as seq is unique and below 2^48.
+func (aead *AEAD) SealSequence(plainText []byte, seq uint64, part byte, associatedData []byte) []byte {
+	return aead.encrypter.Seal(nil, makeSequenceNonce(aead.MyIV, seq, part), plainText, associatedData)
+}
+
+// makeSequenceNonce lays out the 12-byte nonce as IV (4) || seq (7, big endian) || part (1).
+func makeSequenceNonce(iv []byte, seq uint64, part byte) []byte {
+	res := make([]byte, 12)
+	copy(res[0:4], iv)
+	binary.BigEndian.PutUint64(res[4:12], seq<<8|uint64(part))
+	return res
+}
@@ -0,0 +1,66 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// pskConfirmationSize is the size of the key confirmation tag sent by the responder.
+const pskConfirmationSize = 16
+
+var ErrPSKConfirmation = errors.New("PSK: key confirmation failed")
+
+// NewPSKSession derives a session from a pre-shared key instead of an X25519 exchange.
+// The nonces of both sides form the HKDF salt, so every handshake yields new keys even
+// though the PSK stays the same; the identity is bound into the HKDF info. initiator
+// selects which half of the key material is used for sending.
+func NewPSKSession(psk []byte, identity string, clientNonce, serverNonce []byte, initiator bool) (session SecuredSession, err error) {
+	if len(psk) == 0 || len(clientNonce) != HandshakeNonceSize || len(serverNonce) != HandshakeNonceSize {
+		return session, errors.New("PSK: expected a key and two 32-byte nonces")
+	}
+
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	peerKey, myKey, peerIV, myIV, err := DeriveKeysFromSharedSecret(psk, salt, []byte("coala psk "+identity))
+	if err != nil {
+		return session, err
+	}
+	if initiator {
+		session.AEAD, err = NewAEAD(peerKey, myKey, peerIV, myIV)
+	} else {
+		session.AEAD, err = NewAEAD(myKey, peerKey, myIV, peerIV)
+	}
+	if err != nil {
+		return session, err
+	}
+
+	session.PSKIdentity = identity
+	session.seq = newSequenceState()
+	session.CreatedAt = int(time.Now().Unix())
+	return session, nil
+}
+
+// PSKConfirmation is the tag the responder returns to prove it holds the same PSK, so
+// the initiator detects a wrong key during the handshake rather than on the first
+// undecryptable message. The tag also covers the features the client offered and the
+// ones the responder negotiated (0 when a hello carried none), so features changed or
+// stripped on the way fail the handshake.
+func PSKConfirmation(psk []byte, identity string, clientNonce, serverNonce []byte, offered, features Features) []byte {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write([]byte("coala psk confirm " + identity))
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	binary.Write(mac, binary.BigEndian, uint32(offered))
+	binary.Write(mac, binary.BigEndian, uint32(features))
+	return mac.Sum(nil)[:pskConfirmationSize]
+}
+
+// VerifyPSKConfirmation checks a tag produced by PSKConfirmation.
+func VerifyPSKConfirmation(tag, psk []byte, identity string, clientNonce, serverNonce []byte, offered, features Features) error {
+	if !hmac.Equal(tag, PSKConfirmation(psk, identity, clientNonce, serverNonce, offered, features)) {
+		return ErrPSKConfirmation
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPSKSession(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	clientNonce, _ := NewHandshakeNonce()
+	serverNonce, _ := NewHandshakeNonce()
+
+	client, err := NewPSKSession(psk, "sensor-7", clientNonce, serverNonce, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewPSKSession(psk, "sensor-7", clientNonce, serverNonce, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := client.AEAD.SealSequence([]byte("hello"), 1, 0, nil)
+	if opened, err := server.AEAD.OpenSequence(sealed, 1, 0, nil); err != nil || !bytes.Equal(opened, []byte("hello")) {
+		t.Fatalf("OpenSequence() = %q, %v", opened, err)
+	}
+
+	// Same PSK, new nonces: new keys.
+	otherNonce, _ := NewHandshakeNonce()
+	next, _ := NewPSKSession(psk, "sensor-7", clientNonce, otherNonce, false)
+	if bytes.Equal(next.AEAD.PeerKey, server.AEAD.PeerKey) {
+		t.Fatal("sessions with different nonces share keys")
+	}
+
+	tag := PSKConfirmation(psk, "sensor-7", clientNonce, serverNonce, SupportedFeatures, SupportedFeatures)
+	if err := VerifyPSKConfirmation(tag, psk, "sensor-7", clientNonce, serverNonce, SupportedFeatures, SupportedFeatures); err != nil {
+		t.Fatalf("VerifyPSKConfirmation() error = %v", err)
+	}
+	if err := VerifyPSKConfirmation(tag, []byte("other key"), "sensor-7", clientNonce, serverNonce, SupportedFeatures, SupportedFeatures); err != ErrPSKConfirmation {
+		t.Fatalf("VerifyPSKConfirmation(wrong key) error = %v, want %v", err, ErrPSKConfirmation)
+	}
+	// The responder saw no features: they were stripped from the PSKClientHello.
+	if err := VerifyPSKConfirmation(PSKConfirmation(psk, "sensor-7", clientNonce, serverNonce, 0, 0), psk, "sensor-7", clientNonce, serverNonce, SupportedFeatures, 0); err != ErrPSKConfirmation {
+		t.Fatalf("VerifyPSKConfirmation(stripped features) error = %v, want %v", err, ErrPSKConfirmation)
+	}
+}
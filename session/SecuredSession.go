@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"errors"
+	"time"
 )
 
 type SecuredSession struct {
@@ -11,6 +12,20 @@ type SecuredSession struct {
 	AEAD          AEAD
 	PeerPublicKey []byte
 	UpdatedAt     int
+	// CreatedAt is the Unix time the session was created by the handshake.
+	CreatedAt int
+	// Features negotiated in the handshake that created the session.
+	Features Features
+	// PSKIdentity is the identity of the pre-shared key of a PSK session, "" for X25519 sessions.
+	PSKIdentity string
+
+	seq *sequenceState
+	// HKDF salt and info, see BindHandshake; nil for the legacy key schedule
+	salt, info []byte
+	// ephemeral key pair of this side and ephemeral public key of the peer, see
+	// BindEphemeral; cleared once the session keys are derived
+	ephemeral     *Curve25519
+	peerEphemeral []byte
 }
 
 func NewSecuredSession(privateKey []byte) (session SecuredSession, err error) {
@@ -23,6 +38,8 @@ func NewSecuredSession(privateKey []byte) (session SecuredSession, err error) {
 	if err != nil {
 		return session, err
 	}
+	session.seq = newSequenceState()
+	session.CreatedAt = int(time.Now().Unix())
 	return
 }
 
@@ -57,8 +74,7 @@ func (session *SecuredSession) Verify(peerSignature []byte) error {
 		return err2
 	}
 
-	// Generating Shared Secret based on: MyPrivateKey + PeerPublicKey
-	sharedSecret, err := session.Curve.GenerateSharedSecret(session.PeerPublicKey)
+	sharedSecret, err := session.sharedSecret(true)
 	if err != nil {
 		return err
 	}
@@ -71,7 +87,7 @@ func (session *SecuredSession) Verify(peerSignature []byte) error {
 
 	   var info []byte // Should be some public data
 	*/
-	peerKey, myKey, peerIV, myIV, err := DeriveKeysFromSharedSecret(sharedSecret, nil, nil)
+	peerKey, myKey, peerIV, myIV, err := DeriveKeysFromSharedSecret(sharedSecret, session.salt, session.info)
 	if err != nil {
 		return err
 	}
@@ -95,13 +111,12 @@ func (session *SecuredSession) PeerVerify(peerSignature []byte) error {
 		return err2
 	}
 
-	// Generating Shared Secret based on: MyPrivateKey + PeerPublicKey
-	sharedSecret, err := session.Curve.GenerateSharedSecret(session.PeerPublicKey)
+	sharedSecret, err := session.sharedSecret(false)
 	if err != nil {
 		return err
 	}
 
-	peerKey, myKey, peerIV, myIV, err := DeriveKeysFromSharedSecret(sharedSecret, nil, nil)
+	peerKey, myKey, peerIV, myIV, err := DeriveKeysFromSharedSecret(sharedSecret, session.salt, session.info)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,58 @@
+package session
+
+import "errors"
+
+// BindEphemeral makes Verify and PeerVerify derive the session keys from a hybrid
+// secret instead of the static X25519 secret alone:
+//
+//	ee || se || es || ss
+//
+// where e and s are the ephemeral and static keys of the initiator (first letter) and
+// of the responder (second letter). ee gives forward secrecy: the ephemeral private key
+// is discarded once the keys are derived, so a leaked static key does not decrypt
+// recorded sessions. se and es prove possession of the static keys, which remain the
+// identity of the peers (PeerPublicKey).
+func (session *SecuredSession) BindEphemeral(ephemeral Curve25519, peerEphemeralPublicKey []byte) {
+	session.ephemeral = &ephemeral
+	session.peerEphemeral = peerEphemeralPublicKey
+}
+
+// sharedSecret returns the input keying material for HKDF. initiator tells Verify
+// (the side that sent ClientHello) from PeerVerify.
+func (session *SecuredSession) sharedSecret(initiator bool) ([]byte, error) {
+	// Generating Shared Secret based on: MyPrivateKey + PeerPublicKey
+	ss, err := session.Curve.GenerateSharedSecret(session.PeerPublicKey)
+	if err != nil || session.ephemeral == nil {
+		return ss, err
+	}
+	if len(session.peerEphemeral) != KEY_SIZE {
+		return nil, errors.New("Curve25519: missing peer ephemeral key")
+	}
+
+	ee, err := session.ephemeral.GenerateSharedSecret(session.peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	myStaticPeerEphemeral, err := session.Curve.GenerateSharedSecret(session.peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	myEphemeralPeerStatic, err := session.ephemeral.GenerateSharedSecret(session.PeerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	se, es := myStaticPeerEphemeral, myEphemeralPeerStatic
+	if !initiator {
+		se, es = es, se
+	}
+
+	// The ephemeral private key is not needed any more.
+	session.ephemeral, session.peerEphemeral = nil, nil
+
+	secret := make([]byte, 0, 4*KEY_SIZE)
+	for _, part := range [][]byte{ee, se, es, ss} {
+		secret = append(secret, part...)
+	}
+	return secret, nil
+}
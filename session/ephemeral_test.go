@@ -0,0 +1,45 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBindEphemeralForwardSecrecy(t *testing.T) {
+	clientKey, serverKey := []byte("client-key"), []byte("server-key")
+	client, _ := NewSecuredSession(clientKey)
+	server, _ := NewSecuredSession(serverKey)
+	client.PeerPublicKey = server.Curve.GetPublicKey()
+	server.PeerPublicKey = client.Curve.GetPublicKey()
+
+	clientEphemeral, _ := NewCurve25519()
+	serverEphemeral, _ := NewCurve25519()
+	client.BindEphemeral(clientEphemeral, serverEphemeral.GetPublicKey())
+	server.BindEphemeral(serverEphemeral, clientEphemeral.GetPublicKey())
+
+	signature, _ := client.GetSignature()
+	if err := client.Verify(signature); err != nil {
+		t.Fatal(err)
+	}
+	signature, _ = server.GetSignature()
+	if err := server.PeerVerify(signature); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(client.AEAD.MyKey, server.AEAD.PeerKey) || !bytes.Equal(client.AEAD.PeerKey, server.AEAD.MyKey) {
+		t.Fatal("both sides derived different keys")
+	}
+	if client.ephemeral != nil || server.ephemeral != nil {
+		t.Fatal("ephemeral private key kept after the key derivation")
+	}
+
+	// An attacker holding both static keys and the recorded public keys.
+	leaked, _ := NewSecuredSession(clientKey)
+	leaked.PeerPublicKey = server.Curve.GetPublicKey()
+	signature, _ = leaked.GetSignature()
+	if err := leaked.Verify(signature); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(leaked.AEAD.MyKey, client.AEAD.MyKey) {
+		t.Fatal("static keys alone reproduce the session keys")
+	}
+}
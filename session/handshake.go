@@ -0,0 +1,45 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// HandshakeNonceSize is the size of the random nonce each side contributes to a handshake.
+const HandshakeNonceSize = 32
+
+// NewHandshakeNonce returns a fresh random handshake nonce.
+func NewHandshakeNonce() ([]byte, error) {
+	nonce := make([]byte, HandshakeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// HandshakeTranscript hashes what both sides of an X25519 handshake sent: the public
+// keys, the nonces, the features the client offered and the ones negotiated. Used as
+// HKDF info, it ties the session keys to this exact exchange, so a hello whose features
+// were changed on the way gives the two sides different keys.
+func HandshakeTranscript(clientPublicKey, serverPublicKey, clientNonce, serverNonce []byte, offered, features Features) []byte {
+	h := sha256.New()
+	h.Write([]byte("coala handshake"))
+	for _, part := range [][]byte{clientPublicKey, serverPublicKey, clientNonce, serverNonce} {
+		binary.Write(h, binary.BigEndian, uint16(len(part)))
+		h.Write(part)
+	}
+	binary.Write(h, binary.BigEndian, uint32(offered))
+	binary.Write(h, binary.BigEndian, uint32(features))
+	return h.Sum(nil)
+}
+
+// BindHandshake makes Verify and PeerVerify derive the session keys with the nonces of
+// both sides as HKDF salt and the transcript hash as HKDF info, instead of deriving them
+// from the shared secret alone. Two peers with static keys then still get new keys for
+// every session. Without FeatureHandshakeNonce the nonces are nil and only the
+// transcript is bound.
+func (session *SecuredSession) BindHandshake(clientNonce, serverNonce, transcript []byte) {
+	session.salt = append(append([]byte{}, clientNonce...), serverNonce...)
+	session.info = transcript
+}
@@ -0,0 +1,40 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBindHandshakeGivesFreshKeys(t *testing.T) {
+	establish := func(bind bool) SecuredSession {
+		client, _ := NewSecuredSession([]byte("client-key"))
+		server, _ := NewSecuredSession([]byte("server-key"))
+		client.PeerPublicKey = server.Curve.GetPublicKey()
+		if bind {
+			clientNonce, _ := NewHandshakeNonce()
+			serverNonce, _ := NewHandshakeNonce()
+			transcript := HandshakeTranscript(client.Curve.GetPublicKey(), server.Curve.GetPublicKey(), clientNonce, serverNonce, SupportedFeatures, SupportedFeatures)
+			client.BindHandshake(clientNonce, serverNonce, transcript)
+		}
+		signature, _ := client.GetSignature()
+		if err := client.Verify(signature); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	if a, b := establish(false), establish(false); !bytes.Equal(a.AEAD.MyKey, b.AEAD.MyKey) {
+		t.Fatal("legacy key schedule is expected to repeat keys for static peers")
+	}
+	if a, b := establish(true), establish(true); bytes.Equal(a.AEAD.MyKey, b.AEAD.MyKey) || bytes.Equal(a.AEAD.MyIV, b.AEAD.MyIV) {
+		t.Fatal("sessions with fresh nonces share keys")
+	}
+
+	nonce := bytes.Repeat([]byte{1}, HandshakeNonceSize)
+	if bytes.Equal(HandshakeTranscript(nil, nil, nonce, nonce, SupportedFeatures, FeatureSequenceNonce), HandshakeTranscript(nil, nil, nonce, nonce, SupportedFeatures, SupportedFeatures)) {
+		t.Fatal("transcript does not cover the negotiated features")
+	}
+	if bytes.Equal(HandshakeTranscript(nil, nil, nonce, nonce, 0, 0), HandshakeTranscript(nil, nil, nonce, nonce, SupportedFeatures, 0)) {
+		t.Fatal("transcript does not cover the offered features")
+	}
+}
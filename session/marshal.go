@@ -0,0 +1,113 @@
+package session
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const marshalVersion = 1
+
+// RestoredSequenceGap is how far the send sequence of an unmarshalled session jumps
+// ahead of the saved value. Messages sealed after the state was saved thus never reuse
+// a nonce, as long as fewer than RestoredSequenceGap of them were sent.
+const RestoredSequenceGap = 1 << 32
+
+var ErrInvalidSessionData = errors.New("session: invalid serialized session")
+
+// MarshalBinary serializes what is needed to continue the session after a restart: the
+// AEAD keys and IVs, the peer key, the negotiated features and the sequence state. The
+// key pair of the handshake is not kept. The result holds the session keys in clear and
+// must be stored encrypted.
+func (session SecuredSession) MarshalBinary() ([]byte, error) {
+	b := []byte{marshalVersion}
+	b = binary.BigEndian.AppendUint32(b, uint32(session.Features))
+	b = binary.BigEndian.AppendUint64(b, uint64(session.CreatedAt))
+	b = binary.BigEndian.AppendUint64(b, uint64(session.UpdatedAt))
+
+	var state sequenceState
+	if s := session.seq; s != nil {
+		s.mx.Lock()
+		state.sent, state.top, state.window, state.messages = s.sent, s.top, s.window, s.messages
+		s.mx.Unlock()
+	}
+	b = binary.BigEndian.AppendUint64(b, state.sent)
+	b = binary.BigEndian.AppendUint64(b, state.top)
+	b = binary.BigEndian.AppendUint64(b, state.messages)
+	for _, word := range state.window {
+		b = binary.BigEndian.AppendUint64(b, word)
+	}
+
+	for _, field := range [][]byte{
+		session.AEAD.PeerKey, session.AEAD.MyKey, session.AEAD.PeerIV, session.AEAD.MyIV,
+		session.PeerPublicKey, []byte(session.PSKIdentity),
+	} {
+		if len(field) > math.MaxUint16 {
+			return nil, ErrInvalidSessionData
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(field)))
+		b = append(b, field...)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary restores a session serialized by MarshalBinary. The send sequence
+// resumes RestoredSequenceGap past the saved one; the caller has to persist the
+// restored session before it seals, or a second restore resumes at the same number. The replay window is restored as
+// saved, so messages received after MarshalBinary are accepted again.
+func (session *SecuredSession) UnmarshalBinary(data []byte) error {
+	r := sessionReader{data: data}
+	if r.byte() != marshalVersion {
+		return ErrInvalidSessionData
+	}
+	restored := SecuredSession{seq: newSequenceState()}
+	restored.Features = Features(r.uint32())
+	restored.CreatedAt = int(r.uint64())
+	restored.UpdatedAt = int(r.uint64())
+
+	s := restored.seq
+	s.sent, s.top, s.messages = r.uint64(), r.uint64(), r.uint64()
+	for i := range s.window {
+		s.window[i] = r.uint64()
+	}
+	// Also when nothing was sent: messages may have been sealed after the save
+	s.sent += RestoredSequenceGap
+
+	peerKey, myKey, peerIV, myIV := r.field(), r.field(), r.field(), r.field()
+	restored.PeerPublicKey = r.field()
+	restored.PSKIdentity = string(r.field())
+	if r.err || len(r.data) != 0 {
+		return ErrInvalidSessionData
+	}
+
+	var err error
+	if restored.AEAD, err = NewAEAD(peerKey, myKey, peerIV, myIV); err != nil {
+		return err
+	}
+	*session = restored
+	return nil
+}
+
+// sessionReader decodes MarshalBinary output; a short read sets err.
+type sessionReader struct {
+	data []byte
+	err  bool
+}
+
+func (r *sessionReader) next(n int) []byte {
+	if r.err || len(r.data) < n {
+		r.err = true
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *sessionReader) byte() byte     { return r.next(1)[0] }
+func (r *sessionReader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *sessionReader) uint64() uint64 { return binary.BigEndian.Uint64(r.next(8)) }
+func (r *sessionReader) field() []byte {
+	n := int(binary.BigEndian.Uint16(r.next(2)))
+	return append([]byte(nil), r.next(n)...)
+}
@@ -0,0 +1,51 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMarshalBinaryRoundTrip(t *testing.T) {
+	client, _ := NewSecuredSession(nil)
+	server, _ := NewSecuredSession(nil)
+	client.PeerPublicKey = server.Curve.GetPublicKey()
+	server.PeerPublicKey = client.Curve.GetPublicKey()
+	signature, _ := client.GetSignature()
+	if err := client.Verify(signature); err != nil {
+		t.Fatal(err)
+	}
+	signature, _ = server.GetSignature()
+	if err := server.PeerVerify(signature); err != nil {
+		t.Fatal(err)
+	}
+	server.Features, server.PSKIdentity = SupportedFeatures, "sensor-7"
+	sent, _ := server.NextSequence()
+	server.AcceptSequence(5)
+
+	data, err := server.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored SecuredSession
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	if restored.Features != server.Features || restored.PSKIdentity != "sensor-7" || !bytes.Equal(restored.PeerPublicKey, server.PeerPublicKey) {
+		t.Fatalf("restored session = %+v", restored)
+	}
+
+	sealed := client.AEAD.SealSequence([]byte("hello"), 6, 0, nil)
+	if plain, err := restored.AEAD.OpenSequence(sealed, 6, 0, nil); err != nil || string(plain) != "hello" {
+		t.Fatalf("restored session cannot open: %q, %v", plain, err)
+	}
+	if restored.CheckSequence(5) != ErrReplayedSequence {
+		t.Fatal("replay window was not restored")
+	}
+	if next, _ := restored.NextSequence(); next <= sent+RestoredSequenceGap {
+		t.Fatalf("NextSequence() after restore = %d, want past %d", next, sent+RestoredSequenceGap)
+	}
+
+	if err := restored.UnmarshalBinary(data[:len(data)-1]); err != ErrInvalidSessionData {
+		t.Fatalf("UnmarshalBinary(truncated) error = %v, want %v", err, ErrInvalidSessionData)
+	}
+}
@@ -0,0 +1,85 @@
+package session
+
+import (
+	"errors"
+	"time"
+)
+
+// MessageIDLifetime is how long a legacy session takes a repeated message ID for a
+// retransmission. It is EXCHANGE_LIFETIME of RFC 7252, the time within which a sender
+// does not reuse a message ID for the same peer. Sessions with FeatureSequenceNonce use
+// the sequence window instead.
+const MessageIDLifetime = 247 * time.Second
+
+var (
+	ErrReplayedMessageID = errors.New("replayed message ID")
+	// ErrMessageIDReused is reported for a message ID received in the session longer
+	// than MessageIDLifetime ago: a replay, or a peer that reused the ID and with it
+	// the nonce. Either way the session must not be used any more.
+	ErrMessageIDReused = errors.New("message ID reused in the session")
+)
+
+// messageIDKey tells the message IDs of the two senders apart: acknowledgements carry
+// an ID chosen by the receiver, all other messages one chosen by the peer.
+func messageIDKey(id uint16, ack bool) uint32 {
+	if ack {
+		return 1<<16 | uint32(id)
+	}
+	return uint32(id)
+}
+
+// CheckMessageID reports ErrReplayedMessageID when a message with the ID was received in
+// the session within MessageIDLifetime, and ErrMessageIDReused when it was received
+// before. It protects sessions without FeatureSequenceNonce, whose nonces are derived
+// from the message ID, for their whole lifetime. It does not record id, see
+// AcceptMessageID.
+func (session *SecuredSession) CheckMessageID(id uint16, ack bool) error {
+	s := session.seq
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.checkMessageID(messageIDKey(id, ack), time.Now())
+}
+
+// AcceptMessageID records id as received. Call it only after the message has been
+// authenticated.
+func (session *SecuredSession) AcceptMessageID(id uint16, ack bool) error {
+	s := session.seq
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := time.Now()
+	key := messageIDKey(id, ack)
+	if err := s.checkMessageID(key, now); err != nil {
+		return err
+	}
+	if s.messageIDs == nil {
+		s.messageIDs = make(map[uint32]time.Time)
+	}
+	if now.After(s.messageIDsPurge) {
+		for k, at := range s.messageIDs {
+			if now.Sub(at) >= MessageIDLifetime {
+				if s.usedMessageIDs == nil {
+					s.usedMessageIDs = new([1 << 17 / 64]uint64)
+				}
+				s.usedMessageIDs[k/64] |= 1 << (k % 64)
+				delete(s.messageIDs, k)
+			}
+		}
+		s.messageIDsPurge = now.Add(MessageIDLifetime / 4)
+	}
+	s.messageIDs[key] = now
+	return nil
+}
+
+func (s *sequenceState) checkMessageID(key uint32, now time.Time) error {
+	if at, ok := s.messageIDs[key]; ok {
+		if now.Sub(at) < MessageIDLifetime {
+			return ErrReplayedMessageID
+		}
+		return ErrMessageIDReused
+	}
+	if s.usedMessageIDs != nil && s.usedMessageIDs[key/64]&(1<<(key%64)) != 0 {
+		return ErrMessageIDReused
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageIDReplay(t *testing.T) {
+	ses, _ := NewSecuredSession(nil)
+	copied := ses
+
+	steps := []struct {
+		id   uint16
+		ack  bool
+		want error
+	}{
+		{42, false, nil},
+		{42, false, ErrReplayedMessageID},
+		{42, true, nil}, // our own message ID, acknowledged by the peer
+		{42, true, ErrReplayedMessageID},
+		{43, false, nil},
+	}
+	for i, step := range steps {
+		if err := ses.CheckMessageID(step.id, step.ack); err != step.want {
+			t.Fatalf("step %d: CheckMessageID(%d) = %v, want %v", i, step.id, err, step.want)
+		}
+		if err := copied.AcceptMessageID(step.id, step.ack); err != step.want {
+			t.Fatalf("step %d: AcceptMessageID(%d) = %v, want %v", i, step.id, err, step.want)
+		}
+	}
+
+	// A message ID is never accepted again in the session, also after the lifetime:
+	// within it, a repeat is a retransmission, later it is a replay or a reused nonce.
+	ses.seq.messageIDs[messageIDKey(42, false)] = time.Now().Add(-MessageIDLifetime)
+	if err := ses.CheckMessageID(42, false); err != ErrMessageIDReused {
+		t.Fatalf("CheckMessageID() after the lifetime = %v, want %v", err, ErrMessageIDReused)
+	}
+	ses.seq.messageIDsPurge = time.Time{}
+	if err := ses.AcceptMessageID(44, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ses.seq.messageIDs[messageIDKey(42, false)]; ok {
+		t.Fatal("message ID older than the lifetime was not purged")
+	}
+	if err := ses.AcceptMessageID(42, false); err != ErrMessageIDReused {
+		t.Fatalf("AcceptMessageID() after the purge = %v, want %v", err, ErrMessageIDReused)
+	}
+	if err := ses.CheckMessageID(43, true); err != nil {
+		t.Fatalf("CheckMessageID() of a new acknowledgement = %v", err)
+	}
+}
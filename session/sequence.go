@@ -0,0 +1,208 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Features is a bit set of protocol revisions negotiated in the coaps handshake. The
+// client offers the features it supports in ClientHello and the peer answers with the
+// subset it supports as well. Peers that do not send the option (older releases)
+// negotiate no features and keep the legacy behaviour.
+type Features uint32
+
+const (
+	// FeatureSequenceNonce derives AEAD nonces from a per-session 48-bit send sequence
+	// number carried in every message instead of the 16-bit CoAP MessageID, and rejects
+	// replayed sequence numbers on receive.
+	FeatureSequenceNonce Features = 1 << iota
+	// FeatureAuthenticatedHeader binds the CoAP header (type, code, message ID, token)
+	// and the options that proxies do not rewrite into the AEAD associated data, so
+	// tampering with any of them makes decryption fail.
+	FeatureAuthenticatedHeader
+	// FeatureHandshakeNonce marks the revised X25519 key schedule: both hellos carry a
+	// random nonce, and the session keys are derived with the nonces as HKDF salt and the
+	// handshake transcript hash as HKDF info (see BindHandshake).
+	FeatureHandshakeNonce
+	// FeatureEphemeralKey adds an ephemeral X25519 key of each side to the handshake for
+	// forward secrecy; the static keys only authenticate the peers (see BindEphemeral).
+	FeatureEphemeralKey
+)
+
+// SupportedFeatures is the set of features offered in handshakes.
+const SupportedFeatures = FeatureSequenceNonce | FeatureAuthenticatedHeader | FeatureHandshakeNonce | FeatureEphemeralKey
+
+// Has reports whether all bits of feature are set.
+func (f Features) Has(feature Features) bool {
+	return f&feature == feature
+}
+
+// ReplayWindowSize is the number of sequence numbers below the highest one received
+// that are still accepted (once each) to tolerate reordering.
+const ReplayWindowSize = 1024
+
+// DefaultSequenceLimit is the number of sequence numbers a session may use in one
+// direction. Sessions are renegotiated once NeedsRekey reports three quarters of it as
+// used; encryption fails with ErrSequenceExhausted at the limit itself.
+const DefaultSequenceLimit uint64 = 1 << 48
+
+var sequenceLimit atomic.Uint64
+
+func init() {
+	sequenceLimit.Store(DefaultSequenceLimit)
+}
+
+// SetSequenceLimit lowers the sequence limit of all sessions and returns the previous
+// one. It exists to exercise rekeying in tests; limits above DefaultSequenceLimit are
+// capped since sequence numbers are carried in 48 bits.
+func SetSequenceLimit(limit uint64) uint64 {
+	return sequenceLimit.Swap(min(limit, DefaultSequenceLimit))
+}
+
+var (
+	ErrReplayedSequence  = errors.New("replayed or outdated sequence number")
+	ErrSequenceExhausted = errors.New("session sequence numbers exhausted")
+)
+
+// sequenceState is shared by all copies of a SecuredSession: sessions are stored and
+// passed around by value.
+type sequenceState struct {
+	mx     sync.Mutex
+	sent   uint64                        // last sequence number used for sending, 0 = none
+	top    uint64                        // highest sequence number received, 0 = none
+	window [ReplayWindowSize / 64]uint64 // bit i set: top-i was received
+
+	messages uint64 // messages sealed or opened, see CountMessage
+
+	// Legacy sessions only, see AcceptMessageID
+	messageIDs      map[uint32]time.Time  // message ID key -> time received, within MessageIDLifetime
+	messageIDsPurge time.Time             // next time to move older IDs to usedMessageIDs
+	usedMessageIDs  *[1 << 17 / 64]uint64 // bit set: ID key received before MessageIDLifetime
+}
+
+func newSequenceState() *sequenceState {
+	return new(sequenceState)
+}
+
+// NextSequence reserves the next send sequence number, starting from 1.
+func (session *SecuredSession) NextSequence() (uint64, error) {
+	s := session.seq
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.sent+1 >= sequenceLimit.Load() {
+		return 0, ErrSequenceExhausted
+	}
+	s.sent++
+	return s.sent, nil
+}
+
+// SentSequence returns the last send sequence number reserved by NextSequence.
+func (session *SecuredSession) SentSequence() uint64 {
+	if session.seq == nil {
+		return 0
+	}
+	s := session.seq
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.sent
+}
+
+// CheckSequence reports ErrReplayedSequence when seq was already received or is too
+// old for the replay window. It does not record seq, see AcceptSequence.
+func (session *SecuredSession) CheckSequence(seq uint64) error {
+	s := session.seq
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.check(seq)
+}
+
+// AcceptSequence records seq as received. Call it only after the message carrying seq
+// has been authenticated, so forged sequence numbers cannot advance the window.
+func (session *SecuredSession) AcceptSequence(seq uint64) error {
+	s := session.seq
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.check(seq); err != nil {
+		return err
+	}
+
+	if seq > s.top {
+		s.shift(seq - s.top)
+		s.top = seq
+	}
+	offset := s.top - seq
+	s.window[offset/64] |= 1 << (offset % 64)
+	return nil
+}
+
+// NeedsRekey reports whether either direction of the session has used three quarters
+// of the sequence limit. The handshake initiator then negotiates a new session, leaving the
+// rest as headroom for messages already in flight.
+func (session *SecuredSession) NeedsRekey() bool {
+	if session.seq == nil {
+		return false
+	}
+	s := session.seq
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	threshold := sequenceLimit.Load() / 4 * 3
+	return s.sent >= threshold || s.top >= threshold
+}
+
+// CountMessage records that a message was sealed or opened with the session keys, in
+// either mode. It drives the message limit of WithRekeyAfter.
+func (session *SecuredSession) CountMessage() {
+	if session.seq == nil {
+		return
+	}
+	s := session.seq
+	s.mx.Lock()
+	s.messages++
+	s.mx.Unlock()
+}
+
+// Messages returns the number of messages counted by CountMessage.
+func (session *SecuredSession) Messages() uint64 {
+	if session.seq == nil {
+		return 0
+	}
+	s := session.seq
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.messages
+}
+
+func (s *sequenceState) check(seq uint64) error {
+	if seq == 0 || seq >= sequenceLimit.Load() {
+		return ErrReplayedSequence
+	}
+	if seq > s.top {
+		return nil
+	}
+	offset := s.top - seq
+	if offset >= ReplayWindowSize || s.window[offset/64]&(1<<(offset%64)) != 0 {
+		return ErrReplayedSequence
+	}
+	return nil
+}
+
+// shift moves the window up by n positions.
+func (s *sequenceState) shift(n uint64) {
+	if n >= ReplayWindowSize {
+		s.window = [ReplayWindowSize / 64]uint64{}
+		return
+	}
+	words, bits := int(n/64), n%64
+	for i := len(s.window) - 1; i >= 0; i-- {
+		var v uint64
+		if i-words >= 0 {
+			v = s.window[i-words] << bits
+			if bits > 0 && i-words-1 >= 0 {
+				v |= s.window[i-words-1] >> (64 - bits)
+			}
+		}
+		s.window[i] = v
+	}
+}
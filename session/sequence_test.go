@@ -0,0 +1,110 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSequenceReplayWindow(t *testing.T) {
+	ses, err := NewSecuredSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		seq  uint64
+		want error
+	}{
+		{0, ErrReplayedSequence},
+		{1, nil},
+		{1, ErrReplayedSequence},
+		{5, nil},
+		{3, nil}, // reordered, inside the window
+		{3, ErrReplayedSequence},
+		{2, nil},
+		{5, ErrReplayedSequence},
+		{5 + ReplayWindowSize + 70, nil},
+		{5 + 71, nil}, // oldest position still in the window
+		{5 + 70, ErrReplayedSequence},
+		{4, ErrReplayedSequence}, // fell out of the window
+		{DefaultSequenceLimit, ErrReplayedSequence},
+	}
+	for i, step := range steps {
+		if err := ses.CheckSequence(step.seq); err != step.want {
+			t.Fatalf("step %d: CheckSequence(%d) = %v, want %v", i, step.seq, err, step.want)
+		}
+		if err := ses.AcceptSequence(step.seq); err != step.want {
+			t.Fatalf("step %d: AcceptSequence(%d) = %v, want %v", i, step.seq, err, step.want)
+		}
+	}
+}
+
+func TestSequenceWindowShift(t *testing.T) {
+	ses, _ := NewSecuredSession(nil)
+	for _, seq := range []uint64{10, 9, 100} {
+		if err := ses.AcceptSequence(seq); err != nil {
+			t.Fatalf("AcceptSequence(%d) = %v", seq, err)
+		}
+	}
+	// 9 and 10 moved across a word boundary of the bitmap and stay marked.
+	for _, seq := range []uint64{9, 10, 100} {
+		if err := ses.CheckSequence(seq); err != ErrReplayedSequence {
+			t.Errorf("CheckSequence(%d) = %v, want %v", seq, err, ErrReplayedSequence)
+		}
+	}
+	for _, seq := range []uint64{8, 11, 99} {
+		if err := ses.CheckSequence(seq); err != nil {
+			t.Errorf("CheckSequence(%d) = %v, want nil", seq, err)
+		}
+	}
+}
+
+func TestNextSequenceAndRekey(t *testing.T) {
+	defer SetSequenceLimit(SetSequenceLimit(8))
+
+	ses, _ := NewSecuredSession(nil)
+	copied := ses // sessions are stored by value, the counter is shared
+
+	for want := uint64(1); want < 8; want++ {
+		if ses.NeedsRekey() != (want > 6) {
+			t.Fatalf("NeedsRekey() before seq %d = %v", want, ses.NeedsRekey())
+		}
+		seq, err := copied.NextSequence()
+		if err != nil || seq != want {
+			t.Fatalf("NextSequence() = %d, %v, want %d", seq, err, want)
+		}
+		copied, ses = ses, copied
+	}
+	if _, err := ses.NextSequence(); err != ErrSequenceExhausted {
+		t.Fatalf("NextSequence() error = %v, want %v", err, ErrSequenceExhausted)
+	}
+}
+
+func TestSealSequenceUsesDistinctNonces(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, 16)
+	iv := []byte{1, 2, 3, 4}
+	aead, err := NewAEAD(key, key, iv, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := []byte("same plaintext!!")
+	seen := make(map[string]bool)
+	for _, seq := range []uint64{1, 2, 1 << 16, 1<<16 + 1, 1<<48 - 1} {
+		for _, part := range []byte{0, 1} {
+			sealed := aead.SealSequence(plain, seq, part, nil)
+			if seen[string(sealed)] {
+				t.Fatalf("seq %d part %d repeats a ciphertext", seq, part)
+			}
+			seen[string(sealed)] = true
+
+			opened, err := aead.OpenSequence(sealed, seq, part, nil)
+			if err != nil || !bytes.Equal(opened, plain) {
+				t.Fatalf("OpenSequence(seq %d, part %d) = %q, %v", seq, part, opened, err)
+			}
+			if _, err := aead.OpenSequence(sealed, seq, part^1, nil); err == nil {
+				t.Fatalf("OpenSequence accepted seq %d with the wrong part", seq)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package coalago
+
+import (
+	"net"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+// WithRekeyAfter makes the Client (or Server) replace a coaps session it initiated by
+// a new handshake once the session has carried messages messages or is older than
+// interval; zero disables either limit. The limits are checked before each request, so
+// a transfer in progress is not interrupted. The responder keeps its session until the
+// new ClientHello replaces it.
+func WithRekeyAfter(messages int, interval time.Duration) Opt {
+	return func(opts *coalaopts) {
+		opts.rekeyMessages = max(messages, 0)
+		opts.rekeyInterval = max(interval, 0)
+	}
+}
+
+// needsRekey reports whether the handshake initiator has to negotiate a new session
+// instead of using ses.
+func (opts *coalaopts) needsRekey(ses session.SecuredSession) bool {
+	if ses.NeedsRekey() {
+		return true
+	}
+	if opts.rekeyMessages > 0 && ses.Messages() >= uint64(opts.rekeyMessages) {
+		return true
+	}
+	return opts.rekeyInterval > 0 && time.Since(time.Unix(int64(ses.CreatedAt), 0)) >= opts.rekeyInterval
+}
+
+// CloseSession drops the coaps session with peer and tells peer to drop its end too,
+// so the next exchange starts with a new handshake. That is also how the keys of a
+// session are rotated on demand. It returns nil when there is no session with peer; an
+// error means peer did not confirm, the local end is dropped anyway.
+func (s *Server) CloseSession(peer string) error {
+	resolved, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		return err
+	}
+	peer = resolved.String()
+
+	tr := s.sr
+	if conn, ok := s.tcpConnections().GetTCP(peer); ok {
+		tr = s.newServerTransport(&tcpConnection{conn: conn.(*net.TCPConn)})
+	}
+	localAddr := tr.conn.LocalAddr().String()
+	ses, ok := getSessionForAddress(tr, localAddr, peer, "")
+	if !ok {
+		return nil
+	}
+	defer deleteSessionForAddress(tr, localAddr, peer, "")
+
+	if !ses.Features.Has(session.FeatureAuthenticatedHeader) {
+		// Legacy peers do not know control messages, their session expires with the TTL
+		return nil
+	}
+	_, err = s.send(newSessionControlMessage(), peer)
+	return err
+}
+
+// CloseSession discards the coaps sessions the Client holds with addr, so the next
+// request to addr starts with a new handshake. The session of the socket the client
+// keeps open to addr is ended on the server too, as with Server.CloseSession; an error
+// means the server did not confirm, the local end is dropped anyway. Clients without
+// their own WithSessionTTL share the sessions of the process.
+func (c *Client) CloseSession(addr string) error {
+	resolved, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	peer := resolved.String()
+	err = c.endSession(peer)
+
+	sessions := c.sessions
+	if sessions == nil {
+		sessions = globalSessions
+	}
+	sessions.DeletePeer(peer)
+	return err
+}
+
+// endSession sends Close over the socket of the client to peer. Nothing is sent
+// without an open socket or a session on it.
+func (c *Client) endSession(peer string) error {
+	conn, ok := c.pool.openShared(peer)
+	if !ok {
+		return nil
+	}
+	defer conn.Close()
+
+	tr := c.newTransport(conn)
+	ses, ok := getSessionForAddress(tr, conn.LocalAddr().String(), peer, "")
+	if !ok || !ses.Features.Has(session.FeatureAuthenticatedHeader) {
+		// Legacy peers do not know control messages, their session expires with the TTL
+		return nil
+	}
+	message := newSessionControlMessage()
+	c.applyAckTimeout(message)
+	_, err := tr.Send(message)
+	return err
+}
+
+// receiveControl handles a datagram to a socket of the client that no exchange
+// waits for: a Close the server sends over the session of that socket. Other
+// datagrams are dropped.
+func (c *Client) receiveControl(conn Transport, data []byte) {
+	defer conn.Close()
+	message, err := Deserialize(data)
+	if err != nil || message == nil || message.Type != CON {
+		return
+	}
+	if option := message.GetOption(OptionHandshakeType); option == nil || !isSessionControl(option.IntValue()) {
+		return
+	}
+	message.Sender = conn.RemoteAddr()
+	securityInputLayer(c.newTransport(conn), message, "")
+}
+
+func isSessionControl(handshakeType int) bool {
+	return handshakeType == CoapHandshakeTypeClose
+}
+
+// newSessionControlMessage builds a Close message. It is sent over the session it
+// refers to, so only the peer holding the session keys can end it.
+func newSessionControlMessage() *CoAPMessage {
+	message := NewCoAPMessage(CON, POST)
+	message.SetSchemeCOAPS()
+	message.AddOption(OptionHandshakeType, CoapHandshakeTypeClose)
+	return message
+}
+
+// receiveSessionControl drops the session a decrypted Close message arrived on and
+// confirms it with an ACK sealed in that session, so the confirmation cannot be forged.
+func receiveSessionControl(tr *transport, message *CoAPMessage, ses session.SecuredSession, proxyAddr string) error {
+	if !ses.Features.Has(session.FeatureAuthenticatedHeader) {
+		// The handshake type option could have been added to a recorded message
+		return ErrorHandshake
+	}
+	defer deleteSessionForAddress(tr, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+
+	reply := NewCoAPMessageId(ACK, CoapCodeDeleted, message.MessageID)
+	reply.Token = message.Token
+	reply.SetSchemeCOAPS()
+	reply.CloneOptions(message, OptionProxySecurityID)
+	reply.ProxyAddr = message.ProxyAddr
+	if _, err := tr.SendTo(reply, message.Sender); err != nil {
+		return err
+	}
+	return ErrorSessionClosed
+}
@@ -0,0 +1,148 @@
+package coalago
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+// newPeerServers starts two servers; a sends coaps requests to b from its listening socket.
+func newPeerServers(t *testing.T, opts ...Opt) (a, b *Server, aAddr, bAddr string) {
+	t.Helper()
+	a, b = NewServer(opts...), NewServer()
+	b.GET("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	})
+	return a, b, startTestServer(t, a), startTestServer(t, b)
+}
+
+func secureGET(t *testing.T, s *Server, addr string) {
+	t.Helper()
+	message := NewCoAPMessage(CON, GET)
+	message.SetSchemeCOAPS()
+	message.SetURIPath("/secure")
+	resp, err := s.Send(message, addr)
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if resp.Payload.String() != "ok" {
+		t.Fatalf("Send() = %q", resp.Payload.String())
+	}
+}
+
+func TestServerCloseSession(t *testing.T) {
+	a, b, aAddr, bAddr := newPeerServers(t)
+	secureGET(t, a, bAddr)
+	if _, ok := b.sessions.Get(bAddr, aAddr, ""); !ok {
+		t.Fatal("no session after the first request")
+	}
+
+	if err := a.CloseSession(bAddr); err != nil {
+		t.Fatalf("CloseSession() error = %v", err)
+	}
+	if _, ok := a.sessions.Get(aAddr, bAddr, ""); ok {
+		t.Fatal("CloseSession() kept the local session")
+	}
+	if _, ok := b.sessions.Get(bAddr, aAddr, ""); ok {
+		t.Fatal("peer kept its session after Close")
+	}
+	if err := a.CloseSession(bAddr); err != nil {
+		t.Fatalf("CloseSession() without a session error = %v", err)
+	}
+
+	handshakes := MetricSuccessfulHandhshakes.Val()
+	secureGET(t, a, bAddr)
+	if MetricSuccessfulHandhshakes.Val() == handshakes {
+		t.Fatal("request after CloseSession() reused the closed session")
+	}
+
+	// The responder rotates the keys by closing the session of the initiator.
+	old, _ := a.sessions.Get(aAddr, bAddr, "")
+	if err := b.CloseSession(aAddr); err != nil {
+		t.Fatalf("CloseSession() by the responder error = %v", err)
+	}
+	if _, ok := a.sessions.Get(aAddr, bAddr, ""); ok {
+		t.Fatal("initiator kept its session after Close")
+	}
+	secureGET(t, a, bAddr)
+	if ses, _ := a.sessions.Get(aAddr, bAddr, ""); bytes.Equal(ses.AEAD.MyKey, old.AEAD.MyKey) {
+		t.Fatal("session after Close kept the old keys")
+	}
+}
+
+func TestRekeyAfterMessages(t *testing.T) {
+	a, _, _, bAddr := newPeerServers(t, WithRekeyAfter(4, 0))
+
+	handshakes := MetricSuccessfulHandhshakes.Val()
+	for i := 0; i < 6; i++ {
+		secureGET(t, a, bAddr)
+	}
+	// Each request seals one message and opens one, so the session is replaced after
+	// every second request: three sessions, each counted by both servers.
+	if got := MetricSuccessfulHandhshakes.Val() - handshakes; got != 6 {
+		t.Fatalf("handshakes = %d, want 6", got)
+	}
+}
+
+func TestNeedsRekeyInterval(t *testing.T) {
+	ses, _ := newSessionPair(t, session.SupportedFeatures)
+	if newCoalaopts(WithRekeyAfter(0, time.Hour)).needsRekey(ses) {
+		t.Fatal("new session needs a rekey")
+	}
+	ses.CreatedAt -= 3600
+	if !newCoalaopts(WithRekeyAfter(0, time.Hour)).needsRekey(ses) {
+		t.Fatal("session older than the interval does not need a rekey")
+	}
+	if newCoalaopts().needsRekey(ses) {
+		t.Fatal("rekey without WithRekeyAfter")
+	}
+}
+
+func TestClientCloseSession(t *testing.T) {
+	_, b, _, bAddr := newPeerServers(t)
+	client := NewClient(WithSessionTTL(time.Minute))
+	if _, err := client.GET("coaps://" + bAddr + "/secure"); err != nil {
+		t.Fatalf("GET() error = %v", err)
+	}
+	if client.sessions.ItemCount() != 1 || b.sessions.ItemCount() != 1 {
+		t.Fatalf("sessions = %d on the client, %d on the server, want 1", client.sessions.ItemCount(), b.sessions.ItemCount())
+	}
+	if err := client.CloseSession(bAddr); err != nil {
+		t.Fatalf("CloseSession() error = %v", err)
+	}
+	if client.sessions.ItemCount() != 0 {
+		t.Fatalf("sessions after CloseSession() = %d, want 0", client.sessions.ItemCount())
+	}
+	if b.sessions.ItemCount() != 0 {
+		t.Fatal("server kept its session after Close")
+	}
+}
+
+func TestServerClosesClientSession(t *testing.T) {
+	clients := make(chan string, 2)
+	s := NewServer()
+	s.GET("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		clients <- message.Sender.String()
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+	client := NewClient(WithSessionTTL(time.Minute))
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.GET("coaps://" + addr + "/secure"); err != nil {
+			t.Fatalf("GET() error = %v", err)
+		}
+		if client.sessions.ItemCount() != 1 {
+			t.Fatalf("client sessions = %d, want 1", client.sessions.ItemCount())
+		}
+		// The control message reaches the socket the client keeps open to the server.
+		if err := s.CloseSession(<-clients); err != nil {
+			t.Fatalf("CloseSession() error = %v", err)
+		}
+		if client.sessions.ItemCount() != 0 {
+			t.Fatal("client kept its session")
+		}
+	}
+}
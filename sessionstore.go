@@ -0,0 +1,252 @@
+package coalago
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+// SessionStore keeps the coaps sessions of a Client or Server by an opaque key. The
+// store decides how long idle sessions live: a session is Set again every time it is
+// used. Sessions are values, but copies share their sequence state, so a store must
+// keep the value it was given rather than a serialized copy while the process runs.
+type SessionStore interface {
+	Get(key string) (session.SecuredSession, bool)
+	Set(key string, ses session.SecuredSession)
+	Delete(key string)
+	// Range calls f for every live session until f returns false.
+	Range(f func(key string, ses session.SecuredSession) bool)
+}
+
+// WithSessionStore makes the Client or Server keep its coaps sessions in store instead
+// of an in-memory cache; WithSessionTTL then has no effect. Clients without their own
+// store or TTL share the sessions of the process.
+func WithSessionStore(store SessionStore) Opt {
+	return func(opts *coalaopts) {
+		opts.sessionStore = store
+	}
+}
+
+// memorySessionStore is the default SessionStore, a sharded cache with a TTL.
+type memorySessionStore struct {
+	cache *shardedCache
+}
+
+// NewMemorySessionStore returns the in-memory SessionStore used by default, which drops
+// sessions idle for longer than ttl.
+func NewMemorySessionStore(ttl time.Duration) SessionStore {
+	return &memorySessionStore{cache: newShardedCache(ttl)}
+}
+
+func (m *memorySessionStore) Get(key string) (session.SecuredSession, bool) {
+	v, ok := m.cache.Get(key)
+	if !ok {
+		return session.SecuredSession{}, false
+	}
+	return v.(session.SecuredSession), true
+}
+
+func (m *memorySessionStore) Set(key string, ses session.SecuredSession) {
+	m.cache.Set(key, ses)
+}
+
+func (m *memorySessionStore) Delete(key string) {
+	m.cache.Delete(key)
+}
+
+func (m *memorySessionStore) Range(f func(key string, ses session.SecuredSession) bool) {
+	m.cache.Range(func(key string, value interface{}) bool {
+		return f(key, value.(session.SecuredSession))
+	})
+}
+
+func (m *memorySessionStore) ItemCount() int {
+	return m.cache.ItemCount()
+}
+
+// FileSessionStore is an in-memory SessionStore that saves its sessions to a file, so
+// peers do not all have to handshake again after a restart. The file is encrypted with
+// AES-GCM under a key derived from a secret, written with mode 0600 and replaced
+// atomically.
+//
+// Sessions are written by Save, every interval after SaveEvery; Server.Close saves the
+// store of the server. Only sessions with sequence-number nonces are saved (see
+// session.FeatureSequenceNonce): their send sequence resumes past the saved one after
+// a restore, and NewFileSessionStore writes that back before returning, so neither a
+// stale file nor a second restore of the same file can make a session reuse a nonce.
+// Legacy sessions handshake again.
+//
+// The replay window is restored as saved: messages a session received after the last
+// Save are accepted once more after a crash, so a recording of them can be replayed.
+// The window cannot be moved ahead like the send sequence, as the peer keeps numbering
+// from where it is and its next messages would be dropped. SaveEvery bounds that
+// interval; Server.CloseSession makes the peer replace a restored session where it
+// matters.
+type FileSessionStore struct {
+	memorySessionStore
+	path string
+	aead cipher.AEAD
+	mx   sync.Mutex // serializes Save
+}
+
+// NewFileSessionStore opens the store saved at path, if the file exists. secret
+// protects the file; sessions idle for longer than ttl expire, also while on disk.
+func NewFileSessionStore(path string, secret []byte, ttl time.Duration) (*FileSessionStore, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("session store secret is empty")
+	}
+	key := sha256.Sum256(append([]byte("coala session store "), secret...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &FileSessionStore{
+		memorySessionStore: memorySessionStore{cache: newShardedCache(ttl)},
+		path:               path,
+		aead:               aead,
+	}
+	if err := fs.load(); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fs, nil
+		}
+		return nil, err
+	}
+	// The restored sessions send past the saved sequence: that has to be on disk
+	// before they seal, or a crash now makes the next restore reuse their nonces.
+	if err := fs.Save(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Save writes the live sessions to the file.
+func (fs *FileSessionStore) Save() error {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+
+	// entry: key length u16, key, expiry (Unix nanoseconds) u64, session length u16, session
+	var plain []byte
+	var err error
+	fs.cache.rangeItems(func(key string, item cacheItem) bool {
+		ses := item.value.(session.SecuredSession)
+		if !ses.Features.Has(session.FeatureSequenceNonce) {
+			return true
+		}
+		var data []byte
+		if data, err = ses.MarshalBinary(); err != nil {
+			return false
+		}
+		plain = binary.BigEndian.AppendUint16(plain, uint16(len(key)))
+		plain = append(plain, key...)
+		plain = binary.BigEndian.AppendUint64(plain, uint64(item.expiresAt.UnixNano()))
+		plain = binary.BigEndian.AppendUint16(plain, uint16(len(data)))
+		plain = append(plain, data...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, fs.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := fs.aead.Seal(nonce, nonce, plain, nil)
+
+	tmp := fs.path + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fs.path)
+}
+
+// SaveEvery saves the store every interval until stop is called, so the state lost in
+// a crash is at most interval old. A failed save is printed and retried at the next
+// interval. A zero or negative interval saves nothing.
+func (fs *FileSessionStore) SaveEvery(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := fs.Save(); err != nil {
+					fmt.Println("session store save error:", err.Error())
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (fs *FileSessionStore) load() error {
+	sealed, err := os.ReadFile(fs.path)
+	if err != nil {
+		return err
+	}
+	n := fs.aead.NonceSize()
+	if len(sealed) < n {
+		return ErrSessionFileCorrupted
+	}
+	plain, err := fs.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return ErrSessionFileCorrupted
+	}
+
+	now := time.Now()
+	for len(plain) > 0 {
+		key, rest, ok := cutField(plain)
+		if !ok || len(rest) < 8 {
+			return ErrSessionFileCorrupted
+		}
+		expiresAt := time.Unix(0, int64(binary.BigEndian.Uint64(rest)))
+		data, rest, ok := cutField(rest[8:])
+		if !ok {
+			return ErrSessionFileCorrupted
+		}
+		plain = rest
+
+		if expiresAt.Before(now) {
+			continue
+		}
+		var ses session.SecuredSession
+		if err := ses.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		fs.cache.setItem(string(key), cacheItem{value: ses, expiresAt: expiresAt})
+	}
+	return nil
+}
+
+// cutField splits a field prefixed with its u16 length off b.
+func cutField(b []byte) (field, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
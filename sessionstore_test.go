@@ -0,0 +1,112 @@
+package coalago
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+func TestFileSessionStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions")
+	secret := []byte("store-secret")
+	openStore := func() *FileSessionStore {
+		store, err := NewFileSessionStore(path, secret, time.Minute)
+		if err != nil {
+			t.Fatalf("NewFileSessionStore() error = %v", err)
+		}
+		return store
+	}
+	newB := func() *Server {
+		b := NewServer(WithSessionStore(openStore()))
+		b.GET("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+			return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+		})
+		return b
+	}
+
+	a := NewServer()
+	startTestServer(t, a)
+	b := newB()
+	bAddr := startTestServer(t, b)
+	secureGET(t, a, bAddr)
+
+	// Close saves the sessions; the restarted server picks them up.
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	startTestServerAt(t, newB(), bAddr)
+
+	handshakes := MetricSuccessfulHandhshakes.Val()
+	secureGET(t, a, bAddr)
+	if got := MetricSuccessfulHandhshakes.Val() - handshakes; got != 0 {
+		t.Fatalf("handshakes after restart = %d, want 0", got)
+	}
+
+	if _, err := NewFileSessionStore(path, []byte("wrong"), time.Minute); !errors.Is(err, ErrSessionFileCorrupted) {
+		t.Fatalf("NewFileSessionStore(wrong secret) error = %v, want %v", err, ErrSessionFileCorrupted)
+	}
+}
+
+func TestFileSessionStoreSaveEvery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions")
+	store, err := NewFileSessionStore(path, []byte("store-secret"), time.Minute)
+	if err != nil {
+		t.Fatalf("NewFileSessionStore() error = %v", err)
+	}
+	ses, _ := newSessionPair(t, session.SupportedFeatures)
+	store.Set("key", ses)
+
+	stop := store.SaveEvery(10 * time.Millisecond)
+	defer stop()
+	for deadline := time.Now().Add(time.Second); ; {
+		restored, err := NewFileSessionStore(path, []byte("store-secret"), time.Minute)
+		if err != nil {
+			t.Fatalf("NewFileSessionStore() error = %v", err)
+		}
+		if _, ok := restored.Get("key"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("SaveEvery() did not save the session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileSessionStoreRestoresTwice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions")
+	secret := []byte("store-secret")
+	store, err := NewFileSessionStore(path, secret, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFileSessionStore() error = %v", err)
+	}
+	ses, _ := newSessionPair(t, session.SupportedFeatures)
+	store.Set("key", ses)
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// Each restore seals a message and crashes before the next save.
+	used := make(map[uint64]bool)
+	for i := 0; i < 2; i++ {
+		restored, err := NewFileSessionStore(path, secret, time.Minute)
+		if err != nil {
+			t.Fatalf("NewFileSessionStore() error = %v", err)
+		}
+		ses, ok := restored.Get("key")
+		if !ok {
+			t.Fatal("session was not restored")
+		}
+		seq, err := ses.NextSequence()
+		if err != nil {
+			t.Fatalf("NextSequence() error = %v", err)
+		}
+		if used[seq] {
+			t.Fatalf("restore %d reused sequence number %d", i+1, seq)
+		}
+		used[seq] = true
+	}
+}
@@ -2,7 +2,9 @@ package coalago
 
 import (
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coalalib/coalago/session"
@@ -90,6 +92,36 @@ func (c *shardedCache) LoadOrStore(key string, value interface{}) (interface{},
 	return value, false
 }
 
+// Range calls f for every item that has not expired, until f returns false.
+func (c *shardedCache) Range(f func(key string, value interface{}) bool) {
+	c.rangeItems(func(key string, item cacheItem) bool {
+		return f(key, item.value)
+	})
+}
+
+func (c *shardedCache) rangeItems(f func(key string, item cacheItem) bool) {
+	now := time.Now()
+	for _, shard := range c.shards {
+		stop := false
+		shard.Range(func(k, v interface{}) bool {
+			item := v.(cacheItem)
+			if now.After(item.expiresAt) {
+				return true
+			}
+			stop = !f(k.(string), item)
+			return !stop
+		})
+		if stop {
+			return
+		}
+	}
+}
+
+// setItem stores an item with its own expiry, e.g. one restored from disk.
+func (c *shardedCache) setItem(key string, item cacheItem) {
+	c.shard(key).Store(key, item)
+}
+
 func (c *shardedCache) cleanupLoop() {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
@@ -133,7 +165,10 @@ func fnv32(key string) uint32 {
 // sessionStorageImpl using shardedCache
 
 type sessionStorageImpl struct {
-	storage *shardedCache
+	store SessionStore
+	// watcher is set once a Server registers OnSessionExpired, see watch
+	watcher   atomic.Pointer[sessionWatch]
+	watchOnce sync.Once
 }
 
 // sessionStorages tracks every session pool in the process (the global client pool and
@@ -144,9 +179,11 @@ var (
 )
 
 func newSessionStorageImpl(ttl time.Duration) *sessionStorageImpl {
-	s := &sessionStorageImpl{
-		storage: newShardedCache(ttl),
-	}
+	return newSessionStorage(NewMemorySessionStore(ttl))
+}
+
+func newSessionStorage(store SessionStore) *sessionStorageImpl {
+	s := &sessionStorageImpl{store: store}
 	sessionStoragesMu.Lock()
 	sessionStorages = append(sessionStorages, s)
 	sessionStoragesMu.Unlock()
@@ -164,45 +201,82 @@ func sessionsTotalCount() int {
 	return total
 }
 
-func (s *sessionStorageImpl) Set(sender, receiver, proxy string, sess session.SecuredSession) {
+// sessionKey builds the storage key of a session. Proxied sessions are shared by all
+// local addresses. The parts are separated so that DeletePeer can tell them apart.
+func sessionKey(sender, receiver, proxy string) string {
 	if proxy != "" {
 		sender = ""
 	}
-	s.storage.Set(sender+receiver+proxy, sess)
+	return sender + "|" + receiver + "|" + proxy
 }
 
-func (s *sessionStorageImpl) Get(sender, receiver, proxy string) (session.SecuredSession, bool) {
-	if proxy != "" {
-		sender = ""
+// sharedSessionKey drops the local address from a session key: the nodes of a cluster
+// listen on different addresses but serve the same peers.
+func sharedSessionKey(key string) string {
+	if i := strings.IndexByte(key, '|'); i >= 0 {
+		return key[i:]
 	}
-	v, ok := s.storage.Get(sender + receiver + proxy)
-	if !ok {
-		return session.SecuredSession{}, false
+	return key
+}
+
+func (s *sessionStorageImpl) Set(sender, receiver, proxy string, sess session.SecuredSession) {
+	key := sessionKey(sender, receiver, proxy)
+	s.store.Set(key, sess)
+	if w := s.watcher.Load(); w != nil {
+		w.set(key, sess)
 	}
-	return v.(session.SecuredSession), true
+}
+
+func (s *sessionStorageImpl) Get(sender, receiver, proxy string) (session.SecuredSession, bool) {
+	return s.store.Get(sessionKey(sender, receiver, proxy))
 }
 
 func (s *sessionStorageImpl) Delete(sender, receiver, proxy string) {
-	if proxy != "" {
-		sender = ""
+	key := sessionKey(sender, receiver, proxy)
+	s.store.Delete(key)
+	if w := s.watcher.Load(); w != nil {
+		w.delete(key)
 	}
-	s.storage.Delete(sender + receiver + proxy)
 }
 
 func (s *sessionStorageImpl) LoadOrStore(sender, receiver, proxy string, sess session.SecuredSession) (session.SecuredSession, bool) {
-	if proxy != "" {
-		sender = ""
-	}
-	key := sender + receiver + proxy
-	if v, ok := s.storage.Get(key); ok {
-		return v.(session.SecuredSession), true
+	key := sessionKey(sender, receiver, proxy)
+	if existing, ok := s.store.Get(key); ok {
+		return existing, true
 	}
-	s.storage.Set(key, sess)
+	s.Set(sender, receiver, proxy, sess)
 	return sess, false
 }
 
+// DeletePeer removes the direct (not proxied) sessions with receiver from every local
+// address and returns how many were removed.
+func (s *sessionStorageImpl) DeletePeer(receiver string) int {
+	var keys []string
+	s.store.Range(func(key string, _ session.SecuredSession) bool {
+		if parts := strings.Split(key, "|"); len(parts) == 3 && parts[1] == receiver && parts[2] == "" {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		s.store.Delete(key)
+		if w := s.watcher.Load(); w != nil {
+			w.delete(key)
+		}
+	}
+	return len(keys)
+}
+
 func (s *sessionStorageImpl) ItemCount() int {
-	return s.storage.ItemCount()
+	if counter, ok := s.store.(interface{ ItemCount() int }); ok {
+		return counter.ItemCount()
+	}
+	total := 0
+	s.store.Range(func(string, session.SecuredSession) bool {
+		total++
+		return true
+	})
+	return total
 }
 
 // proxySessionStorage using shardedCache
@@ -0,0 +1,76 @@
+package coalago
+
+import (
+	"context"
+	"io"
+)
+
+// Stream sends a confirmable message like SendContext, but writes the body of the
+// response as it arrives instead of collecting it in Response.Body: the blocks of a
+// Block2 transfer are written in order while later ones are still being received.
+// start is called once with the response without its body, before anything is
+// written, and returns the writer for the body; an error from the writer aborts the
+// transfer. The returned Response has no Body; its RTT, Retransmissions and Blocks
+// are only filled in when Stream returns.
+func (c *Client) Stream(ctx context.Context, message *CoAPMessage, addr string, start func(*Response) io.Writer) (*Response, error) {
+	stream := &responseStream{start: start}
+	message.stream = stream
+	message.Context = ctx
+
+	release, err := c.acquire(message, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	conn, err := c.pool.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	c.applyAckTimeout(message)
+	tr := c.newTransport(conn)
+	tr.stats = new(exchangeStats)
+	resp, err := tr.Send(message)
+	if err != nil {
+		return nil, err
+	}
+	// A response in a single message, or the rest of a streamed one
+	if err := stream.write(resp, map[int][]byte{stream.next: resp.Payload.Bytes()}); err != nil {
+		return nil, err
+	}
+	tr.stats.fill(stream.head)
+	return stream.head, nil
+}
+
+// responseStream hands the body of a response to the writer of Client.Stream.
+type responseStream struct {
+	start func(*Response) io.Writer
+	head  *Response
+	w     io.Writer
+	next  int // number of the next block to write
+}
+
+// write starts the stream with the first response message and writes the blocks of buf
+// that follow the ones already written, removing them from buf.
+func (s *responseStream) write(message *CoAPMessage, buf map[int][]byte) error {
+	if s.w == nil {
+		s.head = newResponse(message)
+		s.head.Body = nil
+		s.w = s.start(s.head)
+	}
+	for {
+		b, ok := buf[s.next]
+		if !ok {
+			return nil
+		}
+		if len(b) > 0 {
+			if _, err := s.w.Write(b); err != nil {
+				return err
+			}
+		}
+		delete(buf, s.next)
+		s.next++
+	}
+}
@@ -0,0 +1,82 @@
+package coalago
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("client went away") }
+
+func TestClientStream(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	s := NewServer()
+	s.GET("/big", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		result := NewResponse(NewBytesPayload(big), CoapCodeContent)
+		result.MediaType = MediaTypeApplicationOctetStream
+		return result
+	})
+	s.GET("/small", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	})
+	addr := startTestServer(t, s)
+	client := NewClient()
+
+	for _, tt := range []struct {
+		path string
+		want []byte
+	}{{"/big", big}, {"/small", []byte("ok")}} {
+		message := NewCoAPMessage(CON, GET)
+		message.SetURIPath(tt.path)
+		var body bytes.Buffer
+		starts := 0
+		resp, err := client.Stream(context.Background(), message, addr, func(head *Response) io.Writer {
+			starts++
+			if head.Code != CoapCodeContent {
+				t.Errorf("%s: head code = %v", tt.path, head.Code)
+			}
+			return &body
+		})
+		if err != nil {
+			t.Fatalf("%s: Stream() error = %v", tt.path, err)
+		}
+		if starts != 1 || !bytes.Equal(body.Bytes(), tt.want) {
+			t.Fatalf("%s: start called %d times, body %d bytes, want %d", tt.path, starts, body.Len(), len(tt.want))
+		}
+		if len(resp.Body) != 0 {
+			t.Fatalf("%s: Stream() returned a Body", tt.path)
+		}
+	}
+
+	// A failing writer aborts the transfer.
+	message := NewCoAPMessage(CON, GET)
+	message.SetURIPath("/big")
+	resp, err := client.Stream(context.Background(), message, addr, func(*Response) io.Writer { return failingWriter{} })
+	if err == nil {
+		t.Fatal("Stream() into a failing writer succeeded")
+	}
+	if resp != nil {
+		t.Fatal("Stream() returned a response after the writer failed")
+	}
+
+	// The content format of a Block2 response reaches the client.
+	message = NewCoAPMessage(CON, GET)
+	message.SetURIPath("/big")
+	full, err := client.Send(message, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var format *CoAPMessageOption
+	for _, opt := range full.Options {
+		if opt.Code == OptionContentFormat {
+			format = opt
+		}
+	}
+	if format == nil || MediaType(format.IntValue()) != MediaTypeApplicationOctetStream {
+		t.Fatal("Block2 response lost its Content-Format")
+	}
+}
@@ -2,6 +2,7 @@ package coalago
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -12,9 +13,11 @@ import (
 
 var (
 	ErrUnsupportedType = errors.New("unsupported type of message")
-	globalSessions     = newSessionStorageImpl(SESSIONS_POOL_EXPIRATION)
-	proxyIDSessions    = newProxySessionStorage(SESSIONS_POOL_EXPIRATION)
-	connStorage        = newConnectionStorage(SESSIONS_POOL_EXPIRATION)
+	// Process-wide storages of the clients without their own session TTL, of proxy
+	// IDs and of servers not built by NewServer; they use the default session TTL.
+	globalSessions  = newSessionStorageImpl(defaultOptions.sessionTTL)
+	proxyIDSessions = newProxySessionStorage(defaultOptions.sessionTTL)
+	connStorage     = newConnectionStorage(defaultOptions.sessionTTL)
 )
 
 func init() {
@@ -30,11 +33,17 @@ type transport struct {
 	conn           Transport
 	block2channels sync.Map
 	privateKey     []byte
+	// opts is the configuration of the owning Client or Server; nil means package defaults.
+	opts *coalaopts
 	// sessions is the session storage of the owning Server. Server-side transports must
 	// not share secured sessions across Server instances: each server has its own key
 	// pair, and the storage key omits the local address for proxied peers, so a shared
 	// pool lets one server's session overwrite another's for the same peer+proxy.
 	sessions *sessionStorageImpl
+	// hooks are the session callbacks of the owning Server, nil for clients.
+	hooks *sessionHooks
+	// stats collects the metadata of a client exchange, nil for servers.
+	stats *exchangeStats
 }
 
 func newtransport(conn Transport) *transport {
@@ -53,50 +62,77 @@ func (tr *transport) sessionStorage() *sessionStorageImpl {
 	return globalSessions
 }
 
+// config returns the configuration of the owning Client or Server.
+func (tr *transport) config() *coalaopts {
+	if tr.opts != nil {
+		return tr.opts
+	}
+	return defaultOptions
+}
+
 func (tr *transport) SetPrivateKey(pk []byte) {
 	tr.privateKey = pk
 }
 
+// watchContext unblocks a pending read on the transport connection as soon as ctx is done,
+// so retransmission loops notice the cancellation without waiting for the read timeout.
+func (sr *transport) watchContext(ctx context.Context) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		sr.conn.SetReadDeadlineSec(-1)
+	})
+}
+
 func (sr *transport) Send(message *CoAPMessage) (resp *CoAPMessage, err error) {
+	if ctx := message.Context; ctx != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		stop := sr.watchContext(ctx)
+		defer stop()
+	}
+
 	switch message.Type {
 	case CON:
-		if message.GetScheme() == COAPS_SCHEME {
-			proxyAddr := message.ProxyAddr
-			if len(proxyAddr) > 0 {
-				proxyID := setProxyIDIfNeed(message, sr.conn.LocalAddr().String())
-				proxyAddr = fmt.Sprintf("%v%v", proxyAddr, proxyID)
-			}
-
-			_, err := handshake(sr, message, sr.conn.RemoteAddr(), proxyAddr)
-			if err != nil {
-				return nil, err
-			}
+		if err := sr.secure(message); err != nil {
+			return nil, err
 		}
 
 		resp, err := sr.sendCON(message)
 		if err == ErrorSessionExpired || err == ErrorSessionNotFound ||
 			err == ErrorClientSessionExpired || err == ErrorClientSessionNotFound {
-			if message.GetScheme() == COAPS_SCHEME {
-				proxyAddr := message.ProxyAddr
-				if len(proxyAddr) > 0 {
-					proxyID := setProxyIDIfNeed(message, sr.conn.LocalAddr().String())
-					proxyAddr = fmt.Sprintf("%v%v", proxyAddr, proxyID)
-				}
-				if _, err := handshake(sr, message, sr.conn.RemoteAddr(), proxyAddr); err != nil {
-					return nil, err
-				}
+			if err := sr.secure(message); err != nil {
+				return nil, err
 			}
-
 			resp, err = sr.sendCON(message)
 		}
 		return resp, err
-	case RST, NON:
+	case NON:
+		if err := sr.secure(message); err != nil {
+			return nil, err
+		}
+		return nil, sr.sendToSocket(message)
+	case RST:
 		return nil, sr.sendToSocket(message)
 	default:
 		return nil, ErrUnsupportedType
 	}
 }
 
+// secure performs the coaps handshake for a coaps message if there is no session with
+// the peer yet.
+func (sr *transport) secure(message *CoAPMessage) error {
+	if message.GetScheme() != COAPS_SCHEME {
+		return nil
+	}
+	proxyAddr := message.ProxyAddr
+	if len(proxyAddr) > 0 {
+		proxyID := setProxyIDIfNeed(message, sr.conn.LocalAddr().String())
+		proxyAddr = fmt.Sprintf("%v%v", proxyAddr, proxyID)
+	}
+	_, err := handshake(sr, message, sr.conn.RemoteAddr(), proxyAddr)
+	return err
+}
+
 func (sr *transport) SendTo(message *CoAPMessage, addr net.Addr) (resp *CoAPMessage, err error) {
 	switch message.Type {
 	case ACK, NON, RST:
@@ -107,7 +143,8 @@ func (sr *transport) SendTo(message *CoAPMessage, addr net.Addr) (resp *CoAPMess
 }
 
 func (sr *transport) sendCON(message *CoAPMessage) (resp *CoAPMessage, err error) {
-	if isBigPayload(message) {
+	cfg := sr.config()
+	if isBigPayload(message, cfg.blockSize) {
 		resp, err = sr.sendARQBlock1CON(message)
 		return
 	}
@@ -118,22 +155,25 @@ func (sr *transport) sendCON(message *CoAPMessage) (resp *CoAPMessage, err error
 	}
 
 	attempts := 0
+	backoff := cfg.backoff(message.Timeout)
 
 	for {
 		if attempts > 0 {
 			MetricRetransmitMessages.Inc()
+			sr.stats.retransmitted()
 		}
 		attempts++
 		MetricSentMessages.Inc()
+		sent := time.Now()
 		_, err = sr.conn.Write(data)
 		if err != nil {
 			MetricSentMessageErrors.Inc()
 			return nil, err
 		}
 
-		resp, err = receiveMessage(sr, message)
+		resp, err = receiveMessage(sr, message, backoff.Next())
 		if err == ErrMaxAttempts {
-			if attempts == maxSendAttempts {
+			if attempts == cfg.maxAttempts() {
 				MetricExpiredMessages.Inc()
 				return nil, err
 			}
@@ -142,6 +182,7 @@ func (sr *transport) sendCON(message *CoAPMessage) (resp *CoAPMessage, err error
 		if err != nil {
 			return nil, err
 		}
+		sr.stats.replied(sent)
 
 		if isPingACK(resp) {
 			return resp, nil
@@ -169,7 +210,7 @@ func isPingACK(resp *CoAPMessage) bool {
 
 func (sr *transport) sendACKTo(message *CoAPMessage, addr net.Addr) (err error) {
 	if message.Type == ACK {
-		if isBigPayload(message) {
+		if isBigPayload(message, sr.config().blockSize) {
 			ch := make(chan *CoAPMessage, 102400)
 			id := addr.String() + message.GetTokenString()
 			sr.block2channels.Store(id, ch)
@@ -221,16 +262,17 @@ func (sr *transport) sendPackets(packets []*packet, windowsize *int, shift int,
 		stop = len(packets)
 	}
 	var acked int
+	cfg := sr.config()
 
 	for i := shift; i < stop; i++ {
 		if !packets[i].acked {
-			if time.Since(packets[i].lastSend) >= timeWait {
-				if packets[i].attempts > 0 && *windowsize >= MIN_WiNDOW_SIZE {
+			if time.Since(packets[i].lastSend) >= cfg.ackTimeout {
+				if packets[i].attempts > 0 && *windowsize >= cfg.minWindowSize {
 					MetricRetransmitMessages.Inc()
 					*localMetricsRetransmitMessages++
 				}
 
-				if packets[i].attempts == maxSendAttempts {
+				if packets[i].attempts == cfg.maxAttempts() {
 					MetricExpiredMessages.Inc()
 					return ErrMaxAttempts
 				}
@@ -239,6 +281,9 @@ func (sr *transport) sendPackets(packets []*packet, windowsize *int, shift int,
 				}
 				packets[i].attempts++
 				packets[i].lastSend = time.Now()
+				if packets[i].attempts > 1 {
+					sr.stats.retransmitted()
+				}
 
 				if err := sr.sendToSocket(packets[i].message); err != nil {
 					return err
@@ -269,10 +314,11 @@ func (sr *transport) sendPacketsToAddr(packets []*packet, windowsize *int, shift
 	}
 
 	var acked int
+	cfg := sr.config()
 	for i := shift; i < stop; i++ {
 		if !packets[i].acked {
-			if time.Since(packets[i].lastSend) >= timeWait {
-				if packets[i].attempts == maxSendAttempts {
+			if time.Since(packets[i].lastSend) >= cfg.ackTimeout {
+				if packets[i].attempts == cfg.maxAttempts() {
 					MetricExpiredMessages.Inc()
 					return ErrMaxAttempts
 				}
@@ -283,7 +329,7 @@ func (sr *transport) sendPacketsToAddr(packets []*packet, windowsize *int, shift
 
 				packets[i].attempts++
 
-				if packets[i].attempts > 1 && *windowsize > MIN_WiNDOW_SIZE {
+				if packets[i].attempts > 1 && *windowsize > cfg.minWindowSize {
 					MetricRetransmitMessages.Inc()
 					*localMetricsRetransmitMessages++
 				}
@@ -302,16 +348,17 @@ func (sr *transport) sendPacketsToAddr(packets []*packet, windowsize *int, shift
 
 func (sr *transport) sendARQBlock1CON(message *CoAPMessage) (*CoAPMessage, error) {
 
+	cfg := sr.config()
 	state := new(stateSend)
 	state.payload = message.Payload.Bytes()
 	state.lenght = len(state.payload)
 	state.origMessage = message
-	state.blockSize = MAX_PAYLOAD_SIZE
-	numblocks := math.Ceil(float64(state.lenght) / float64(MAX_PAYLOAD_SIZE))
-	if int(numblocks) < DEFAULT_WINDOW_SIZE {
+	state.blockSize = cfg.blockSize
+	numblocks := math.Ceil(float64(state.lenght) / float64(cfg.blockSize))
+	if int(numblocks) < cfg.windowSize {
 		state.windowsize = int(numblocks)
 	} else {
-		state.windowsize = DEFAULT_WINDOW_SIZE
+		state.windowsize = cfg.windowSize
 	}
 
 	packets := []*packet{}
@@ -335,14 +382,18 @@ func (sr *transport) sendARQBlock1CON(message *CoAPMessage) (*CoAPMessage, error
 	var balancerCounter = 0
 	var overflowIndicator = 0
 
+	sr.stats.addBlocks(len(packets))
+	sent := time.Now()
 	err := sr.sendPackets(packets, &state.windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator)
 
 	if err != nil {
 		return nil, err
 	}
 
+	timeout := message.Timeout
 	for {
-		resp, err := receiveMessage(sr, message)
+		resp, err := receiveMessage(sr, message, timeout)
+		timeout = cfg.ackTimeout
 		if err != nil {
 			if err == ErrMaxAttempts {
 				if err = sr.sendPackets(packets, &state.windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator); err != nil {
@@ -352,6 +403,7 @@ func (sr *transport) sendARQBlock1CON(message *CoAPMessage) (*CoAPMessage, error
 			}
 			return nil, err
 		}
+		sr.stats.replied(sent)
 
 		if resp.Type == ACK {
 			if resp.Type == ACK && resp.Code == CoapCodeEmpty {
@@ -395,11 +447,11 @@ func (sr *transport) sendARQBlock1CON(message *CoAPMessage) (*CoAPMessage, error
 						state.windowsize += dt
 						retransmitsTmp = localMetricsRetransmitMessages
 
-						if state.windowsize < MIN_WiNDOW_SIZE {
-							state.windowsize = MIN_WiNDOW_SIZE
+						if state.windowsize < cfg.minWindowSize {
+							state.windowsize = cfg.minWindowSize
 						}
-						if state.windowsize > MAX_WINDOW_SIZE {
-							state.windowsize = MAX_WINDOW_SIZE
+						if state.windowsize > cfg.maxWindowSize {
+							state.windowsize = cfg.maxWindowSize
 						}
 
 					}
@@ -415,16 +467,17 @@ func (sr *transport) sendARQBlock1CON(message *CoAPMessage) (*CoAPMessage, error
 }
 
 func (sr *transport) sendARQBlock2ACK(input chan *CoAPMessage, message *CoAPMessage, addr net.Addr) error {
+	cfg := sr.config()
 	state := new(stateSend)
 	state.payload = message.Payload.Bytes()
 	state.lenght = len(state.payload)
 	state.origMessage = message
-	state.blockSize = MAX_PAYLOAD_SIZE
-	numblocks := math.Ceil(float64(state.lenght) / float64(MAX_PAYLOAD_SIZE))
-	if int(numblocks) < DEFAULT_WINDOW_SIZE {
+	state.blockSize = cfg.blockSize
+	numblocks := math.Ceil(float64(state.lenght) / float64(cfg.blockSize))
+	if int(numblocks) < cfg.windowSize {
 		state.windowsize = int(numblocks)
 	} else {
-		state.windowsize = DEFAULT_WINDOW_SIZE
+		state.windowsize = cfg.windowSize
 	}
 
 	packets := []*packet{}
@@ -500,11 +553,11 @@ func (sr *transport) sendARQBlock2ACK(input chan *CoAPMessage, message *CoAPMess
 								state.windowsize += dt
 								retransmitsTmp = localMetricsRetransmitMessages
 
-								if state.windowsize < MIN_WiNDOW_SIZE {
-									state.windowsize = MIN_WiNDOW_SIZE
+								if state.windowsize < cfg.minWindowSize {
+									state.windowsize = cfg.minWindowSize
 								}
-								if state.windowsize > MAX_WINDOW_SIZE {
-									state.windowsize = MAX_WINDOW_SIZE
+								if state.windowsize > cfg.maxWindowSize {
+									state.windowsize = cfg.maxWindowSize
 								}
 							}
 
@@ -515,7 +568,9 @@ func (sr *transport) sendARQBlock2ACK(input chan *CoAPMessage, message *CoAPMess
 					}
 				}
 			}
-		case <-time.After(timeWait):
+		case <-message.getContext().Done():
+			return message.getContext().Err()
+		case <-time.After(cfg.ackTimeout):
 			if err := sr.sendPacketsToAddr(packets, &state.windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator, addr); err != nil {
 				return err
 			}
@@ -526,17 +581,41 @@ func (sr *transport) sendARQBlock2ACK(input chan *CoAPMessage, message *CoAPMess
 func (sr *transport) receiveARQBlock2(origMessage *CoAPMessage, inputMessage *CoAPMessage) (rsp *CoAPMessage, err error) {
 	buf := make(map[int][]byte)
 	totalBlocks := -1
+	received := 0 // distinct blocks, including the ones already handed to a stream
+	stream := origMessage.stream
 	var attempts int
+	cfg := sr.config()
+
+	// addBlock stores a block and reports whether the body is complete
+	addBlock := func(message *CoAPMessage, block *block) (bool, error) {
+		if !block.MoreBlocks {
+			totalBlocks = block.BlockNumber + 1
+		}
+		if _, dup := buf[block.BlockNumber]; !dup && (stream == nil || block.BlockNumber >= stream.next) {
+			buf[block.BlockNumber] = message.Payload.Bytes()
+			received++
+		}
+		if stream != nil {
+			if err := stream.write(message, buf); err != nil {
+				return false, err
+			}
+		}
+		if totalBlocks != received {
+			return false, nil
+		}
+		sr.stats.addBlocks(totalBlocks)
+		return true, nil
+	}
 
 	if inputMessage != nil {
 		block := inputMessage.GetBlock2()
 
 		if block != nil && inputMessage.Type == CON {
-			if !block.MoreBlocks {
-				totalBlocks = block.BlockNumber + 1
+			done, err := addBlock(inputMessage, block)
+			if err != nil {
+				return nil, err
 			}
-			buf[block.BlockNumber] = inputMessage.Payload.Bytes()
-			if totalBlocks == len(buf) {
+			if done {
 				b := assembleBlocks(buf, totalBlocks)
 				inputMessage.Payload = NewBytesPayload(b)
 
@@ -557,9 +636,9 @@ func (sr *transport) receiveARQBlock2(origMessage *CoAPMessage, inputMessage *Co
 	}
 
 	for {
-		inputMessage, err = receiveMessage(sr, origMessage)
+		inputMessage, err = receiveMessage(sr, origMessage, cfg.ackTimeout)
 		if err == ErrMaxAttempts {
-			if attempts == maxSendAttempts {
+			if attempts == cfg.maxAttempts() {
 				MetricExpiredMessages.Inc()
 				return nil, err
 			}
@@ -578,13 +657,11 @@ func (sr *transport) receiveARQBlock2(origMessage *CoAPMessage, inputMessage *Co
 			continue
 		}
 
-		if !block.MoreBlocks {
-			totalBlocks = block.BlockNumber + 1
+		done, err := addBlock(inputMessage, block)
+		if err != nil {
+			return nil, err
 		}
-
-		buf[block.BlockNumber] = inputMessage.Payload.Bytes()
-
-		if totalBlocks == len(buf) {
+		if done {
 			b := assembleBlocks(buf, totalBlocks)
 			inputMessage.Payload = NewBytesPayload(b)
 			ack := ackTo(origMessage, inputMessage, CoapCodeEmpty)